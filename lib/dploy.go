@@ -3,8 +3,10 @@ package dploy
 import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	marathon "github.com/gambol99/go-marathon"
 	tw "github.com/olekukonko/tablewriter"
 	yaml "gopkg.in/yaml.v2"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -17,18 +19,35 @@ const (
 	ENV_VAR_DPLOY_LOGLEVEL     string        = "DPLOY_LOGLEVEL"
 	ENV_VAR_DPLOY_EXAMPLES     string        = "DPLOY_EXAMPLES"
 	DEFAULT_DEPLOY_WAIT_TIME   time.Duration = 10
+	DEFAULT_RESTART_WAIT_TIME  time.Duration = 300
+	DEFAULT_UPGRADE_WAIT_TIME  time.Duration = 300
+	DEFAULT_POLL_INTERVAL      time.Duration = 2
+	DEFAULT_MARATHON_TIMEOUT   time.Duration = 10
 	APP_DESCRIPTOR_FILENAME    string        = "dploy.app"
 	DEFAULT_MARATHON_URL       string        = "http://localhost:8080"
 	DEFAULT_APP_NAME           string        = "CHANGEME"
 	MARATHON_APP_SPEC_DIR      string        = "specs/"
 	MARATHON_APP_SPEC_EXT      string        = ".json"
 	MARATHON_LABEL             string        = "DPLOY"
+	MARATHON_LABEL_SUSPENDED   string        = "DPLOY_SUSPENDED_INSTANCES"
+	MARATHON_LABEL_PREVIEW     string        = "DPLOY_PREVIEW"
+	MARATHON_LABEL_CHECKSUM    string        = "DPLOY_SPEC_CHECKSUM"
 	MARATHON_OBSERVER_TEMPLATE string        = "https://raw.githubusercontent.com/mhausenblas/dploy/master/observer/observer.json"
 	MARATHON_OBSERVER_PAT_FILE string        = ".pat"
+	MARATHON_OBSERVER_APP_ID   string        = "dploy-observer"
+	OBSERVER_TOKEN_FILE        string        = ".observer-token"
+	OBSERVER_MODE_WEBHOOK      string        = "webhook"
+	OBSERVER_MODE_POLL         string        = "poll"
+	OBSERVER_SECRET_ENV_PREFIX string        = "DPLOY_OBSERVER_SECRET_"
+	PLAN_CREATE                string        = "create"
+	PLAN_UPDATE                string        = "update"
+	PLAN_UNCHANGED             string        = "unchanged"
 	RESOURCETYPE_PLATFORM      string        = "platform"
 	RESOURCETYPE_APP           string        = "app"
 	RESOURCETYPE_GROUP         string        = "group"
 	CMD_TRUNCATE               int           = 17
+	MESOS_AGENT_PORT           int           = 5051
+	MESOS_HEARTBEAT_INTERVAL   time.Duration = 30
 	EXAMPLE_HELLO_WORLD        string        = "https://raw.githubusercontent.com/mhausenblas/dploy/master/examples/helloworld.json"
 	EXAMPLE_BUZZ               string        = "https://raw.githubusercontent.com/mhausenblas/dploy/master/examples/buzz/buzz.json"
 	EXAMPLE_WP                 string        = "https://raw.githubusercontent.com/mhausenblas/dploy/master/examples/stateful/wordpress.json"
@@ -39,14 +58,118 @@ const (
 	SYSTEM_MSG_OFFLINE         string        = "offline\t💔"
 )
 
+// MarathonTransport carries all requests against the Marathon API. Wrap it to
+// observe these requests, as the observer does to count the failing ones.
+var MarathonTransport http.RoundTripper = http.DefaultTransport
+
 // DployApp is the dploy application deployment descriptor, in short: app descriptor.
 // It defines the connection to the target DC/OS cluster as well as the app properties.
 type DployApp struct {
-	MarathonURL   string `yaml:"marathon_url"`
-	AppName       string `yaml:"app_name"`
-	RepoURL       string `yaml:"repo_url,omitempty"`
-	PublicNode    string `yaml:"public_node,omitempty"`
-	TriggerBranch string `yaml:"trigger_branch,omitempty"`
+	MarathonURL          string         `yaml:"marathon_url"`
+	AppName              string         `yaml:"app_name"`
+	RepoURL              string         `yaml:"repo_url,omitempty"`
+	SCM                  string         `yaml:"scm,omitempty"`
+	PublicNode           string         `yaml:"public_node,omitempty"`
+	TriggerBranch        string         `yaml:"trigger_branch,omitempty"`
+	TriggerTags          string         `yaml:"trigger_tags,omitempty"`
+	TriggerOnSpecChanges bool           `yaml:"trigger_on_spec_changes,omitempty"`
+	Previews             bool           `yaml:"previews,omitempty"`
+	PreviewForks         bool           `yaml:"preview_forks,omitempty"`
+	PreviewAuthors       string         `yaml:"preview_authors,omitempty"`
+	ObserverMode         string         `yaml:"observer_mode,omitempty"`
+	PollInterval         int            `yaml:"poll_interval,omitempty"`
+	WorkspacePath        string         `yaml:"workspace_path,omitempty"`
+	RollbackOnFailure    bool           `yaml:"rollback_on_failure,omitempty"`
+	Approval             bool           `yaml:"approval,omitempty"`
+	ApprovalExpiry       int            `yaml:"approval_expiry,omitempty"`
+	Notifications        []Notification `yaml:"notifications,omitempty"`
+	PATFile              string         `yaml:"pat_file,omitempty"`
+	PATSecret            string         `yaml:"pat_secret,omitempty"`
+	GitHubAppID          int            `yaml:"github_app_id,omitempty"`
+	GitHubInstallationID int            `yaml:"github_app_installation_id,omitempty"`
+	GitHubAppKeyFile     string         `yaml:"github_app_key_file,omitempty"`
+	GitHubAppKeySecret   string         `yaml:"github_app_key_secret,omitempty"`
+	SMTPPasswordSecret   string         `yaml:"smtp_password_secret,omitempty"`
+	ObserverTokenFile    string         `yaml:"observer_token_file,omitempty"`
+}
+
+// Notification is a sink the observer sends messages to on deployment events.
+type Notification struct {
+	Type     string   `yaml:"type" json:"type"`
+	URL      string   `yaml:"url,omitempty" json:"url,omitempty"`
+	SMTPHost string   `yaml:"smtp_host,omitempty" json:"smtp_host,omitempty"`
+	Username string   `yaml:"username,omitempty" json:"username,omitempty"`
+	From     string   `yaml:"from,omitempty" json:"from,omitempty"`
+	To       []string `yaml:"to,omitempty" json:"to,omitempty"`
+	Events   []string `yaml:"events,omitempty" json:"events,omitempty"`
+	Template string   `yaml:"template,omitempty" json:"template,omitempty"`
+}
+
+// AppResult is the outcome of deploying a single µS.
+type AppResult struct {
+	ID        string `json:"id"`
+	Success   bool   `json:"success"`
+	Msg       string `json:"message,omitempty"`
+	Endpoints string `json:"endpoints,omitempty"`
+}
+
+// Deployment is the record of a push-to-deploy carried out by the observer.
+type Deployment struct {
+	ID       string      `json:"id"`
+	Ref      string      `json:"ref"`
+	Commit   string      `json:"commit"`
+	Pusher   string      `json:"pusher"`
+	State    string      `json:"state"`
+	Msg      string      `json:"message,omitempty"`
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished"`
+	Apps     []AppResult `json:"apps,omitempty"`
+}
+
+// Plan is a deployment the observer staged and that awaits approval.
+// The Msg of each app says if it would be created, updated or is unchanged.
+type Plan struct {
+	ID      string      `json:"id"`
+	Ref     string      `json:"ref"`
+	Commit  string      `json:"commit"`
+	Pusher  string      `json:"pusher"`
+	Queued  time.Time   `json:"queued"`
+	Expires time.Time   `json:"expires"`
+	Apps    []AppResult `json:"plan,omitempty"`
+}
+
+// Watch is a repo the observer watches for pushes, along with how to deploy the
+// dploy apps in it. The observer keeps a registry of watches, which launchObserver
+// and killObserver add to and remove from. Rather than carrying a secret itself, a
+// watch can reference an environment variable of the observer holding it, such as a
+// DC/OS secret, via the respective *Ref field; these start with OBSERVER_SECRET_ENV_PREFIX.
+type Watch struct {
+	Owner             string         `json:"owner"`
+	Repo              string         `json:"repo"`
+	RepoURL           string         `json:"repo_url,omitempty"`
+	SCM               string         `json:"scm,omitempty"`
+	PAT               string         `json:"pat,omitempty"`
+	PATRef            string         `json:"pat_ref,omitempty"`
+	AppID             int            `json:"app_id,omitempty"`
+	InstallationID    int            `json:"installation_id,omitempty"`
+	AppKey            string         `json:"app_key,omitempty"`
+	AppKeyRef         string         `json:"app_key_ref,omitempty"`
+	TargetBranch      string         `json:"branch,omitempty"`
+	TagPatterns       []string       `json:"tag_patterns,omitempty"`
+	OnlySpecChanges   bool           `json:"only_spec_changes,omitempty"`
+	WorkspacePath     string         `json:"workspace_path,omitempty"`
+	Previews          bool           `json:"previews,omitempty"`
+	PreviewForks      bool           `json:"preview_forks,omitempty"`
+	PreviewAuthors    []string       `json:"preview_authors,omitempty"`
+	Mode              string         `json:"mode,omitempty"`
+	PollInterval      int            `json:"poll_interval,omitempty"`
+	Approval          bool           `json:"approval,omitempty"`
+	ApprovalExpiry    int            `json:"approval_expiry,omitempty"`
+	RollbackOnFailure bool           `json:"rollback_on_failure,omitempty"`
+	Notifications     []Notification `json:"notifications,omitempty"`
+	SMTPPassword      string         `json:"smtp_password,omitempty"`
+	SMTPPasswordRef   string         `json:"smtp_password_ref,omitempty"`
+	HookSecret        string         `json:"hook_secret,omitempty"`
 }
 
 // Init creates an app descriptor (dploy.app) and the `specs/` directory
@@ -102,7 +225,11 @@ func Init(workdir string, showAll bool) bool {
 func DryRun(workdir string, showAll bool) bool {
 	setLogLevel()
 	fmt.Printf("%s\tKicking the tires! Checking Marathon connection, descriptor and app specs ...\n", USER_MSG_INFO)
-	appDescriptor := readAppDescriptor(workdir)
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
 	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
 	if err != nil {
 		log.WithFields(log.Fields{"cmd": "dryrun"}).Error("Failed to connect to Marathon due to ", err)
@@ -120,7 +247,6 @@ func DryRun(workdir string, showAll bool) bool {
 		fmt.Printf("%s\tTry `dploy init` here first.\n", USER_MSG_INFO)
 		return false
 	} else {
-		appDescriptor := readAppDescriptor(workdir)
 		if strings.HasPrefix(appDescriptor.MarathonURL, "http") {
 			fmt.Printf("%s\tFound an app descriptor\n", USER_MSG_SUCCESS)
 			if appSpecs := getAppSpecs(workdir); len(appSpecs) > 0 {
@@ -135,17 +261,49 @@ func DryRun(workdir string, showAll bool) bool {
 		}
 	}
 	// check for optional push-to-deploy info,
-	// i.e. both a GitHub repo URL and a public node
-	// have been set in the `dploy.app` file
-	patoken, patExists := getPAT(workdir)
-	if appDescriptor.RepoURL != "" && appDescriptor.PublicNode != "" && patExists {
+	// i.e. both a repo URL and a public node (unless
+	// polling) have been set in the `dploy.app` file
+	patoken, patExists := getPAT(appDescriptor, workdir)
+	_, keyExists := getAppKey(appDescriptor, workdir)
+	if pushToDeployConfigured(appDescriptor) && hasCredentials(appDescriptor, patExists, keyExists) {
 		fmt.Printf("%s\tFound stuff I need for push-to-deploy:\n", USER_MSG_SUCCESS)
-		fmt.Printf("\tGitHub repo: %s\n", appDescriptor.RepoURL)
-		fmt.Printf("\tPublic node: %s\n", appDescriptor.PublicNode)
-		fmt.Printf("\tGitHub personal access token: %s\n", strings.Repeat("*", len(patoken)))
+		fmt.Printf("\tRepo: %s\n", appDescriptor.RepoURL)
+		if scm := appDescriptor.SCM; scm != "" {
+			fmt.Printf("\tSCM provider: %s\n", scm)
+		}
+		if appDescriptor.ObserverMode == OBSERVER_MODE_POLL {
+			fmt.Printf("\tPolling the repo for pushes instead of using a Webhook\n")
+			if interval := appDescriptor.PollInterval; interval > 0 {
+				fmt.Printf("\tPoll interval: %d sec\n", interval)
+			}
+		} else {
+			fmt.Printf("\tPublic node: %s\n", appDescriptor.PublicNode)
+		}
+		if id := appDescriptor.GitHubAppID; id != 0 {
+			fmt.Printf("\tGitHub App: %d\n", id)
+			if secret := appDescriptor.GitHubAppKeySecret; secret != "" {
+				fmt.Printf("\tGitHub App private key: from DC/OS secret %s\n", secret)
+			}
+		} else if secret := appDescriptor.PATSecret; secret != "" {
+			fmt.Printf("\tPersonal access token: from DC/OS secret %s\n", secret)
+		} else {
+			fmt.Printf("\tPersonal access token: %s\n", strings.Repeat("*", len(patoken)))
+		}
 		if branch := appDescriptor.TriggerBranch; branch != "" {
 			fmt.Printf("\tTrigger branch: %s\n", branch)
 		}
+		if tags := appDescriptor.TriggerTags; tags != "" {
+			fmt.Printf("\tTrigger tags: %s\n", tags)
+		}
+		if appDescriptor.TriggerOnSpecChanges {
+			fmt.Printf("\tTriggering only on changes of %s or %s\n", APP_DESCRIPTOR_FILENAME, MARATHON_APP_SPEC_DIR)
+		}
+		if ws := appDescriptor.WorkspacePath; ws != "" {
+			fmt.Printf("\tWorkspace path: %s\n", ws)
+		}
+		if appDescriptor.Previews {
+			fmt.Printf("\tDeploying pull requests into preview environments\n")
+		}
 	}
 	fmt.Printf("%s\tNow you can use `dploy ls` to list resources of your app\n", USER_MSG_INFO)
 	fmt.Printf("\tor `dploy run` to launch it via Marathon.\n")
@@ -157,7 +315,11 @@ func DryRun(workdir string, showAll bool) bool {
 func Run(workdir string, showAll bool) bool {
 	setLogLevel()
 	fmt.Printf("%s\tOK, let's rock and roll! Trying to launch your app ...\n", USER_MSG_INFO)
-	appDescriptor := readAppDescriptor(workdir)
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
 	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
 	if err != nil {
 		log.WithFields(log.Fields{"cmd": "run"}).Error("Failed to connect to Marathon due to ", err)
@@ -166,7 +328,11 @@ func Run(workdir string, showAll bool) bool {
 	fmt.Printf("%s\tWorking\n", USER_MSG_INFO)
 	go showSpinner(100 * time.Millisecond)
 	launchObserver(appDescriptor, workdir)
-	marathonCreateApps(*marathonURL, appDescriptor.AppName, workdir)
+	if err := marathonCreateApps(*marathonURL, appDescriptor.AppName, workdir); err != nil {
+		hideSpinner()
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
 	hideSpinner()
 	fmt.Printf("%s\tLaunched your app!\n", USER_MSG_SUCCESS)
 	fmt.Printf("%s\tNow you can use `dploy ps` to list processes\n", USER_MSG_INFO)
@@ -179,7 +345,11 @@ func Run(workdir string, showAll bool) bool {
 func Destroy(workdir string, showAll bool) bool {
 	setLogLevel()
 	fmt.Printf("%s\tSeems you wanna get rid of your app. OK, gonna try and tear it down now ...\n", USER_MSG_INFO)
-	appDescriptor := readAppDescriptor(workdir)
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
 	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
 	if err != nil {
 		log.WithFields(log.Fields{"cmd": "destroy"}).Error("Failed to connect to Marathon due to ", err)
@@ -187,7 +357,11 @@ func Destroy(workdir string, showAll bool) bool {
 	}
 	fmt.Printf("%s\tWorking\n", USER_MSG_INFO)
 	go showSpinner(100 * time.Millisecond)
-	marathonDeleteApps(*marathonURL, appDescriptor.AppName, workdir)
+	if err := marathonDeleteApps(*marathonURL, appDescriptor.AppName, workdir); err != nil {
+		hideSpinner()
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
 	killObserver(appDescriptor, workdir)
 	hideSpinner()
 	fmt.Printf("%s\tDestroyed your app!\n", USER_MSG_SUCCESS)
@@ -197,7 +371,11 @@ func Destroy(workdir string, showAll bool) bool {
 // ListResources lists the resource definitions of the app.
 func ListResources(workdir string, showAll bool) bool {
 	setLogLevel()
-	appDescriptor := readAppDescriptor(workdir)
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
 	specsDir, _ := filepath.Abs(filepath.Join(workdir, MARATHON_APP_SPEC_DIR))
 	if _, err := os.Stat(specsDir); os.IsNotExist(err) {
 		fmt.Printf("%s\tDidn't find app spec dir, expecting it in %s\n", USER_MSG_PROBLEM, specsDir)
@@ -205,7 +383,9 @@ func ListResources(workdir string, showAll bool) bool {
 		return false
 	} else {
 		if strings.HasPrefix(appDescriptor.MarathonURL, "http") {
-			renderAppResources(appDescriptor, workdir)
+			if !renderAppResources(appDescriptor, workdir) {
+				return false
+			}
 		} else {
 			fmt.Printf("%s\tDidn't find an app descriptor (%s) in current directory\n", USER_MSG_PROBLEM, APP_DESCRIPTOR_FILENAME)
 			return false
@@ -217,7 +397,11 @@ func ListResources(workdir string, showAll bool) bool {
 // ListRuntimeProperties lists runtime properties of the app.
 func ListRuntimeProperties(workdir string, showAll bool) bool {
 	setLogLevel()
-	appDescriptor := readAppDescriptor(workdir)
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
 	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
 	if err != nil {
 		log.WithFields(log.Fields{"cmd": "ps"}).Error("Failed to connect to Marathon due to ", err)
@@ -226,9 +410,9 @@ func ListRuntimeProperties(workdir string, showAll bool) bool {
 	myApps := marathonAppRuntime(*marathonURL, appDescriptor.AppName)
 	table := tw.NewWriter(os.Stdout)
 	if showAll {
-		table.SetHeader([]string{"PID", "CMD", "IMAGE", "INSTANCES", "ENDPOINTS", "CPU", "MEM (MB)", "STATUS"})
+		table.SetHeader([]string{"PID", "CMD", "IMAGE", "INSTANCES", "TASKS", "ENDPOINTS", "CPU", "MEM (MB)", "STATUS"})
 	} else {
-		table.SetHeader([]string{"PID", "INSTANCES", "ENDPOINTS", "STATUS"})
+		table.SetHeader([]string{"PID", "INSTANCES", "TASKS", "ENDPOINTS", "STATUS"})
 
 	}
 	table.SetCenterSeparator("")
@@ -251,6 +435,7 @@ func ListRuntimeProperties(workdir string, showAll bool) bool {
 				appID += "/"
 			}
 			appInstances := strconv.Itoa(*app.Instances)
+			appTasks := listTaskIDs(appRuntime)
 			appEndpoints := listEndpoints(appRuntime)
 			appStatus := marathonAppStatus(client, appRuntime)
 			if showAll {
@@ -271,9 +456,9 @@ func ListRuntimeProperties(workdir string, showAll bool) bool {
 				}
 				appCPU := strconv.FormatFloat(app.CPUs, 'f', -1, 64)
 				appMem := strconv.FormatFloat(*app.Mem, 'f', -1, 64)
-				row = []string{appID, appCmd, appImage, appInstances, appEndpoints, appCPU, appMem, appStatus}
+				row = []string{appID, appCmd, appImage, appInstances, appTasks, appEndpoints, appCPU, appMem, appStatus}
 			} else {
-				row = []string{appID, appInstances, appEndpoints, appStatus}
+				row = []string{appID, appInstances, appTasks, appEndpoints, appStatus}
 			}
 			table.Append(row)
 		}
@@ -290,7 +475,11 @@ func ListRuntimeProperties(workdir string, showAll bool) bool {
 // Scale sets the number of instances of a particular µS identified through pid.
 func Scale(workdir string, showAll bool, pid string, instances int) bool {
 	setLogLevel()
-	appDescriptor := readAppDescriptor(workdir)
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
 	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
 	if err != nil {
 		log.WithFields(log.Fields{"cmd": "scale"}).Error("Failed to connect to Marathon due to ", err)
@@ -307,22 +496,359 @@ func Scale(workdir string, showAll bool, pid string, instances int) bool {
 	return true
 }
 
+// Restart triggers a rolling restart of a particular µS identified through pid or,
+// if pid is empty, of all µS of the app, one after the other. Marathon replaces the
+// tasks according to the upgrade strategy defined in the respective app spec.
+func Restart(workdir string, showAll bool, pid string) bool {
+	setLogLevel()
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": "restart"}).Error("Failed to connect to Marathon due to ", err)
+		return false
+	}
+	client := marathonClient(*marathonURL)
+	appIDs := []string{}
+	if pid != "" {
+		appIDs = append(appIDs, pid)
+	} else {
+		for _, app := range marathonAppRuntime(*marathonURL, appDescriptor.AppName) {
+			appIDs = append(appIDs, app.ID)
+		}
+	}
+	if len(appIDs) == 0 {
+		fmt.Printf("%s\tDidn't find any processes belonging to your app\n", USER_MSG_PROBLEM)
+		return false
+	}
+	for _, appID := range appIDs {
+		fmt.Printf("%s\tRestarting %s ...\n", USER_MSG_INFO, appID)
+		if err := marathonRestartApp(client, appID); err != nil {
+			fmt.Printf("%s\tFailed to restart %s due to following error: %s\n", USER_MSG_PROBLEM, appID, err)
+			return false
+		}
+		fmt.Printf("%s\tRestarted %s, all tasks are healthy\n", USER_MSG_SUCCESS, appID)
+	}
+	return true
+}
+
+// Kill kills a single task identified through taskID or, if taskID is empty, all tasks
+// of the µS identified through pid that run on host. By default Marathon replaces the
+// killed tasks, with scale set the µS is scaled down by the number of killed tasks instead.
+func Kill(workdir string, showAll bool, taskID string, pid string, host string, scale bool) bool {
+	setLogLevel()
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": "kill"}).Error("Failed to connect to Marathon due to ", err)
+		return false
+	}
+	client := marathonClient(*marathonURL)
+	switch {
+	case taskID != "" && scale:
+		// Marathon responds with the deployment scaling the app down rather than the killed task:
+		appID, err := appIDOfTask(taskID)
+		if err == nil {
+			err = marathonKillAndScale(client, *marathonURL, appID, "/tasks/"+url.PathEscape(taskID), url.Values{})
+		}
+		if err != nil {
+			fmt.Printf("%s\tFailed to kill task %s due to following error: %s\n", USER_MSG_PROBLEM, taskID, err)
+			return false
+		}
+		fmt.Printf("%s\tKilled task %s of %s\n", USER_MSG_SUCCESS, taskID, appID)
+	case taskID != "":
+		task, err := client.KillTask(taskID, &marathon.KillTaskOpts{})
+		if err != nil {
+			fmt.Printf("%s\tFailed to kill task %s due to following error: %s\n", USER_MSG_PROBLEM, taskID, err)
+			return false
+		}
+		client.WaitOnApplication(task.AppID, DEFAULT_DEPLOY_WAIT_TIME*time.Second)
+		fmt.Printf("%s\tKilled task %s of %s running on %s\n", USER_MSG_SUCCESS, task.ID, task.AppID, task.Host)
+	case pid != "" && host != "" && scale:
+		if err := marathonKillAndScale(client, *marathonURL, pid, "/tasks", url.Values{"host": {host}}); err != nil {
+			fmt.Printf("%s\tFailed to kill tasks of %s on %s due to following error: %s\n", USER_MSG_PROBLEM, pid, host, err)
+			return false
+		}
+		fmt.Printf("%s\tKilled tasks of %s running on %s\n", USER_MSG_SUCCESS, pid, host)
+	case pid != "" && host != "":
+		tasks, err := client.KillApplicationTasks(pid, &marathon.KillApplicationTasksOpts{Host: host})
+		if err != nil {
+			fmt.Printf("%s\tFailed to kill tasks of %s on %s due to following error: %s\n", USER_MSG_PROBLEM, pid, host, err)
+			return false
+		}
+		client.WaitOnApplication(pid, DEFAULT_DEPLOY_WAIT_TIME*time.Second)
+		if tasks == nil || len(tasks.Tasks) == 0 {
+			fmt.Printf("%s\tDidn't find any tasks of %s running on %s\n", USER_MSG_PROBLEM, pid, host)
+			return false
+		}
+		for _, task := range tasks.Tasks {
+			fmt.Printf("%s\tKilled task %s of %s running on %s\n", USER_MSG_SUCCESS, task.ID, pid, task.Host)
+		}
+	default:
+		fmt.Printf("%s\tDon't know what to kill, need either a task ID or both a pid and a host\n", USER_MSG_PROBLEM)
+		fmt.Printf("%s\tUse `dploy ps` to look up the tasks of your app.\n", USER_MSG_INFO)
+		return false
+	}
+	if scale {
+		fmt.Printf("%s\tScaled down accordingly, Marathon won't replace the killed task(s)\n", USER_MSG_INFO)
+	} else {
+		fmt.Printf("%s\tMarathon will replace the killed task(s)\n", USER_MSG_INFO)
+	}
+	return true
+}
+
+// Suspend scales all µS of the app down to zero instances.
+// The number of instances each µS had before is recorded as a Marathon label
+// on the µS itself so that Resume can restore it later on.
+func Suspend(workdir string, showAll bool) bool {
+	setLogLevel()
+	fmt.Printf("%s\tOK, putting your app to sleep ...\n", USER_MSG_INFO)
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": "suspend"}).Error("Failed to connect to Marathon due to ", err)
+		return false
+	}
+	fmt.Printf("%s\tWorking\n", USER_MSG_INFO)
+	go showSpinner(100 * time.Millisecond)
+	suspended, err := marathonSuspendApps(*marathonURL, appDescriptor.AppName)
+	hideSpinner()
+	if err != nil {
+		fmt.Printf("%s\tFailed to suspend your app due to following error: %s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	if len(suspended) == 0 {
+		fmt.Printf("%s\tDidn't find any running processes belonging to your app\n", USER_MSG_PROBLEM)
+		return false
+	}
+	for _, appID := range suspended {
+		fmt.Printf("\t\tSuspended %s\n", appID)
+	}
+	fmt.Printf("%s\tSuspended your app!\n", USER_MSG_SUCCESS)
+	fmt.Printf("%s\tUse `dploy resume` to bring it back again.\n", USER_MSG_INFO)
+	return true
+}
+
+// Resume restores the number of instances of all µS of the app
+// that have previously been suspended using Suspend.
+func Resume(workdir string, showAll bool) bool {
+	setLogLevel()
+	fmt.Printf("%s\tOK, waking up your app ...\n", USER_MSG_INFO)
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": "resume"}).Error("Failed to connect to Marathon due to ", err)
+		return false
+	}
+	fmt.Printf("%s\tWorking\n", USER_MSG_INFO)
+	go showSpinner(100 * time.Millisecond)
+	resumed, err := marathonResumeApps(*marathonURL, appDescriptor.AppName)
+	hideSpinner()
+	if err != nil {
+		fmt.Printf("%s\tFailed to resume your app due to following error: %s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	if len(resumed) == 0 {
+		fmt.Printf("%s\tDidn't find any suspended processes belonging to your app\n", USER_MSG_PROBLEM)
+		return false
+	}
+	for _, appID := range resumed {
+		fmt.Printf("\t\tResumed %s\n", appID)
+	}
+	fmt.Printf("%s\tResumed your app!\n", USER_MSG_SUCCESS)
+	fmt.Printf("%s\tNow you can use `dploy ps` to list processes.\n", USER_MSG_INFO)
+	return true
+}
+
+// History lists the deployments the observer carried out on push, most recent first.
+// With showAll set, the outcome of each deployment is shown per µS.
+func History(workdir string, showAll bool) bool {
+	setLogLevel()
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	history := []Deployment{}
+	if err := observerAdmin(appDescriptor, workdir, "GET", "/history?repo="+repoName(appDescriptor), nil, &history); err != nil {
+		fmt.Printf("%s\tCan't get deployment history due to following error: %s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	if len(history) == 0 {
+		fmt.Printf("%s\tThere haven't been any deployments on push so far\n", USER_MSG_INFO)
+		return true
+	}
+	table := tw.NewWriter(os.Stdout)
+	if showAll {
+		table.SetHeader([]string{"COMMIT", "REF", "PUSHER", "STARTED", "DURATION", "STATE", "PID", "RESULT"})
+	} else {
+		table.SetHeader([]string{"COMMIT", "PUSHER", "STARTED", "DURATION", "STATE"})
+	}
+	table.SetCenterSeparator("")
+	table.SetColumnSeparator("")
+	table.SetRowSeparator("")
+	table.SetAlignment(tw.ALIGN_LEFT)
+	table.SetHeaderAlignment(tw.ALIGN_LEFT)
+	for _, d := range history {
+		commit := d.Commit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		started := d.Started.Format(time.RFC3339)
+		duration := d.Finished.Sub(d.Started).String()
+		if showAll {
+			table.Append([]string{commit, d.Ref, d.Pusher, started, duration, d.State, "", d.Msg})
+			for _, app := range d.Apps {
+				result := "ok"
+				if !app.Success {
+					result = app.Msg
+				}
+				table.Append([]string{"", "", "", "", "", "", app.ID, result})
+			}
+		} else {
+			table.Append([]string{commit, d.Pusher, started, duration, d.State})
+		}
+	}
+	fmt.Printf("%s\tDeployment history of your app [%s]:\n", USER_MSG_INFO, appDescriptor.AppName)
+	table.Render()
+	return true
+}
+
+// Pending lists the deployments the observer staged and that await approval.
+func Pending(workdir string, showAll bool) bool {
+	setLogLevel()
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	plans := []Plan{}
+	if err := observerAdmin(appDescriptor, workdir, "GET", "/pending?repo="+repoName(appDescriptor), nil, &plans); err != nil {
+		fmt.Printf("%s\tCan't get pending deployments due to following error: %s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	if len(plans) == 0 {
+		fmt.Printf("%s\tThere are no deployments awaiting approval\n", USER_MSG_INFO)
+		return true
+	}
+	table := tw.NewWriter(os.Stdout)
+	if showAll {
+		table.SetHeader([]string{"ID", "COMMIT", "REF", "PUSHER", "EXPIRES", "PID", "PLAN"})
+	} else {
+		table.SetHeader([]string{"ID", "COMMIT", "PUSHER", "EXPIRES"})
+	}
+	table.SetCenterSeparator("")
+	table.SetColumnSeparator("")
+	table.SetRowSeparator("")
+	table.SetAlignment(tw.ALIGN_LEFT)
+	table.SetHeaderAlignment(tw.ALIGN_LEFT)
+	for _, p := range plans {
+		commit := p.Commit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		expires := p.Expires.Format(time.RFC3339)
+		if showAll {
+			table.Append([]string{p.ID, commit, p.Ref, p.Pusher, expires, "", ""})
+			for _, app := range p.Apps {
+				table.Append([]string{"", "", "", "", "", app.ID, app.Msg})
+			}
+		} else {
+			table.Append([]string{p.ID, commit, p.Pusher, expires})
+		}
+	}
+	fmt.Printf("%s\tDeployments of your app [%s] awaiting approval:\n", USER_MSG_INFO, appDescriptor.AppName)
+	table.Render()
+	return true
+}
+
+// Approve tells the observer to carry out the staged deployment with the ID,
+// as listed by Pending.
+func Approve(workdir string, showAll bool, id string) bool {
+	setLogLevel()
+	if id == "" {
+		fmt.Printf("%s\tPlease specify the deployment to approve, for example `dploy approve 1a2b3c4d`\n", USER_MSG_PROBLEM)
+		return false
+	}
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	if err := observerAdmin(appDescriptor, workdir, "POST", "/approve/"+id, nil, nil); err != nil {
+		fmt.Printf("%s\tCan't approve deployment %s due to following error: %s\n", USER_MSG_PROBLEM, id, err)
+		return false
+	}
+	fmt.Printf("%s\tApproved deployment %s, see `dploy history` for its outcome\n", USER_MSG_SUCCESS, id)
+	return true
+}
+
 // Upgrade updates all µS using app specs via Marathon.
 // It is not used by the CLI but rather via the observer
 // service to upgrade on push to a GitHub repo (/dploy handler)
 func Upgrade(workdir string) bool {
+	_, success := UpgradeApps(workdir, "")
+	return success
+}
+
+// UpgradeApps works like Upgrade but also reports the outcome per µS. The µS are
+// updated via the Marathon at marathonLocation or, if it's empty, the one set in
+// the app descriptor, which is left untouched either way.
+func UpgradeApps(workdir string, marathonLocation string) ([]AppResult, bool) {
 	setLogLevel()
-	appDescriptor := readAppDescriptor(workdir)
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": "upgrade"}).Error(err)
+		return nil, false
+	}
 	log.WithFields(log.Fields{"cmd": "upgrade"}).Debug("Got app descriptor from workspace ", workdir)
-	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
+	marathonURL, err := url.Parse(marathonOf(appDescriptor, marathonLocation))
 	if err != nil {
 		log.WithFields(log.Fields{"cmd": "upgrade"}).Error("Failed to connect to Marathon due to ", err)
-		return false
+		return nil, false
 	}
-	uerr := marathonUpdateApps(*marathonURL, appDescriptor.AppName, workdir)
+	results, uerr := marathonUpdateApps(*marathonURL, appDescriptor.AppName, workdir)
 	if uerr != nil {
 		log.WithFields(log.Fields{"cmd": "upgrade"}).Error("Failed to update app(s) due to ", uerr)
-		return false
+		return results, false
 	}
-	return true
+	return results, true
+}
+
+// PlanApps works like UpgradeApps but rather than updating the µS it only
+// reports if they would be created, updated or are unchanged.
+func PlanApps(workdir string, marathonLocation string) ([]AppResult, bool) {
+	setLogLevel()
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": "plan"}).Error(err)
+		return nil, false
+	}
+	log.WithFields(log.Fields{"cmd": "plan"}).Debug("Got app descriptor from workspace ", workdir)
+	marathonURL, err := url.Parse(marathonOf(appDescriptor, marathonLocation))
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": "plan"}).Error("Failed to connect to Marathon due to ", err)
+		return nil, false
+	}
+	results, perr := marathonPlanApps(*marathonURL, appDescriptor.AppName, workdir)
+	if perr != nil {
+		log.WithFields(log.Fields{"cmd": "plan"}).Error("Failed to plan app(s) due to ", perr)
+		return results, false
+	}
+	return results, true
 }
@@ -11,8 +11,12 @@ func TestInit(t *testing.T) {
 // Examples
 
 func ExampleInit_output() {
-	Init("/tmp/")
-	// Output: /tmp/dploy.app with following content:
-	//  marathon_url: http://localhost:8080
-	//  app_name: CHANGEME
+	Init("/tmp/", false)
+	// Output:
+	// 🗣	Initializing your app ...
+	// 🙌	Done initializing your app:
+	//		Set up app descriptor in /tmp/dploy.app
+	//		Created app spec directory /tmp/specs
+	// 🗣	Now it's time to edit the app descriptor and adapt or add Marathon app specs.
+	//	Next, you can run `dploy dryrun`
 }
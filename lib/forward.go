@@ -0,0 +1,181 @@
+package dploy
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	marathon "github.com/gambol99/go-marathon"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// PortForward tunnels the local TCP port to the remote port of a task of the µS identified
+// through pid, using the task with taskID or, if taskID is empty, the first task found.
+// The ports are given as "<local>:<remote>" where remote can be a container port, a service
+// port or a host port of the task. If via is set (for example `core@52.37.239.156`), the
+// connections are tunneled through an SSH jump host, otherwise the agent is dialed directly.
+// It serves connections until the process is interrupted.
+func PortForward(workdir string, showAll bool, pid string, taskID string, ports string, via string) bool {
+	setLogLevel()
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": "port-forward"}).Error("Failed to connect to Marathon due to ", err)
+		return false
+	}
+	local, remote, err := parsePorts(ports)
+	if pid == "" || err != nil {
+		fmt.Printf("%s\tNeed a pid and ports, for example `dploy port-forward /webserver 8080:80`\n", USER_MSG_PROBLEM)
+		return false
+	}
+	client := marathonClient(*marathonURL)
+	app, err := client.Application(pid)
+	if err != nil {
+		fmt.Printf("%s\tCan't look up µS %s due to following error: %s\n", USER_MSG_PROBLEM, pid, err)
+		return false
+	}
+	task, err := selectTask(app, taskID)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	hostPort, err := taskPort(app, task, remote)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return false
+	}
+	target := fmt.Sprintf("%s:%d", task.Host, hostPort)
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", local))
+	if err != nil {
+		fmt.Printf("%s\tCan't listen on local port %d due to following error: %s\n", USER_MSG_PROBLEM, local, err)
+		return false
+	}
+	defer listener.Close()
+	fmt.Printf("%s\tForwarding 127.0.0.1:%d to %s of task %s\n", USER_MSG_SUCCESS, local, target, task.ID)
+	if via != "" {
+		fmt.Printf("\tTunneling through %s\n", via)
+	}
+	fmt.Printf("%s\tHit CTRL+C to stop forwarding.\n", USER_MSG_INFO)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.WithFields(log.Fields{"forward": "accept"}).Error("Can't accept connection due to ", err)
+			return false
+		}
+		go forward(conn, target, via)
+	}
+}
+
+func parsePorts(ports string) (int, int, error) {
+	p := strings.Split(ports, ":")
+	if len(p) != 2 {
+		return 0, 0, fmt.Errorf("Expected ports as <local>:<remote> but got %s", ports)
+	}
+	local, err := strconv.Atoi(p[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	remote, err := strconv.Atoi(p[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return local, remote, nil
+}
+
+// taskPort resolves the remote port to the host port of the task, the same host
+// port `dploy ps` lists as an endpoint. The remote port is looked up in the
+// container port mappings, the service ports and then the host ports of the task.
+func taskPort(app *marathon.Application, task *marathon.Task, remote int) (int, error) {
+	for i, pm := range containerPortMappings(app) {
+		if pm.ContainerPort == remote && i < len(task.Ports) {
+			return task.Ports[i], nil
+		}
+	}
+	for i, p := range app.Ports {
+		if p == remote && i < len(task.Ports) {
+			return task.Ports[i], nil
+		}
+	}
+	for _, p := range task.Ports {
+		if p == remote {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Task %s doesn't expose port %d", task.ID, remote)
+}
+
+// containerPortMappings returns the port mappings of the app's container. Since
+// Marathon 1.5 they're part of the container, before they were part of docker.
+func containerPortMappings(app *marathon.Application) []marathon.PortMapping {
+	if app.Container == nil {
+		return nil
+	}
+	if app.Container.PortMappings != nil {
+		return *app.Container.PortMappings
+	}
+	if app.Container.Docker != nil && app.Container.Docker.PortMappings != nil {
+		return *app.Container.Docker.PortMappings
+	}
+	return nil
+}
+
+func forward(conn net.Conn, target string, via string) {
+	defer conn.Close()
+	upstream, err := dialTarget(target, via)
+	if err != nil {
+		log.WithFields(log.Fields{"forward": "dial"}).Error("Can't connect to ", target, " due to ", err)
+		return
+	}
+	defer upstream.Close()
+	log.WithFields(log.Fields{"forward": "conn"}).Debug("Forwarding ", conn.RemoteAddr(), " to ", target)
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- true
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- true
+	}()
+	<-done
+}
+
+// dialTarget connects to target either directly or through
+// an SSH jump host using `ssh -W` as the transport.
+func dialTarget(target string, via string) (io.ReadWriteCloser, error) {
+	if via == "" {
+		return net.Dial("tcp", target)
+	}
+	cmd := exec.Command("ssh", "-W", target, via)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &sshTunnel{cmd: cmd, Reader: stdout, WriteCloser: stdin}, nil
+}
+
+type sshTunnel struct {
+	io.Reader
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (t *sshTunnel) Close() error {
+	t.WriteCloser.Close()
+	t.cmd.Process.Kill()
+	return t.cmd.Wait()
+}
@@ -0,0 +1,36 @@
+package dploy
+
+import (
+	"encoding/json"
+	marathon "github.com/gambol99/go-marathon"
+	"testing"
+)
+
+// Tests
+
+func TestTaskPort(t *testing.T) {
+	task := &marathon.Task{ID: "web.1", Ports: []int{31001, 31002}}
+	tests := []struct {
+		name   string
+		app    string
+		remote int
+		want   int
+	}{
+		{"container port mappings", `{"id": "/web", "container": {"type": "DOCKER", "portMappings": [{"containerPort": 80}, {"containerPort": 443}]}}`, 443, 31002},
+		{"docker port mappings", `{"id": "/web", "container": {"type": "DOCKER", "docker": {"portMappings": [{"containerPort": 80}, {"containerPort": 443}]}}}`, 80, 31001},
+		{"container before docker port mappings", `{"id": "/web", "container": {"type": "DOCKER", "portMappings": [{"containerPort": 8080}], "docker": {"portMappings": [{"containerPort": 9090}]}}}`, 8080, 31001},
+		{"service ports", `{"id": "/web", "ports": [10000, 10001]}`, 10001, 31002},
+		{"host ports", `{"id": "/web"}`, 31001, 31001},
+		{"unknown port", `{"id": "/web", "container": {"type": "DOCKER", "portMappings": [{"containerPort": 80}]}}`, 22, 0},
+	}
+	for _, tt := range tests {
+		app := &marathon.Application{}
+		if err := json.Unmarshal([]byte(tt.app), app); err != nil {
+			t.Fatalf("%s: can't decode app spec due to %s", tt.name, err)
+		}
+		got, err := taskPort(app, task, tt.remote)
+		if got != tt.want || (err != nil) != (tt.want == 0) {
+			t.Errorf("%s: resolved port %d to %d (%v), want %d", tt.name, tt.remote, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package dploy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	marathon "github.com/gambol99/go-marathon"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The types below model the subset of the Mesos agent operator API (v1)
+// needed to launch and attach to nested container sessions, see
+// http://mesos.apache.org/documentation/latest/operator-http-api/#agent-api
+
+type mesosContainerID struct {
+	Value  string            `json:"value"`
+	Parent *mesosContainerID `json:"parent,omitempty"`
+}
+
+type mesosContainer struct {
+	FrameworkID struct{ Value string } `json:"framework_id"`
+	ExecutorID  struct{ Value string } `json:"executor_id"`
+	ContainerID mesosContainerID       `json:"container_id"`
+}
+
+type mesosTask struct {
+	TaskID      struct{ Value string }  `json:"task_id"`
+	FrameworkID struct{ Value string }  `json:"framework_id"`
+	ExecutorID  *struct{ Value string } `json:"executor_id"`
+	Statuses    []struct {
+		ContainerStatus *struct {
+			ContainerID *mesosContainerID `json:"container_id"`
+		} `json:"container_status"`
+	} `json:"statuses"`
+}
+
+type mesosGetTasks struct {
+	GetTasks struct {
+		LaunchedTasks []mesosTask `json:"launched_tasks"`
+	} `json:"get_tasks"`
+}
+
+type mesosGetContainers struct {
+	GetContainers struct {
+		Containers []mesosContainer `json:"containers"`
+	} `json:"get_containers"`
+}
+
+type mesosWaitNestedContainer struct {
+	WaitNestedContainer struct {
+		ExitStatus *int `json:"exit_status"`
+	} `json:"wait_nested_container"`
+}
+
+type mesosWindowSize struct {
+	Rows    int `json:"rows"`
+	Columns int `json:"columns"`
+}
+
+type mesosTTYInfo struct {
+	WindowSize mesosWindowSize `json:"window_size"`
+}
+
+type mesosProcessIO struct {
+	Type string `json:"type"`
+	Data *struct {
+		Type string `json:"type"`
+		Data string `json:"data"`
+	} `json:"data,omitempty"`
+}
+
+// Exec runs command in a nested container of a task of the µS identified through pid,
+// using the task with taskID or, if taskID is empty, the first task found.
+// If stdin is a terminal the session is interactive and gets a TTY attached,
+// otherwise the command is run one-shot with stdin streamed to it.
+// Note that this requires the µS to be launched with the Mesos containerizer.
+// Returns the exit code of the command or -1 if it couldn't be run.
+func Exec(workdir string, showAll bool, pid string, taskID string, command []string) int {
+	setLogLevel()
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return -1
+	}
+	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": "exec"}).Error("Failed to connect to Marathon due to ", err)
+		return -1
+	}
+	if pid == "" || len(command) == 0 {
+		fmt.Printf("%s\tNeed a pid and a command, for example `dploy exec /webserver -- ls -al`\n", USER_MSG_PROBLEM)
+		return -1
+	}
+	task, err := marathonFindTask(*marathonURL, pid, taskID)
+	if err != nil {
+		fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+		return -1
+	}
+	exitCode, err := mesosExec(task, command)
+	if err != nil {
+		fmt.Printf("%s\tFailed to exec into task %s due to following error: %s\n", USER_MSG_PROBLEM, task.ID, err)
+		return -1
+	}
+	log.WithFields(log.Fields{"cmd": "exec"}).Debug("Command exited with code ", exitCode)
+	return exitCode
+}
+
+// marathonFindTask looks up the task with taskID of the app with appID or,
+// if taskID is empty, the first task of the app.
+func marathonFindTask(marathonURL url.URL, appID string, taskID string) (*marathon.Task, error) {
+	client := marathonClient(marathonURL)
+	app, err := client.Application(appID)
+	if err != nil {
+		return nil, fmt.Errorf("Can't look up µS %s due to %s", appID, err)
+	}
+	return selectTask(app, taskID)
+}
+
+// selectTask picks the task with taskID of the app or, if taskID is empty, the first task.
+func selectTask(app *marathon.Application, taskID string) (*marathon.Task, error) {
+	for _, task := range app.Tasks {
+		if taskID == "" || task.ID == taskID {
+			log.WithFields(log.Fields{"marathon": "find_task"}).Debug("Using task ", task.ID, " on ", task.Host)
+			return task, nil
+		}
+	}
+	if taskID != "" {
+		return nil, fmt.Errorf("Didn't find task %s of µS %s", taskID, app.ID)
+	}
+	return nil, fmt.Errorf("Didn't find any running tasks of µS %s", app.ID)
+}
+
+func mesosAgentURL(host string) string {
+	return "http://" + host + ":" + strconv.Itoa(MESOS_AGENT_PORT) + "/api/v1"
+}
+
+// mesosExec launches command as a nested container session under the container of task
+// and streams its output to stdout/stderr. Returns the exit code of the command.
+func mesosExec(task *marathon.Task, command []string) (int, error) {
+	agentURL := mesosAgentURL(task.Host)
+	parent, err := mesosFindContainer(agentURL, task.ID)
+	if err != nil {
+		return -1, err
+	}
+	containerID := mesosContainerID{Value: newUUID(), Parent: parent}
+	tty := terminal.IsTerminal(int(os.Stdin.Fd()))
+	launch := map[string]interface{}{
+		"container_id": containerID,
+		"command": map[string]interface{}{
+			"shell":     false,
+			"value":     command[0],
+			"arguments": command,
+		},
+	}
+	if tty {
+		launch["container"] = map[string]interface{}{
+			"type":     "MESOS",
+			"tty_info": mesosTTYInfo{WindowSize: terminalSize()},
+		}
+	}
+	call := map[string]interface{}{
+		"type":                            "LAUNCH_NESTED_CONTAINER_SESSION",
+		"launch_nested_container_session": launch,
+	}
+	body, _ := json.Marshal(call)
+	req, _ := http.NewRequest("POST", agentURL, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/recordio")
+	req.Header.Set("Message-Accept", "application/json")
+	log.WithFields(log.Fields{"mesos": "exec"}).Debug("Launching nested container session ", containerID.Value, " on ", agentURL)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return -1, fmt.Errorf("Agent responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if tty {
+		state, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+		if err == nil {
+			defer terminal.Restore(int(os.Stdin.Fd()), state)
+		}
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go mesosAttachInput(agentURL, containerID, tty, done)
+	if err := mesosStreamOutput(resp.Body); err != nil {
+		return -1, err
+	}
+	return mesosWaitContainer(agentURL, containerID)
+}
+
+// mesosFindContainer looks up the ID of the container that runs the task. That's the
+// one the agent reports in the latest status of the task, which for tasks of pods is
+// nested in the container of their executor. Agents that don't report it are asked for
+// the container of the executor of the task, which for plain apps has the task ID as ID.
+func mesosFindContainer(agentURL string, taskID string) (*mesosContainerID, error) {
+	resp, err := mesosCall(agentURL, map[string]interface{}{"type": "GET_TASKS"})
+	if err != nil {
+		return nil, err
+	}
+	tasks := mesosGetTasks{}
+	if err := json.Unmarshal(resp, &tasks); err != nil {
+		return nil, fmt.Errorf("Can't decode tasks of agent due to %s", err)
+	}
+	for _, task := range tasks.GetTasks.LaunchedTasks {
+		if task.TaskID.Value != taskID {
+			continue
+		}
+		for i := len(task.Statuses) - 1; i >= 0; i-- {
+			if cs := task.Statuses[i].ContainerStatus; cs != nil && cs.ContainerID != nil {
+				log.WithFields(log.Fields{"mesos": "find_container"}).Debug("Found container ", cs.ContainerID.Value, " for task ", taskID, " in its status")
+				return cs.ContainerID, nil
+			}
+		}
+		executorID := taskID
+		if task.ExecutorID != nil && task.ExecutorID.Value != "" {
+			executorID = task.ExecutorID.Value
+		}
+		return mesosFindExecutorContainer(agentURL, task.FrameworkID.Value, executorID)
+	}
+	return nil, fmt.Errorf("Didn't find task %s on agent %s", taskID, agentURL)
+}
+
+// mesosFindExecutorContainer looks up the ID of the container of the executor with
+// executorID of the framework with frameworkID.
+func mesosFindExecutorContainer(agentURL string, frameworkID string, executorID string) (*mesosContainerID, error) {
+	resp, err := mesosCall(agentURL, map[string]interface{}{"type": "GET_CONTAINERS"})
+	if err != nil {
+		return nil, err
+	}
+	containers := mesosGetContainers{}
+	if err := json.Unmarshal(resp, &containers); err != nil {
+		return nil, fmt.Errorf("Can't decode containers of agent due to %s", err)
+	}
+	for _, c := range containers.GetContainers.Containers {
+		if c.FrameworkID.Value == frameworkID && c.ExecutorID.Value == executorID {
+			log.WithFields(log.Fields{"mesos": "find_container"}).Debug("Found container ", c.ContainerID.Value, " of executor ", executorID)
+			return &c.ContainerID, nil
+		}
+	}
+	return nil, fmt.Errorf("Didn't find a container of executor %s on agent %s", executorID, agentURL)
+}
+
+func mesosWaitContainer(agentURL string, containerID mesosContainerID) (int, error) {
+	resp, err := mesosCall(agentURL, map[string]interface{}{
+		"type": "WAIT_NESTED_CONTAINER",
+		"wait_nested_container": map[string]interface{}{
+			"container_id": containerID,
+		},
+	})
+	if err != nil {
+		return -1, err
+	}
+	wait := mesosWaitNestedContainer{}
+	if err := json.Unmarshal(resp, &wait); err != nil {
+		return -1, fmt.Errorf("Can't decode exit status due to %s", err)
+	}
+	if wait.WaitNestedContainer.ExitStatus == nil {
+		return -1, fmt.Errorf("Agent didn't report the exit status of nested container %s", containerID.Value)
+	}
+	return exitCode(*wait.WaitNestedContainer.ExitStatus), nil
+}
+
+// exitCode decodes an exit status as returned by waitpid(2) into the exit code
+// of the command or, like shells do, 128 plus the number of the signal that
+// terminated it.
+func exitCode(status int) int {
+	if signal := status & 0x7f; signal != 0 {
+		return 128 + signal
+	}
+	return (status >> 8) & 0xff
+}
+
+// mesosCall issues a non-streaming call against the agent operator API.
+func mesosCall(agentURL string, call interface{}) ([]byte, error) {
+	body, _ := json.Marshal(call)
+	req, _ := http.NewRequest("POST", agentURL, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	c, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Agent responded with %s: %s", resp.Status, strings.TrimSpace(string(c)))
+	}
+	return c, nil
+}
+
+// mesosStreamOutput decodes the RecordIO stream of ProcessIO messages of
+// a nested container session and copies the data to stdout and stderr.
+func mesosStreamOutput(r io.Reader) error {
+	records := bufio.NewReader(r)
+	for {
+		record, err := readRecord(records)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pio := mesosProcessIO{}
+		if err := json.Unmarshal(record, &pio); err != nil {
+			return fmt.Errorf("Can't decode output of nested container due to %s", err)
+		}
+		if pio.Type != "DATA" || pio.Data == nil {
+			continue
+		}
+		data, _ := base64.StdEncoding.DecodeString(pio.Data.Data)
+		switch pio.Data.Type {
+		case "STDOUT":
+			os.Stdout.Write(data)
+		case "STDERR":
+			os.Stderr.Write(data)
+		}
+	}
+}
+
+// mesosAttachInput streams stdin as well as heartbeats to the nested container session.
+// Once stdin is exhausted, an empty data record signals EOF to the command. Closing done
+// ends the stream and makes the goroutines feeding it exit.
+func mesosAttachInput(agentURL string, containerID mesosContainerID, tty bool, done <-chan struct{}) {
+	pr, pw := io.Pipe()
+	records := make(chan interface{})
+	send := func(record interface{}) bool {
+		select {
+		case records <- record:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	go func() {
+		writeRecord(pw, attachInput(map[string]interface{}{
+			"type":         "CONTAINER_ID",
+			"container_id": containerID,
+		}))
+		if tty {
+			writeRecord(pw, attachControl(map[string]interface{}{
+				"type":     "TTY_INFO",
+				"tty_info": mesosTTYInfo{WindowSize: terminalSize()},
+			}))
+		}
+		defer pw.Close()
+		for {
+			select {
+			case r := <-records:
+				if err := writeRecord(pw, r); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		heartbeat := time.NewTicker(MESOS_HEARTBEAT_INTERVAL * time.Second)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-heartbeat.C:
+				if !send(attachControl(map[string]interface{}{
+					"type":      "HEARTBEAT",
+					"heartbeat": map[string]interface{}{"interval": map[string]int64{"nanoseconds": int64(MESOS_HEARTBEAT_INTERVAL * time.Second)}},
+				})) {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() { // note: a pending read of stdin can't be interrupted, so this exits with the next one
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 && !send(attachData(buf[:n])) {
+				return
+			}
+			if err != nil {
+				send(attachData([]byte{}))
+				return
+			}
+		}
+	}()
+	req, _ := http.NewRequest("POST", agentURL, pr)
+	req.Header.Set("Content-Type", "application/recordio")
+	req.Header.Set("Message-Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.WithFields(log.Fields{"mesos": "attach_input"}).Debug("Input stream closed due to ", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func attachInput(input map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":                   "ATTACH_CONTAINER_INPUT",
+		"attach_container_input": input,
+	}
+}
+
+func attachData(data []byte) map[string]interface{} {
+	return attachInput(map[string]interface{}{
+		"type": "PROCESS_IO",
+		"process_io": map[string]interface{}{
+			"type": "DATA",
+			"data": map[string]string{"type": "STDIN", "data": base64.StdEncoding.EncodeToString(data)},
+		},
+	})
+}
+
+func attachControl(control map[string]interface{}) map[string]interface{} {
+	return attachInput(map[string]interface{}{
+		"type": "PROCESS_IO",
+		"process_io": map[string]interface{}{
+			"type":    "CONTROL",
+			"control": control,
+		},
+	})
+}
+
+// readRecord reads a single RecordIO record, that is, "<length>\n<data>".
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(header))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid RecordIO header %q", header)
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func writeRecord(w io.Writer, message interface{}) error {
+	record, _ := json.Marshal(message)
+	_, err := fmt.Fprintf(w, "%d\n%s", len(record), record)
+	return err
+}
+
+func terminalSize() mesosWindowSize {
+	columns, rows, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return mesosWindowSize{Rows: 24, Columns: 80}
+	}
+	return mesosWindowSize{Rows: rows, Columns: columns}
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,42 @@
+package dploy
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// Tests
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		status, want int
+	}{
+		{0, 0},
+		{1 << 8, 1},
+		{42 << 8, 42},
+		{9, 137},  // SIGKILL
+		{15, 143}, // SIGTERM
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.status); got != tt.want {
+			t.Errorf("exitCode(%d) = %d, want %d", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestRecordIO(t *testing.T) {
+	var buf bytes.Buffer
+	writeRecord(&buf, map[string]string{"type": "DATA"})
+	writeRecord(&buf, map[string]string{"type": "CONTROL"})
+	records := bufio.NewReader(&buf)
+	for _, want := range []string{`{"type":"DATA"}`, `{"type":"CONTROL"}`} {
+		record, err := readRecord(records)
+		if err != nil || string(record) != want {
+			t.Errorf("read %q (%v), want %q", record, err, want)
+		}
+	}
+	if _, err := readRecord(bufio.NewReader(bytes.NewBufferString("x\n{}"))); err == nil {
+		t.Error("read record with invalid header")
+	}
+}
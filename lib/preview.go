@@ -0,0 +1,155 @@
+package dploy
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	marathon "github.com/gambol99/go-marathon"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DeployPreview deploys the app in workdir as an isolated preview environment, for
+// example of a pull request: the app name as well as the IDs of the apps and groups
+// defined in the app specs get suffix appended, and all apps are labelled with preview
+// so that TeardownPreview can find them again. On success, the outcome lists the apps
+// of the preview environment along with their endpoints. As with UpgradeApps, an
+// empty marathonLocation means the Marathon set in the app descriptor.
+func DeployPreview(workdir string, marathonLocation string, preview string, suffix string) ([]AppResult, bool) {
+	setLogLevel()
+	appDescriptor, err := readAppDescriptor(workdir)
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": "preview"}).Error(err)
+		return nil, false
+	}
+	marathonURL, err := url.Parse(marathonOf(appDescriptor, marathonLocation))
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": "preview"}).Error("Failed to connect to Marathon due to ", err)
+		return nil, false
+	}
+	client := marathonClient(*marathonURL)
+	dployAppName := appDescriptor.AppName + suffix
+	for _, specFilename := range getAppSpecs(workdir) {
+		appSpec, group, err := readAppSpec(dployAppName, specFilename)
+		if err != nil {
+			log.WithFields(log.Fields{"marathon": "preview"}).Error(err)
+			return []AppResult{{ID: dployAppName, Success: false, Msg: err.Error()}}, false
+		}
+		if appSpec != nil {
+			appSpec.ID += suffix
+			appSpec.AddLabel(MARATHON_LABEL_PREVIEW, preview)
+			if _, err := client.UpdateApplication(appSpec, true); err != nil {
+				log.WithFields(log.Fields{"marathon": "preview_app"}).Error("Failed to deploy preview app due to ", err)
+				return []AppResult{{ID: appSpec.ID, Success: false, Msg: err.Error()}}, false
+			}
+			client.WaitOnApplication(appSpec.ID, DEFAULT_DEPLOY_WAIT_TIME*time.Second)
+			log.WithFields(log.Fields{"marathon": "preview_app"}).Debug("Deployed preview app ", appSpec.ID)
+		} else {
+			groupID := group.ID
+			group.ID += suffix
+			previewGroup(group, preview, groupID, group.ID)
+			if _, err := client.UpdateGroup(group.ID, group, false); err != nil {
+				log.WithFields(log.Fields{"marathon": "preview_group"}).Error("Failed to deploy preview group due to ", err)
+				return []AppResult{{ID: group.ID, Success: false, Msg: err.Error()}}, false
+			}
+			client.WaitOnGroup(group.ID, DEFAULT_DEPLOY_WAIT_TIME*time.Second)
+			log.WithFields(log.Fields{"marathon": "preview_group"}).Debug("Deployed preview group ", group.ID)
+		}
+	}
+	results := []AppResult{}
+	for _, app := range marathonPreviewApps(client, preview) {
+		appRuntime, err := client.Application(app.ID)
+		if err != nil {
+			results = append(results, AppResult{ID: app.ID, Success: true, Msg: "Endpoints not available"})
+			continue
+		}
+		results = append(results, AppResult{ID: app.ID, Success: true, Endpoints: listEndpoints(appRuntime)})
+	}
+	return results, true
+}
+
+// TeardownPreview removes all apps labelled with preview from Marathon, along
+// with the groups DeployPreview created for them.
+func TeardownPreview(marathonLocation string, preview string, suffix string) ([]AppResult, bool) {
+	setLogLevel()
+	marathonURL, err := url.Parse(marathonLocation)
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": "teardown"}).Error("Failed to connect to Marathon due to ", err)
+		return nil, false
+	}
+	client := marathonClient(*marathonURL)
+	results := []AppResult{}
+	success := true
+	deleted := map[string]bool{}
+	for _, app := range marathonPreviewApps(client, preview) {
+		id, isGroup := previewRoot(app.ID, suffix)
+		if deleted[id] {
+			continue
+		}
+		deleted[id] = true
+		var derr error
+		if isGroup {
+			_, derr = client.DeleteGroup(id, false)
+		} else {
+			_, derr = client.DeleteApplication(id, false)
+		}
+		if derr != nil {
+			log.WithFields(log.Fields{"marathon": "teardown"}).Error("Failed to delete ", id, " due to ", derr)
+			results = append(results, AppResult{ID: id, Success: false, Msg: derr.Error()})
+			success = false
+			continue
+		}
+		log.WithFields(log.Fields{"marathon": "teardown"}).Debug("Deleted ", id)
+		results = append(results, AppResult{ID: id, Success: true})
+	}
+	return results, success
+}
+
+// Labels the apps of a group and its sub-groups with preview and moves members
+// with absolute IDs below the group from oldPrefix to newPrefix
+func previewGroup(group *marathon.Group, preview string, oldPrefix string, newPrefix string) {
+	for _, app := range group.Apps {
+		if strings.HasPrefix(app.ID, oldPrefix+"/") {
+			app.ID = newPrefix + strings.TrimPrefix(app.ID, oldPrefix)
+		}
+		app.AddLabel(MARATHON_LABEL_PREVIEW, preview)
+	}
+	for _, g := range group.Groups {
+		if strings.HasPrefix(g.ID, oldPrefix+"/") {
+			g.ID = newPrefix + strings.TrimPrefix(g.ID, oldPrefix)
+		}
+		previewGroup(g, preview, oldPrefix, newPrefix)
+	}
+}
+
+// Finds what DeployPreview created for the app with appID: the outermost group
+// whose ID got suffix appended or, if there is none, the app itself
+func previewRoot(appID string, suffix string) (string, bool) {
+	segments := strings.Split(strings.Trim(appID, "/"), "/")
+	for i := 1; i < len(segments); i++ {
+		if strings.HasSuffix(segments[i-1], suffix) {
+			return "/" + strings.Join(segments[:i], "/"), true
+		}
+	}
+	return appID, false
+}
+
+func marathonPreviewApps(client marathon.Marathon, preview string) []marathon.Application {
+	applications, err := client.Applications(nil)
+	if err != nil {
+		log.WithFields(log.Fields{"marathon": "preview_apps"}).Error("Failed to list Marathon apps due to ", err)
+		return nil
+	}
+	var previewApps []marathon.Application
+	for _, app := range applications.Apps {
+		if app.Labels != nil && (*app.Labels)[MARATHON_LABEL_PREVIEW] == preview {
+			previewApps = append(previewApps, app)
+		}
+	}
+	return previewApps
+}
+
+// PreviewSuffix returns the suffix identifying the preview environment of pull request number
+func PreviewSuffix(number int) string {
+	return fmt.Sprintf("-pr%d", number)
+}
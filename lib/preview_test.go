@@ -0,0 +1,89 @@
+package dploy
+
+import (
+	marathon "github.com/gambol99/go-marathon"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Tests
+
+func TestPreviewSuffix(t *testing.T) {
+	if got := PreviewSuffix(42); got != "-pr42" {
+		t.Errorf("PreviewSuffix(42) = %s, want -pr42", got)
+	}
+}
+
+func TestPreviewGroup(t *testing.T) {
+	_, group := appSpecOf(t, `{"id": "/shop", "groups": [{"id": "backend", "apps": [{"id": "db"}, {"id": "/shop/backend/cache"}]}], "apps": [{"id": "web"}, {"id": "/shop/api"}]}`)
+	group.ID += "-pr42"
+	previewGroup(group, "mhausenblas/shop#42", "/shop", group.ID)
+	apps := map[string]*marathon.Application{}
+	groupApps(group, "", apps)
+	ids := []string{}
+	for id, app := range apps {
+		ids = append(ids, id)
+		if (*app.Labels)[MARATHON_LABEL_PREVIEW] != "mhausenblas/shop#42" {
+			t.Errorf("app %s not labelled as part of the preview", id)
+		}
+	}
+	sort.Strings(ids)
+	want := []string{"/shop-pr42/api", "/shop-pr42/backend/cache", "/shop-pr42/backend/db", "/shop-pr42/web"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("preview apps are %v, want %v", ids, want)
+	}
+}
+
+func TestPreviewRoot(t *testing.T) {
+	tests := []struct {
+		appID   string
+		root    string
+		isGroup bool
+	}{
+		{"/web-pr42", "/web-pr42", false},
+		{"/shop-pr42/web", "/shop-pr42", true},
+		{"/shop-pr42/backend/db", "/shop-pr42", true},
+		{"/shop/backend-pr42/db", "/shop/backend-pr42", true},
+		{"/shop/web-pr42", "/shop/web-pr42", false},
+	}
+	for _, tt := range tests {
+		root, isGroup := previewRoot(tt.appID, "-pr42")
+		if root != tt.root || isGroup != tt.isGroup {
+			t.Errorf("previewRoot(%s) = %s, %t, want %s, %t", tt.appID, root, isGroup, tt.root, tt.isGroup)
+		}
+	}
+}
+
+func TestTeardownPreview(t *testing.T) {
+	preview := map[string]string{MARATHON_LABEL_PREVIEW: "mhausenblas/shop#42"}
+	other := map[string]string{MARATHON_LABEL_PREVIEW: "mhausenblas/shop#7"}
+	fm, marathonURL, stop := startFakeMarathon(
+		runningApp("/blog-pr42", "blog-pr42", 1, preview),
+		runningApp("/shop-pr42/web", "shop-pr42", 1, preview),
+		runningApp("/shop-pr42/backend/db", "shop-pr42", 1, preview),
+		runningApp("/shop-pr7/web", "shop-pr7", 1, other),
+		runningApp("/shop/web", "shop", 1, nil),
+	)
+	defer stop()
+	results, success := TeardownPreview(marathonURL.String(), "mhausenblas/shop#42", "-pr42")
+	if !success {
+		t.Errorf("teardown failed: %v", results)
+	}
+	torndown := []string{}
+	for _, r := range results {
+		torndown = append(torndown, r.ID)
+	}
+	sort.Strings(torndown)
+	if want := []string{"/blog-pr42", "/shop-pr42"}; !reflect.DeepEqual(torndown, want) {
+		t.Errorf("tore down %v, want %v", torndown, want)
+	}
+	left := []string{}
+	for id := range fm.apps {
+		left = append(left, id)
+	}
+	sort.Strings(left)
+	if want := []string{"/shop-pr7/web", "/shop/web"}; !reflect.DeepEqual(left, want) {
+		t.Errorf("left %v running, want %v", left, want)
+	}
+}
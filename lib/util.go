@@ -1,17 +1,24 @@
 package dploy
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	marathon "github.com/gambol99/go-marathon"
 	tw "github.com/olekukonko/tablewriter"
 	yaml "gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -90,30 +97,115 @@ func fetch(theURL url.URL) (string, string, error) {
 	}
 }
 
-func readAppDescriptor(workdir string) DployApp {
+func readAppDescriptor(workdir string) (DployApp, error) {
 	ad, _ := filepath.Abs(filepath.Join(workdir, APP_DESCRIPTOR_FILENAME))
 	log.WithFields(log.Fields{"appdescriptor": "read"}).Debug("Trying to read app descriptor ", ad)
 	d, err := ioutil.ReadFile(ad)
 	if err != nil {
-		log.Fatalf("Failed to read app descriptor due to %v", err)
+		return DployApp{}, fmt.Errorf("Failed to read app descriptor due to %v", err)
 	}
 	appDescriptor := DployApp{}
 	uerr := yaml.Unmarshal([]byte(d), &appDescriptor)
 	if uerr != nil {
-		log.Fatalf("Failed to de-serialize app descriptor due to %v", uerr)
+		return DployApp{}, fmt.Errorf("Failed to de-serialize app descriptor %s due to %v", ad, uerr)
 	}
 	log.WithFields(log.Fields{"appdescriptor": "read"}).Debug("Got valid app descriptor ")
-	return appDescriptor
+	return appDescriptor, nil
 }
 
-func getPAT(workdir string) (string, bool) {
-	pat, _ := filepath.Abs(filepath.Join(workdir, MARATHON_OBSERVER_PAT_FILE))
-	patoken, err := ioutil.ReadFile(pat)
+// descriptorPath resolves a path set in the app descriptor, which is relative to
+// workdir unless absolute or starting with ~/
+func descriptorPath(workdir string, path string) string {
+	if strings.HasPrefix(path, "~/") {
+		path = filepath.Join(os.Getenv("HOME"), path[2:])
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workdir, path)
+	}
+	p, _ := filepath.Abs(path)
+	return p
+}
+
+// getPAT reads the personal access token from the file set via pat_file in the
+// app descriptor or else from .pat in workdir
+func getPAT(appDescriptor DployApp, workdir string) (string, bool) {
+	patFile := appDescriptor.PATFile
+	if patFile == "" {
+		patFile = MARATHON_OBSERVER_PAT_FILE
+	}
+	pat := descriptorPath(workdir, patFile)
+	patoken, err := ReadTokenFile(pat)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.WithFields(log.Fields{"pat": "read"}).Debug("Can't read GitHub Personal Access Token file ", err)
+		} else {
+			log.WithFields(log.Fields{"pat": "read"}).Error("Can't read GitHub Personal Access Token file due to ", err)
+		}
+		return "", false
+	}
+	return patoken, true
+}
+
+// getAppKey reads the private key of the GitHub App set up in the app descriptor
+// from the file set via github_app_key_file
+func getAppKey(appDescriptor DployApp, workdir string) (string, bool) {
+	if appDescriptor.GitHubAppID == 0 || appDescriptor.GitHubAppKeyFile == "" {
+		return "", false
+	}
+	key, err := ReadTokenFile(descriptorPath(workdir, appDescriptor.GitHubAppKeyFile))
 	if err != nil {
-		log.WithFields(log.Fields{"pat": "read"}).Debug("Can't read GitHub Personal Access Token file ", err)
+		log.WithFields(log.Fields{"appkey": "read"}).Error("Can't read private key of GitHub App due to ", err)
 		return "", false
 	}
-	return string(patoken), true
+	return key, true
+}
+
+// hasCredentials checks if the observer can authenticate against the SCM provider:
+// as GitHub App if one is set up, with a personal access token otherwise, where
+// either is available locally or as DC/OS secret
+func hasCredentials(appDescriptor DployApp, patExists bool, keyExists bool) bool {
+	if appDescriptor.GitHubAppID != 0 {
+		return keyExists || appDescriptor.GitHubAppKeySecret != ""
+	}
+	return patExists || appDescriptor.PATSecret != ""
+}
+
+// ReadTokenFile reads a token, such as a personal access token, from the file at
+// path, refusing files anyone may read. Surrounding whitespace is stripped.
+func ReadTokenFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode().Perm()&0004 != 0 {
+		return "", fmt.Errorf("%s is readable by anyone, restrict access to it with `chmod 600 %s`", path, path)
+	}
+	t, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(t))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return token, nil
+}
+
+// redactedSpec returns a copy of the app spec that's safe to log, with the values
+// of environment variables holding tokens, passwords or secrets masked
+func redactedSpec(appSpec marathon.Application) marathon.Application {
+	if appSpec.Env == nil {
+		return appSpec
+	}
+	env := make(map[string]string)
+	for k, v := range *appSpec.Env {
+		if strings.HasSuffix(k, "_PAT") || strings.HasSuffix(k, "_KEY") || strings.Contains(k, "TOKEN") || strings.Contains(k, "PASSWORD") || strings.Contains(k, "SECRET") {
+			v = strings.Repeat("*", len(v))
+		}
+		env[k] = v
+	}
+	appSpec.Env = &env
+	return appSpec
 }
 
 func observerAlive(marathonURL url.URL, appID string) bool {
@@ -138,6 +230,139 @@ func observerAlive(marathonURL url.URL, appID string) bool {
 	}
 }
 
+// Checks if push-to-deploy is configured in the app descriptor: it needs a
+// repo URL and, since the Webhook must be able to reach the observer, a public
+// node, unless the observer polls the repo
+func pushToDeployConfigured(appDescriptor DployApp) bool {
+	if appDescriptor.RepoURL == "" {
+		return false
+	}
+	return appDescriptor.PublicNode != "" || appDescriptor.ObserverMode == OBSERVER_MODE_POLL
+}
+
+// Splits a repo URL such as https://gitlab.com/GROUP/SUBGROUP/REPO.git into
+// owner (GROUP/SUBGROUP) and repo (REPO), independent of the SCM provider
+func splitRepoURL(repoURL string) (string, string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", "", err
+	}
+	p := strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	i := strings.LastIndex(p, "/")
+	if i < 1 || i == len(p)-1 {
+		return "", "", fmt.Errorf("%s doesn't look like OWNER/REPO", repoURL)
+	}
+	return p[:i], p[i+1:], nil
+}
+
+// marathonOf returns marathonLocation if set, otherwise the Marathon URL of the app
+// descriptor; this way the observer can use the Marathon it discovered without
+// having to rewrite the descriptors it checked out
+func marathonOf(appDescriptor DployApp, marathonLocation string) string {
+	if marathonLocation != "" {
+		return marathonLocation
+	}
+	return appDescriptor.MarathonURL
+}
+
+// repoName returns OWNER/REPO of the repo in the app descriptor, which is also
+// how the observer identifies the watch of the repo
+func repoName(appDescriptor DployApp) string {
+	owner, repo, err := splitRepoURL(appDescriptor.RepoURL)
+	if err != nil {
+		return ""
+	}
+	return owner + "/" + repo
+}
+
+// newWatch sets up the watch of the repo in the app descriptor for the observer
+func newWatch(appDescriptor DployApp, pat string, appKey string) (Watch, error) {
+	owner, repo, err := splitRepoURL(appDescriptor.RepoURL)
+	if err != nil {
+		return Watch{}, err
+	}
+	watch := Watch{
+		Owner:             owner,
+		Repo:              repo,
+		RepoURL:           appDescriptor.RepoURL,
+		SCM:               appDescriptor.SCM,
+		PAT:               pat,
+		AppID:             appDescriptor.GitHubAppID,
+		InstallationID:    appDescriptor.GitHubInstallationID,
+		AppKey:            appKey,
+		TargetBranch:      appDescriptor.TriggerBranch,
+		OnlySpecChanges:   appDescriptor.TriggerOnSpecChanges,
+		WorkspacePath:     appDescriptor.WorkspacePath,
+		Previews:          appDescriptor.Previews,
+		PreviewForks:      appDescriptor.PreviewForks,
+		Mode:              appDescriptor.ObserverMode,
+		PollInterval:      appDescriptor.PollInterval,
+		Approval:          appDescriptor.Approval,
+		ApprovalExpiry:    appDescriptor.ApprovalExpiry,
+		RollbackOnFailure: appDescriptor.RollbackOnFailure,
+		Notifications:     appDescriptor.Notifications,
+		SMTPPassword:      os.Getenv("DPLOY_SMTP_PASSWORD"),
+	}
+	if tags := appDescriptor.TriggerTags; tags != "" {
+		watch.TagPatterns = strings.Split(tags, ",")
+	}
+	if authors := appDescriptor.PreviewAuthors; authors != "" {
+		watch.PreviewAuthors = strings.Split(authors, ",")
+	}
+	// reference DC/OS secrets rather than sending the credentials themselves:
+	if watch.AppID != 0 && appDescriptor.GitHubAppKeySecret != "" {
+		watch.AppKey, watch.AppKeyRef = "", secretRef(watch, "APP_KEY")
+	}
+	if watch.AppID == 0 && appDescriptor.PATSecret != "" {
+		watch.PAT, watch.PATRef = "", secretRef(watch, "PAT")
+	}
+	if len(watch.Notifications) > 0 && appDescriptor.SMTPPasswordSecret != "" {
+		watch.SMTPPassword, watch.SMTPPasswordRef = "", secretRef(watch, "SMTP_PASSWORD")
+	}
+	return watch, nil
+}
+
+// secretRef names the environment variable of the observer holding a secret of the
+// watch, such as DPLOY_OBSERVER_SECRET_PAT_MHAUSENBLAS_DPLOY for the token of mhausenblas/dploy
+func secretRef(watch Watch, kind string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(watch.Owner+"_"+watch.Repo))
+	return OBSERVER_SECRET_ENV_PREFIX + kind + "_" + name
+}
+
+// watchSecrets maps the environment variables the watch references to the DC/OS
+// secrets in the app descriptor they're sourced from
+func watchSecrets(appDescriptor DployApp, watch Watch) map[string]string {
+	secrets := make(map[string]string)
+	if watch.PATRef != "" {
+		secrets[watch.PATRef] = appDescriptor.PATSecret
+	}
+	if watch.AppKeyRef != "" {
+		secrets[watch.AppKeyRef] = appDescriptor.GitHubAppKeySecret
+	}
+	if watch.SMTPPasswordRef != "" {
+		secrets[watch.SMTPPasswordRef] = appDescriptor.SMTPPasswordSecret
+	}
+	return secrets
+}
+
+// warnInlineSecret warns loudly that a secret ends up in the app definition of the
+// observer in plain text, since it's not referenced as DC/OS secret via attribute
+func warnInlineSecret(what string, attribute string) {
+	log.WithFields(log.Fields{"observer": "launch"}).Warn("Passing ", what, " to observer as plain environment variable")
+	fmt.Printf("%s	WARNING: The %s is passed to the observer as plain environment variable, visible to anyone who can read its app definition in Marathon.\n", USER_MSG_PROBLEM, what)
+	fmt.Printf("%s	Store it in the DC/OS secret store and set %s in %s to reference it instead.\n", USER_MSG_INFO, attribute, APP_DESCRIPTOR_FILENAME)
+}
+
+// carriesSecrets tells if the watch carries credentials itself rather than references
+func (watch Watch) carriesSecrets() bool {
+	return watch.PAT != "" || watch.AppKey != "" || watch.SMTPPassword != "" || watch.HookSecret != ""
+}
+
 func launchObserver(appDescriptor DployApp, workdir string) bool {
 	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
 	if err != nil {
@@ -145,11 +370,14 @@ func launchObserver(appDescriptor DployApp, workdir string) bool {
 		return false
 	}
 	client := marathonClient(*marathonURL)
-	patoken, patExists := getPAT(workdir)
-	if appDescriptor.RepoURL != "" && appDescriptor.PublicNode != "" && patExists { // push-to-deploy is configured
-		owpo := appDescriptor.RepoURL[len("https://github.com/"):] // https://github.com/OWNER/REPO -> OWNER, REPO
-		owner := strings.Split(owpo, "/")[0]
-		repo := strings.Split(owpo, "/")[1]
+	patoken, patExists := getPAT(appDescriptor, workdir)
+	appKey, keyExists := getAppKey(appDescriptor, workdir)
+	if pushToDeployConfigured(appDescriptor) && hasCredentials(appDescriptor, patExists, keyExists) {
+		owner, repo, err := splitRepoURL(appDescriptor.RepoURL)
+		if err != nil {
+			log.WithFields(log.Fields{"observer": "launch"}).Error("Failed to parse repo URL due to ", err)
+			return false
+		}
 		log.WithFields(log.Fields{"observer": "launch"}).Debug("Got repo ", owner, "/", repo)
 		fn, err := Download(MARATHON_OBSERVER_TEMPLATE, workdir)
 		if err != nil {
@@ -157,18 +385,105 @@ func launchObserver(appDescriptor DployApp, workdir string) bool {
 			return false
 		}
 		observerTemplate, _ := filepath.Abs(filepath.Join(workdir, fn))
-		appSpec, _ := readAppSpec(appDescriptor.AppName, observerTemplate)
-		if ok := observerAlive(*marathonURL, appSpec.ID); ok { // observer is already running
+		appSpec, _, err := readAppSpec(appDescriptor.AppName, observerTemplate)
+		if err != nil || appSpec == nil {
+			log.WithFields(log.Fields{"observer": "launch"}).Error("Failed to read observer template due to ", err)
+			return false
+		}
+		if ok := observerAlive(*marathonURL, appSpec.ID); ok { // observer is already running, so add a watch for the repo
+			watch, err := newWatch(appDescriptor, patoken, appKey)
+			if err != nil {
+				log.WithFields(log.Fields{"observer": "launch"}).Error("Failed to set up watch due to ", err)
+				return false
+			}
+			if err := observerProvideSecrets(client, watchSecrets(appDescriptor, watch)); err != nil {
+				log.WithFields(log.Fields{"observer": "launch"}).Error("Failed to provide the DC/OS secrets of ", owner, "/", repo, " to observer due to ", err)
+				return false
+			}
+			if err := observerAdmin(appDescriptor, workdir, "POST", "/watches", watch, nil); err != nil {
+				log.WithFields(log.Fields{"observer": "launch"}).Error("Failed to add watch of ", owner, "/", repo, " to observer due to ", err)
+				return false
+			}
+			log.WithFields(log.Fields{"observer": "launch"}).Info("Observer now also watches ", owner, "/", repo)
 			return true
 		} else {
 			appSpec.AddEnv("DPLOY_PUBLIC_NODE", appDescriptor.PublicNode)
-			appSpec.AddEnv("DPLOY_OBSERVER_GITHUB_PAT", patoken)
+			if id := appDescriptor.GitHubAppID; id != 0 { // authenticate as GitHub App rather than with a token
+				appSpec.AddEnv("DPLOY_OBSERVER_GITHUB_APP_ID", strconv.Itoa(id))
+				if installation := appDescriptor.GitHubInstallationID; installation != 0 {
+					appSpec.AddEnv("DPLOY_OBSERVER_GITHUB_APP_INSTALLATION_ID", strconv.Itoa(installation))
+				}
+				if secret := appDescriptor.GitHubAppKeySecret; secret != "" {
+					appSpec.AddSecret("DPLOY_OBSERVER_GITHUB_APP_KEY", "app-key", secret)
+				} else {
+					warnInlineSecret("private key of the GitHub App", "github_app_key_secret")
+					appSpec.AddEnv("DPLOY_OBSERVER_GITHUB_APP_KEY", appKey)
+				}
+			} else if secret := appDescriptor.PATSecret; secret != "" { // reference the secret rather than putting the token into the app spec
+				appSpec.AddSecret("DPLOY_OBSERVER_GITHUB_PAT", "pat", secret)
+			} else {
+				warnInlineSecret("personal access token", "pat_secret")
+				appSpec.AddEnv("DPLOY_OBSERVER_GITHUB_PAT", patoken)
+			}
 			appSpec.AddEnv("DPLOY_OBSERVER_GITHUB_OWNER", owner)
 			appSpec.AddEnv("DPLOY_OBSERVER_GITHUB_REPO", repo)
+			appSpec.AddEnv("DPLOY_OBSERVER_REPO_URL", appDescriptor.RepoURL)
+			token, err := observerToken(appDescriptor, workdir, true)
+			if err != nil {
+				log.WithFields(log.Fields{"observer": "launch"}).Error("Failed to set up admin token of observer due to ", err)
+				return false
+			}
+			appSpec.AddEnv("DPLOY_OBSERVER_ADMIN_TOKEN_SHA256", tokenDigest(token))
+			if scm := appDescriptor.SCM; scm != "" {
+				appSpec.AddEnv("DPLOY_OBSERVER_SCM", scm)
+			}
 			if branch := appDescriptor.TriggerBranch; branch != "" {
 				appSpec.AddEnv("DPLOY_OBSERVER_TARGETBRANCH", branch)
 			}
-			log.WithFields(log.Fields{"observer": "launch"}).Debug("Trying to launch observer with following app spec ", appSpec)
+			if tags := appDescriptor.TriggerTags; tags != "" {
+				appSpec.AddEnv("DPLOY_OBSERVER_TAG_PATTERNS", tags)
+			}
+			if appDescriptor.TriggerOnSpecChanges {
+				appSpec.AddEnv("DPLOY_OBSERVER_ONLY_SPEC_CHANGES", "true")
+			}
+			if appDescriptor.Previews {
+				appSpec.AddEnv("DPLOY_OBSERVER_PREVIEWS", "true")
+			}
+			if appDescriptor.PreviewForks {
+				appSpec.AddEnv("DPLOY_OBSERVER_PREVIEW_FORKS", "true")
+			}
+			if authors := appDescriptor.PreviewAuthors; authors != "" {
+				appSpec.AddEnv("DPLOY_OBSERVER_PREVIEW_AUTHORS", authors)
+			}
+			if ws := appDescriptor.WorkspacePath; ws != "" {
+				appSpec.AddEnv("DPLOY_OBSERVER_WORKSPACE_PATH", ws)
+			}
+			if mode := appDescriptor.ObserverMode; mode != "" {
+				appSpec.AddEnv("DPLOY_OBSERVER_MODE", mode)
+			}
+			if interval := appDescriptor.PollInterval; interval > 0 {
+				appSpec.AddEnv("DPLOY_OBSERVER_POLL_INTERVAL", strconv.Itoa(interval))
+			}
+			if appDescriptor.RollbackOnFailure {
+				appSpec.AddEnv("DPLOY_OBSERVER_ROLLBACK_ON_FAILURE", "true")
+			}
+			if appDescriptor.Approval {
+				appSpec.AddEnv("DPLOY_OBSERVER_APPROVAL", "true")
+				if expiry := appDescriptor.ApprovalExpiry; expiry > 0 {
+					appSpec.AddEnv("DPLOY_OBSERVER_APPROVAL_EXPIRY", strconv.Itoa(expiry))
+				}
+			}
+			if len(appDescriptor.Notifications) > 0 {
+				notifications, _ := json.Marshal(appDescriptor.Notifications)
+				appSpec.AddEnv("DPLOY_OBSERVER_NOTIFICATIONS", string(notifications))
+				if secret := appDescriptor.SMTPPasswordSecret; secret != "" {
+					appSpec.AddSecret("DPLOY_OBSERVER_SMTP_PASSWORD", "smtp-password", secret)
+				} else if password := os.Getenv("DPLOY_SMTP_PASSWORD"); password != "" {
+					warnInlineSecret("SMTP password", "smtp_password_secret")
+					appSpec.AddEnv("DPLOY_OBSERVER_SMTP_PASSWORD", password)
+				}
+			}
+			log.WithFields(log.Fields{"observer": "launch"}).Debug("Trying to launch observer with following app spec ", redactedSpec(*appSpec))
 			if _, err := os.Stat(observerTemplate); err == nil {
 				os.Remove(observerTemplate)
 				log.WithFields(log.Fields{"observer": "launch"}).Debug("Removed temporary observer template ", observerTemplate)
@@ -202,29 +517,184 @@ func killObserver(appDescriptor DployApp, workdir string) bool {
 		return false
 	}
 	client := marathonClient(*marathonURL)
-	if appDescriptor.RepoURL != "" && appDescriptor.PublicNode != "" {
+	if pushToDeployConfigured(appDescriptor) {
 		fn, err := Download(MARATHON_OBSERVER_TEMPLATE, workdir)
 		if err != nil {
 			log.WithFields(log.Fields{"observer": "kill"}).Error("Failed to download observer template due to ", err)
 			return false
 		}
 		observerTemplate, _ := filepath.Abs(filepath.Join(workdir, fn))
-		appSpec, _ := readAppSpec(appDescriptor.AppName, observerTemplate)
+		appSpec, _, err := readAppSpec(appDescriptor.AppName, observerTemplate)
+		if err != nil || appSpec == nil {
+			log.WithFields(log.Fields{"observer": "kill"}).Error("Failed to read observer template due to ", err)
+			return false
+		}
 		if ok := observerAlive(*marathonURL, appSpec.ID); ok {
-			_, err := client.DeleteApplication(appSpec.ID)
+			if err := observerAdmin(appDescriptor, workdir, "DELETE", "/watches/"+repoName(appDescriptor), nil, nil); err != nil {
+				log.WithFields(log.Fields{"observer": "kill"}).Error("Failed to remove watch and unregister Webhook due to ", err, ", it requires manual removal")
+			} else {
+				log.WithFields(log.Fields{"observer": "kill"}).Info("Removed watch and unregistered Webhook")
+			}
+			remaining := []Watch{}
+			if err := observerAdmin(appDescriptor, workdir, "GET", "/watches", nil, &remaining); err == nil && len(remaining) > 0 {
+				log.WithFields(log.Fields{"observer": "kill"}).Info("Keeping observer since it still watches ", len(remaining), " other repo(s)")
+				return true
+			}
+			_, err := client.DeleteApplication(appSpec.ID, false)
 			if err != nil {
 				log.WithFields(log.Fields{"observer": "kill"}).Info("Failed to kill observer")
 				return false
 			}
 			log.WithFields(log.Fields{"observer": "kill"}).Info("Killed observer")
 			client.WaitOnDeployment(appSpec.ID, DEFAULT_DEPLOY_WAIT_TIME*time.Second)
-			// TODO: unregister Webhook as well
 			return true
 		}
 	}
 	return false
 }
 
+// observerLocation returns the base URL of the running observer along with its app.
+// The observer is reached via the public node, using the host port Marathon assigned to it.
+func observerLocation(appDescriptor DployApp) (string, *marathon.Application, error) {
+	marathonURL, err := url.Parse(appDescriptor.MarathonURL)
+	if err != nil {
+		return "", nil, err
+	}
+	client := marathonClient(*marathonURL)
+	observer, err := client.Application(MARATHON_OBSERVER_APP_ID)
+	if err != nil || len(observer.Tasks) == 0 || len(observer.Tasks[0].Ports) == 0 {
+		return "", nil, fmt.Errorf("The observer is not running, is push-to-deploy configured?")
+	}
+	host := appDescriptor.PublicNode
+	if host == "" {
+		host = observer.Tasks[0].Host
+	}
+	scheme := "http"
+	if observerEnv(observer, "DPLOY_OBSERVER_TLS_CERT") != "" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, host, observer.Tasks[0].Ports[0]), observer, nil
+}
+
+func observerEnv(observer *marathon.Application, name string) string {
+	if observer.Env == nil {
+		return ""
+	}
+	return (*observer.Env)[name]
+}
+
+// observerProvideSecrets makes DC/OS secrets available to the running observer as the
+// environment variables they're mapped to, so that watches can reference them. Since
+// this changes the app definition, Marathon restarts the observer, which then restores
+// its watches from the persisted state.
+func observerProvideSecrets(client marathon.Marathon, secrets map[string]string) error {
+	observer, err := client.Application(MARATHON_OBSERVER_APP_ID)
+	if err != nil {
+		return err
+	}
+	update := new(marathon.Application)
+	update.ID = observer.ID
+	update.Env = observer.Env
+	update.Secrets = observer.Secrets
+	missing := false
+	for envVar, source := range secrets {
+		if observer.Secrets != nil {
+			if s, ok := (*observer.Secrets)[strings.ToLower(envVar)]; ok && s.EnvVar == envVar && s.Source == source {
+				continue
+			}
+		}
+		update.AddSecret(envVar, strings.ToLower(envVar), source)
+		missing = true
+	}
+	if !missing {
+		return nil
+	}
+	deployment, err := client.UpdateApplication(update, false)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"observer": "secrets"}).Debug("Providing ", len(secrets), " DC/OS secret(s) to observer in deployment ", deployment.DeploymentID)
+	return marathonWaitOnDeployment(client, observer.ID, deployment.DeploymentID, DEFAULT_UPGRADE_WAIT_TIME*time.Second)
+}
+
+// observerAdmin calls an admin endpoint of the observer, authenticated with the admin
+// token launchObserver has set up for it, encoding in and decoding the result into out
+// as JSON, if not nil
+func observerAdmin(appDescriptor DployApp, workdir string, method string, path string, in interface{}, out interface{}) error {
+	location, _, err := observerLocation(appDescriptor)
+	if err != nil {
+		return err
+	}
+	token, err := observerToken(appDescriptor, workdir, false)
+	if err != nil {
+		return fmt.Errorf("Can't read admin token of the observer due to %s", err)
+	}
+	if watch, ok := in.(Watch); ok && watch.carriesSecrets() && !strings.HasPrefix(location, "https://") {
+		return fmt.Errorf("Refusing to send the credentials of %s/%s to the observer via plain HTTP, reference them as DC/OS secrets via pat_secret, github_app_key_secret and smtp_password_secret or serve the observer via TLS", watch.Owner, watch.Repo)
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, location+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("The observer responded with %s", resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// generateToken returns a random token, for example to authenticate against the observer
+func generateToken() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// observerToken reads the admin token of the observer from the file set via
+// observer_token_file in the app descriptor or else from .observer-token in workdir.
+// With create set, a new token is generated and written to the file, readable by the
+// owner only, if there's none yet. The observer itself only gets to know the digest of
+// the token, so the token doesn't show up in its app definition.
+func observerToken(appDescriptor DployApp, workdir string, create bool) (string, error) {
+	tokenFile := appDescriptor.ObserverTokenFile
+	if tokenFile == "" {
+		tokenFile = OBSERVER_TOKEN_FILE
+	}
+	tf := descriptorPath(workdir, tokenFile)
+	token, err := ReadTokenFile(tf)
+	if err == nil || !create || !os.IsNotExist(err) {
+		return token, err
+	}
+	token = generateToken()
+	if err := ioutil.WriteFile(tf, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	log.WithFields(log.Fields{"observer": "token"}).Info("Stored admin token of observer in ", tf)
+	return token, nil
+}
+
+// tokenDigest returns the hex encoded SHA-256 digest of token
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func getAppSpecs(workdir string) []string {
 	appSpecDir, _ := filepath.Abs(filepath.Join(workdir, MARATHON_APP_SPEC_DIR))
 	log.WithFields(log.Fields{"marathon": "get_app_specs"}).Debug("Trying to find app specs in ", appSpecDir)
@@ -243,11 +713,13 @@ func getAppSpecs(workdir string) []string {
 	return appSpecs
 }
 
-func readAppSpec(dployAppName, appSpecFilename string) (*marathon.Application, *marathon.Group) {
+// readAppSpec reads the app or group defined in an app spec and labels the app(s)
+// as belonging to dployAppName. Exactly one of app and group is set on success.
+func readAppSpec(dployAppName, appSpecFilename string) (*marathon.Application, *marathon.Group, error) {
 	log.WithFields(log.Fields{"marathon": "read_app_spec"}).Debug("Trying to read app spec ", appSpecFilename)
 	d, err := ioutil.ReadFile(appSpecFilename)
 	if err != nil {
-		log.WithFields(log.Fields{"marathon": "read_app_spec"}).Error("Can't read app spec ", appSpecFilename)
+		return nil, nil, fmt.Errorf("Failed to read app spec %s due to %v", appSpecFilename, err)
 	}
 	log.WithFields(log.Fields{"marathon": "read_app_spec"}).Debug("Got app spec:\n", string(d))
 
@@ -255,19 +727,19 @@ func readAppSpec(dployAppName, appSpecFilename string) (*marathon.Application, *
 		group := marathon.Group{}
 		uerr := json.Unmarshal([]byte(d), &group)
 		if uerr != nil {
-			log.Fatalf("Failed to de-serialize app spec for group due to %v", uerr)
+			return nil, nil, fmt.Errorf("Failed to de-serialize app spec %s for group due to %v", appSpecFilename, uerr)
 		}
 		labelGroup(&group, dployAppName)
-		return nil, &group
+		return nil, &group, nil
 	} else { // we're dealing with a simple app
 		app := marathon.Application{}
 		uerr := json.Unmarshal([]byte(d), &app)
 		if uerr != nil {
-			log.Fatalf("Failed to de-serialize app spec due to %v", uerr)
+			return nil, nil, fmt.Errorf("Failed to de-serialize app spec %s due to %v", appSpecFilename, uerr)
 		}
 		log.WithFields(log.Fields{"marathon": "read_app_spec"}).Debug("Owning app ", app.ID)
 		labelApp(&app, dployAppName)
-		return &app, nil
+		return &app, nil, nil
 	}
 }
 
@@ -290,13 +762,17 @@ func labelApp(app *marathon.Application, label string) {
 	app.AddLabel(MARATHON_LABEL, label)
 }
 
-func renderAppResources(appDescriptor DployApp, workdir string) {
+func renderAppResources(appDescriptor DployApp, workdir string) bool {
 	table := tw.NewWriter(os.Stdout)
 	row := []string{"Marathon", RESOURCETYPE_PLATFORM, appDescriptor.MarathonURL}
 	table.Append(row)
 	if appSpecs := getAppSpecs(workdir); len(appSpecs) > 0 {
 		for _, specFilename := range appSpecs {
-			appSpec, groupAppSpec := readAppSpec(appDescriptor.AppName, specFilename)
+			appSpec, groupAppSpec, err := readAppSpec(appDescriptor.AppName, specFilename)
+			if err != nil {
+				fmt.Printf("%s\t%s\n", USER_MSG_PROBLEM, err)
+				return false
+			}
 			if appSpec != nil { // we have an app
 				renderApp(appSpec, specFilename, "", table)
 			} else { // we have a group
@@ -315,6 +791,7 @@ func renderAppResources(appDescriptor DployApp, workdir string) {
 		fmt.Printf("%s\tDidn't find any app specs in %s \n", USER_MSG_PROBLEM, MARATHON_APP_SPEC_DIR)
 		os.Exit(3)
 	}
+	return true
 }
 
 func renderApp(app *marathon.Application, specFilename string, path string, table *tw.Table) {
@@ -355,14 +832,26 @@ func listEndpoints(app *marathon.Application) string {
 	var endpoints []string
 	for _, task := range app.Tasks {
 		log.WithFields(log.Fields{"endpoints": "list"}).Debug("Inspecting task ", task)
+		if len(task.Ports) == 0 {
+			continue
+		}
 		endpoints = append(endpoints, fmt.Sprintf("%s:%d", task.Host, task.Ports[0]))
 	}
 	return strings.Join(endpoints[:], " ")
 }
 
+func listTaskIDs(app *marathon.Application) string {
+	var taskIDs []string
+	for _, task := range app.Tasks {
+		taskIDs = append(taskIDs, task.ID)
+	}
+	return strings.Join(taskIDs[:], " ")
+}
+
 func marathonClient(marathonURL url.URL) marathon.Marathon {
 	config := marathon.NewDefaultConfig()
 	config.URL = marathonURL.String()
+	config.HTTPClient = marathonHTTPClient()
 	client, err := marathon.NewClient(config)
 	if err != nil {
 		log.Fatalf("Failed to create a client for Marathon. Error: %s", err)
@@ -370,6 +859,12 @@ func marathonClient(marathonURL url.URL) marathon.Marathon {
 	return client
 }
 
+// marathonHTTPClient returns the client for requests against the Marathon API, using
+// MarathonTransport and the timeout go-marathon uses by default
+func marathonHTTPClient() *http.Client {
+	return &http.Client{Transport: MarathonTransport, Timeout: DEFAULT_MARATHON_TIMEOUT * time.Second}
+}
+
 func marathonGetInfo(marathonURL url.URL) *marathon.Info {
 	client := marathonClient(marathonURL)
 	info, err := client.Info()
@@ -417,11 +912,191 @@ func marathonAppRuntime(marathonURL url.URL, dployAppName string) []marathon.App
 	return myApps
 }
 
-func marathonCreateApps(marathonURL url.URL, dployAppName string, workdir string) {
+// marathonRestartApp triggers a rolling restart of an app and waits until the
+// resulting deployment has finished, reporting progress along the way.
+func marathonRestartApp(client marathon.Marathon, appID string) error {
+	deployment, err := client.RestartApplication(appID, false) // note: not forcing, last parameter set to false
+	if err != nil {
+		log.WithFields(log.Fields{"marathon": "restart_app"}).Error("Failed to restart app ", appID, " due to ", err)
+		return err
+	}
+	log.WithFields(log.Fields{"marathon": "restart_app"}).Debug("Restarting app ", appID, " in deployment ", deployment.DeploymentID)
+	return marathonWaitOnDeployment(client, appID, deployment.DeploymentID, DEFAULT_RESTART_WAIT_TIME*time.Second)
+}
+
+// marathonKillAndScale kills the tasks of an app selected through path (relative to
+// the app) and query, scales the app down accordingly and waits until the resulting
+// deployment has finished. This calls the Marathon API directly since go-marathon
+// expects the killed tasks in the response, while Marathon responds with the deployment.
+func marathonKillAndScale(client marathon.Marathon, marathonURL url.URL, appID string, path string, query url.Values) error {
+	if !strings.HasPrefix(appID, "/") {
+		appID = "/" + appID
+	}
+	query.Set("scale", "true")
+	marathonURL.Path = strings.TrimSuffix(marathonURL.Path, "/") + "/v2/apps" + appID + path
+	marathonURL.RawQuery = query.Encode()
+	req, err := http.NewRequest("DELETE", marathonURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := marathonHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Marathon responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	deployment := marathon.DeploymentID{}
+	if err := json.NewDecoder(resp.Body).Decode(&deployment); err != nil {
+		return fmt.Errorf("Can't decode deployment of %s due to %v", appID, err)
+	}
+	log.WithFields(log.Fields{"marathon": "kill_scale"}).Debug("Scaling down app ", appID, " in deployment ", deployment.DeploymentID)
+	return marathonWaitOnDeployment(client, appID, deployment.DeploymentID, DEFAULT_UPGRADE_WAIT_TIME*time.Second)
+}
+
+// appIDOfTask derives the ID of the app a task belongs to from the task ID, which
+// Marathon forms from the app ID with slashes replaced by underscores, a dot and a
+// UUID and, as of Marathon 1.4, an ._app.<incarnation> suffix.
+func appIDOfTask(taskID string) (string, error) {
+	id := taskID
+	if i := strings.Index(id, "._app."); i >= 0 {
+		id = id[:i]
+	}
+	i := strings.LastIndex(id, ".")
+	if i < 1 {
+		return "", fmt.Errorf("%s is not a Marathon task ID", taskID)
+	}
+	return "/" + strings.Replace(id[:i], "_", "/", -1), nil
+}
+
+// marathonWaitOnDeployment polls Marathon until the deployment is done and prints
+// the number of running and healthy tasks of the app whenever they change.
+// Returns an error if the deployment didn't finish in time or the app ended up unhealthy.
+func marathonWaitOnDeployment(client marathon.Marathon, appID string, deploymentID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	progress := ""
+	for {
+		if app, err := client.Application(appID); err == nil {
+			instances := 0
+			if app.Instances != nil {
+				instances = *app.Instances
+			}
+			p := fmt.Sprintf("%d/%d running, %d healthy, %d staged", app.TasksRunning, instances, app.TasksHealthy, app.TasksStaged)
+			if p != progress {
+				fmt.Printf("\t\t%s: %s\n", appID, p)
+				progress = p
+			}
+		}
+		inProgress, err := client.HasDeployment(deploymentID)
+		if err != nil {
+			log.WithFields(log.Fields{"marathon": "wait_deployment"}).Error("Can't check deployment ", deploymentID, " due to ", err)
+			return err
+		}
+		if !inProgress {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Deployment %s of %s didn't finish within %s", deploymentID, appID, timeout)
+		}
+		time.Sleep(DEFAULT_POLL_INTERVAL * time.Second)
+	}
+	if healthy, _ := client.ApplicationOK(appID); !healthy {
+		return fmt.Errorf("App %s is not healthy after deployment %s", appID, deploymentID)
+	}
+	return nil
+}
+
+// marathonSuspendApps scales all apps labelled with dployAppName to zero instances
+// and remembers the previous number of instances in the MARATHON_LABEL_SUSPENDED label.
+// Since Marathon lists apps nested in groups as well, these are covered, too.
+// Returns the IDs of the apps that have been suspended.
+func marathonSuspendApps(marathonURL url.URL, dployAppName string) ([]string, error) {
+	client := marathonClient(marathonURL)
+	var suspended []string
+	for _, app := range marathonAppRuntime(marathonURL, dployAppName) {
+		labels := copyLabels(app.Labels)
+		if _, ok := labels[MARATHON_LABEL_SUSPENDED]; ok {
+			log.WithFields(log.Fields{"marathon": "suspend_app"}).Debug("App ", app.ID, " is already suspended")
+			continue
+		}
+		instances := 0
+		if app.Instances != nil {
+			instances = *app.Instances
+		}
+		labels[MARATHON_LABEL_SUSPENDED] = strconv.Itoa(instances)
+		if err := marathonUpdateInstances(client, app.ID, 0, labels); err != nil {
+			log.WithFields(log.Fields{"marathon": "suspend_app"}).Error("Failed to suspend app ", app.ID, " due to ", err)
+			return suspended, err
+		}
+		log.WithFields(log.Fields{"marathon": "suspend_app"}).Debug("Suspended app ", app.ID, " with ", instances, " instances")
+		suspended = append(suspended, app.ID)
+	}
+	return suspended, nil
+}
+
+// marathonResumeApps scales all apps labelled with dployAppName that have been
+// suspended back to the number of instances recorded in the MARATHON_LABEL_SUSPENDED label.
+// Returns the IDs of the apps that have been resumed.
+func marathonResumeApps(marathonURL url.URL, dployAppName string) ([]string, error) {
+	client := marathonClient(marathonURL)
+	var resumed []string
+	for _, app := range marathonAppRuntime(marathonURL, dployAppName) {
+		labels := copyLabels(app.Labels)
+		count, ok := labels[MARATHON_LABEL_SUSPENDED]
+		if !ok {
+			log.WithFields(log.Fields{"marathon": "resume_app"}).Debug("App ", app.ID, " is not suspended")
+			continue
+		}
+		instances, err := strconv.Atoi(count)
+		if err != nil {
+			log.WithFields(log.Fields{"marathon": "resume_app"}).Error("Invalid number of instances ", count, " recorded for app ", app.ID)
+			return resumed, fmt.Errorf("Invalid number of instances %s recorded for app %s", count, app.ID)
+		}
+		delete(labels, MARATHON_LABEL_SUSPENDED)
+		if err := marathonUpdateInstances(client, app.ID, instances, labels); err != nil {
+			log.WithFields(log.Fields{"marathon": "resume_app"}).Error("Failed to resume app ", app.ID, " due to ", err)
+			return resumed, err
+		}
+		log.WithFields(log.Fields{"marathon": "resume_app"}).Debug("Resumed app ", app.ID, " with ", instances, " instances")
+		resumed = append(resumed, app.ID)
+	}
+	return resumed, nil
+}
+
+// marathonUpdateInstances sets both the number of instances and the labels
+// of an app in one go, resulting in a single Marathon deployment.
+func marathonUpdateInstances(client marathon.Marathon, appID string, instances int, labels map[string]string) error {
+	update := new(marathon.Application)
+	update.ID = appID
+	update.Count(instances)
+	update.Labels = &labels
+	if _, err := client.UpdateApplication(update, false); err != nil { // note: not forcing, last parameter set to false
+		return err
+	}
+	client.WaitOnApplication(appID, DEFAULT_DEPLOY_WAIT_TIME*time.Second)
+	return nil
+}
+
+func copyLabels(labels *map[string]string) map[string]string {
+	c := make(map[string]string)
+	if labels != nil {
+		for k, v := range *labels {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+func marathonCreateApps(marathonURL url.URL, dployAppName string, workdir string) error {
 	client := marathonClient(marathonURL)
 	appSpecs := getAppSpecs(workdir)
 	for _, specFilename := range appSpecs {
-		appSpec, group := readAppSpec(dployAppName, specFilename)
+		appSpec, group, err := readAppSpec(dployAppName, specFilename)
+		if err != nil {
+			return err
+		}
 		if appSpec != nil {
 			app, err := client.CreateApplication(appSpec)
 			if err != nil {
@@ -442,36 +1117,203 @@ func marathonCreateApps(marathonURL url.URL, dployAppName string, workdir string
 			client.WaitOnGroup(group.ID, DEFAULT_DEPLOY_WAIT_TIME*time.Second)
 		}
 	}
+	return nil
 }
 
-func marathonUpdateApps(marathonURL url.URL, dployAppName string, workdir string) error {
+// marathonUpdateApps updates the apps and groups defined in the app specs, skipping
+// those whose spec hasn't changed since the last update (tracked via the
+// MARATHON_LABEL_CHECKSUM label) and waiting for each update to become healthy.
+// Stops at the first app or group that fails to update.
+func marathonUpdateApps(marathonURL url.URL, dployAppName string, workdir string) ([]AppResult, error) {
 	client := marathonClient(marathonURL)
 	appSpecs := getAppSpecs(workdir)
+	results := []AppResult{}
 	for _, specFilename := range appSpecs {
-		appSpec, _ := readAppSpec(dployAppName, specFilename)
+		appSpec, group, err := readAppSpec(dployAppName, specFilename)
+		if err != nil {
+			return results, err
+		}
 		log.WithFields(log.Fields{"marathon": "update_app"}).Debug("Looking at ", dployAppName, " in ", specFilename)
 		if appSpec != nil {
-			//TODO: only update apps that have actually changed
-			_, err := client.UpdateApplication(appSpec, true) // note: for now we default to force updates
+			result, err := marathonUpdateApp(client, appSpec)
+			results = append(results, result)
 			if err != nil {
-				log.WithFields(log.Fields{"marathon": "update_app"}).Error("Failed to update app due to ", err)
-				return err
-			} else {
-				log.WithFields(log.Fields{"marathon": "update_app"}).Debug("Updated app: ", appSpec.ID)
+				return results, err
+			}
+		} else {
+			groupResults, err := marathonUpdateGroup(client, group)
+			results = append(results, groupResults...)
+			if err != nil {
+				return results, err
 			}
-			client.WaitOnApplication(appSpec.ID, DEFAULT_DEPLOY_WAIT_TIME*time.Second)
 		}
 	}
-	return nil
+	return results, nil
+}
+
+func marathonUpdateApp(client marathon.Marathon, app *marathon.Application) (AppResult, error) {
+	checksum := specChecksum(app)
+	if running, err := client.Application(app.ID); err == nil && running.Labels != nil && (*running.Labels)[MARATHON_LABEL_CHECKSUM] == checksum {
+		log.WithFields(log.Fields{"marathon": "update_app"}).Debug("App ", app.ID, " unchanged, skipping it")
+		return AppResult{ID: app.ID, Success: true, Msg: "unchanged", Endpoints: listEndpoints(running)}, nil
+	}
+	app.AddLabel(MARATHON_LABEL_CHECKSUM, checksum)
+	deployment, err := client.UpdateApplication(app, true) // note: for now we default to force updates
+	if err != nil {
+		log.WithFields(log.Fields{"marathon": "update_app"}).Error("Failed to update app due to ", err)
+		return AppResult{ID: app.ID, Success: false, Msg: err.Error()}, err
+	}
+	log.WithFields(log.Fields{"marathon": "update_app"}).Debug("Updating app ", app.ID, " in deployment ", deployment.DeploymentID)
+	if err := marathonWaitOnDeployment(client, app.ID, deployment.DeploymentID, DEFAULT_UPGRADE_WAIT_TIME*time.Second); err != nil {
+		return AppResult{ID: app.ID, Success: false, Msg: err.Error()}, err
+	}
+	return AppResult{ID: app.ID, Success: true, Endpoints: marathonEndpoints(client, app.ID)}, nil
+}
+
+// marathonUpdateGroup updates a group, including its nested groups and apps, via
+// the group update API. Since groups can't be labelled, the checksum of the group
+// spec is stored with each of its apps and the group counts as unchanged if all of
+// them carry it. The outcome is reported per app of the group.
+func marathonUpdateGroup(client marathon.Marathon, group *marathon.Group) ([]AppResult, error) {
+	checksum := specChecksum(group)
+	apps := map[string]*marathon.Application{}
+	groupApps(group, "", apps)
+	appIDs := []string{}
+	for id := range apps {
+		appIDs = append(appIDs, id)
+	}
+	sort.Strings(appIDs)
+	results := []AppResult{}
+	unchanged := true
+	for _, id := range appIDs {
+		running, err := client.Application(id)
+		if err != nil || running.Labels == nil || (*running.Labels)[MARATHON_LABEL_CHECKSUM] != checksum {
+			unchanged = false
+			continue
+		}
+		results = append(results, AppResult{ID: id, Success: true, Msg: "unchanged", Endpoints: listEndpoints(running)})
+	}
+	if unchanged {
+		log.WithFields(log.Fields{"marathon": "update_group"}).Debug("Group ", group.ID, " unchanged, skipping it")
+		return results, nil
+	}
+	for _, app := range apps {
+		app.AddLabel(MARATHON_LABEL_CHECKSUM, checksum)
+	}
+	deployment, err := client.UpdateGroup(group.ID, group, false) // note: not forcing, last parameter set to false
+	if err != nil {
+		log.WithFields(log.Fields{"marathon": "update_group"}).Error("Failed to update group due to ", err)
+		return []AppResult{{ID: group.ID, Success: false, Msg: err.Error()}}, err
+	}
+	log.WithFields(log.Fields{"marathon": "update_group"}).Debug("Updating group ", group.ID, " in deployment ", deployment.DeploymentID)
+	results = []AppResult{}
+	var gerr error
+	for _, id := range appIDs { // once the deployment is done, this only checks the health of the remaining apps
+		if err := marathonWaitOnDeployment(client, id, deployment.DeploymentID, DEFAULT_UPGRADE_WAIT_TIME*time.Second); err != nil {
+			results = append(results, AppResult{ID: id, Success: false, Msg: err.Error()})
+			gerr = err
+			continue
+		}
+		results = append(results, AppResult{ID: id, Success: true, Endpoints: marathonEndpoints(client, id)})
+	}
+	return results, gerr
 }
 
-func marathonDeleteApps(marathonURL url.URL, dployAppName string, workdir string) {
+// marathonPlanApps compares the checksums of the app specs in the workdir with
+// the ones of the running µS to tell which would be created or updated
+func marathonPlanApps(marathonURL url.URL, dployAppName string, workdir string) ([]AppResult, error) {
+	client := marathonClient(marathonURL)
+	results := []AppResult{}
+	for _, specFilename := range getAppSpecs(workdir) {
+		appSpec, group, err := readAppSpec(dployAppName, specFilename)
+		if err != nil {
+			return results, err
+		}
+		checksum := ""
+		apps := map[string]*marathon.Application{}
+		if appSpec != nil {
+			checksum = specChecksum(appSpec)
+			apps[appSpec.ID] = appSpec
+		} else {
+			checksum = specChecksum(group)
+			groupApps(group, "", apps)
+		}
+		appIDs := []string{}
+		for id := range apps {
+			appIDs = append(appIDs, id)
+		}
+		sort.Strings(appIDs)
+		for _, id := range appIDs {
+			running, err := client.Application(id)
+			if err != nil {
+				running = nil // not deployed yet
+			}
+			action := planAction(running, checksum)
+			log.WithFields(log.Fields{"marathon": "plan"}).Debug("Planning to ", action, " ", id)
+			results = append(results, AppResult{ID: id, Success: true, Msg: action})
+		}
+	}
+	return results, nil
+}
+
+// planAction tells if an app would be created, updated or is unchanged, given the
+// running app, nil if there's none, and the checksum of its spec
+func planAction(running *marathon.Application, checksum string) string {
+	switch {
+	case running == nil:
+		return PLAN_CREATE
+	case running.Labels != nil && (*running.Labels)[MARATHON_LABEL_CHECKSUM] == checksum:
+		return PLAN_UNCHANGED
+	}
+	return PLAN_UPDATE
+}
+
+// marathonEndpoints looks up the endpoints of the running app, if any
+func marathonEndpoints(client marathon.Marathon, appID string) string {
+	app, err := client.Application(appID)
+	if err != nil {
+		log.WithFields(log.Fields{"marathon": "endpoints"}).Debug("Can't look up endpoints of ", appID, " due to ", err)
+		return ""
+	}
+	return listEndpoints(app)
+}
+
+// groupApps collects the apps of a group and its nested groups by absolute ID,
+// resolving relative IDs against path
+func groupApps(group *marathon.Group, path string, apps map[string]*marathon.Application) {
+	groupID := group.ID
+	if !strings.HasPrefix(groupID, "/") {
+		groupID = path + "/" + groupID
+	}
+	for _, app := range group.Apps {
+		appID := app.ID
+		if !strings.HasPrefix(appID, "/") {
+			appID = groupID + "/" + appID
+		}
+		apps[appID] = app
+	}
+	for _, g := range group.Groups {
+		groupApps(g, groupID, apps)
+	}
+}
+
+// specChecksum computes the SHA-256 checksum of an app or group spec
+func specChecksum(spec interface{}) string {
+	b, _ := json.Marshal(spec)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func marathonDeleteApps(marathonURL url.URL, dployAppName string, workdir string) error {
 	client := marathonClient(marathonURL)
 	appSpecs := getAppSpecs(workdir)
 	for _, specFilename := range appSpecs {
-		appSpec, groupAppSpec := readAppSpec(dployAppName, specFilename)
+		appSpec, groupAppSpec, err := readAppSpec(dployAppName, specFilename)
+		if err != nil {
+			return err
+		}
 		if appSpec != nil {
-			_, err := client.DeleteApplication(appSpec.ID)
+			_, err := client.DeleteApplication(appSpec.ID, false)
 			if err != nil {
 				log.WithFields(log.Fields{"marathon": "delete_app"}).Info("Failed to delete app ", appSpec.ID, " due to ", err)
 			} else {
@@ -479,7 +1321,7 @@ func marathonDeleteApps(marathonURL url.URL, dployAppName string, workdir string
 			}
 			client.WaitOnDeployment(appSpec.ID, DEFAULT_DEPLOY_WAIT_TIME*time.Second)
 		} else {
-			_, err := client.DeleteGroup(groupAppSpec.ID)
+			_, err := client.DeleteGroup(groupAppSpec.ID, false)
 			if err != nil {
 				log.WithFields(log.Fields{"marathon": "delete_app"}).Info("Failed to delete group ", groupAppSpec.ID, " due to ", err)
 			} else {
@@ -488,4 +1330,5 @@ func marathonDeleteApps(marathonURL url.URL, dployAppName string, workdir string
 			client.WaitOnDeployment(groupAppSpec.ID, DEFAULT_DEPLOY_WAIT_TIME*time.Second)
 		}
 	}
+	return nil
 }
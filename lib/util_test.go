@@ -0,0 +1,405 @@
+package dploy
+
+import (
+	"encoding/json"
+	"fmt"
+	marathon "github.com/gambol99/go-marathon"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Helpers
+
+// writes the app spec into a temporary file and reads it back
+func appSpecOf(t *testing.T, spec string) (*marathon.Application, *marathon.Group) {
+	dir, _ := ioutil.TempDir("", "dploy-spec")
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "spec.json")
+	if err := ioutil.WriteFile(fn, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	app, group, err := readAppSpec("test", fn)
+	if err != nil {
+		t.Fatalf("can't read app spec: %v", err)
+	}
+	return app, group
+}
+
+// fakeMarathon serves the parts of the Marathon API dploy uses to manage running
+// apps, keeping the apps in memory and recording the requests it got
+type fakeMarathon struct {
+	apps     map[string]*marathon.Application
+	requests []string
+	mutex    sync.Mutex
+}
+
+// starts a fake Marathon running the apps, returning its URL and the function to stop it
+func startFakeMarathon(apps ...*marathon.Application) (*fakeMarathon, url.URL, func()) {
+	fm := &fakeMarathon{apps: map[string]*marathon.Application{}}
+	for _, app := range apps {
+		fm.apps[app.ID] = app
+		fm.run(app)
+	}
+	server := httptest.NewServer(fm)
+	u, _ := url.Parse(server.URL)
+	return fm, *u, server.Close
+}
+
+// sets the tasks of the app according to its number of instances
+func (fm *fakeMarathon) run(app *marathon.Application) {
+	app.Tasks = nil
+	instances := 0
+	if app.Instances != nil {
+		instances = *app.Instances
+	}
+	for i := 0; i < instances; i++ {
+		app.Tasks = append(app.Tasks, &marathon.Task{ID: fmt.Sprintf("%s.%d", strings.Replace(strings.TrimPrefix(app.ID, "/"), "/", "_", -1), i), AppID: app.ID})
+	}
+	app.TasksRunning = instances
+}
+
+func (fm *fakeMarathon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	fm.requests = append(fm.requests, r.Method+" "+r.URL.RequestURI())
+	path := strings.TrimPrefix(r.URL.Path, "/v2/apps")
+	switch {
+	case r.URL.Path == "/v2/deployments":
+		json.NewEncoder(w).Encode([]marathon.Deployment{})
+		return
+	case r.URL.Path == "/v2/apps" && r.Method == "GET":
+		apps := marathon.Applications{}
+		for _, app := range fm.apps {
+			apps.Apps = append(apps.Apps, *app)
+		}
+		json.NewEncoder(w).Encode(apps)
+		return
+	case strings.HasPrefix(r.URL.Path, "/v2/groups/") && r.Method == "DELETE":
+		group := strings.TrimPrefix(r.URL.Path, "/v2/groups")
+		for id := range fm.apps {
+			if strings.HasPrefix(id, group+"/") {
+				delete(fm.apps, id)
+			}
+		}
+		json.NewEncoder(w).Encode(marathon.DeploymentID{DeploymentID: "deployment-group"})
+		return
+	}
+	id, action := path, ""
+	for _, a := range []string{"/restart", "/tasks"} {
+		if i := strings.Index(path, a); i >= 0 {
+			id, action = path[:i], a
+		}
+	}
+	app, ok := fm.apps[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"message": "App '%s' does not exist"}`, id)
+		return
+	}
+	deployment := marathon.DeploymentID{DeploymentID: "deployment-" + action, Version: "2018-06-14T23:20:16.000Z"}
+	switch {
+	case r.Method == "GET" && action == "":
+		json.NewEncoder(w).Encode(map[string]*marathon.Application{"app": app})
+		return
+	case r.Method == "PUT" && action == "":
+		update := marathon.Application{}
+		json.NewDecoder(r.Body).Decode(&update)
+		if update.Instances != nil {
+			app.Instances = update.Instances
+		}
+		if update.Labels != nil {
+			app.Labels = update.Labels
+		}
+	case r.Method == "DELETE" && action == "":
+		delete(fm.apps, id)
+		json.NewEncoder(w).Encode(deployment)
+		return
+	case r.Method == "POST" && action == "/restart":
+	case r.Method == "DELETE" && action == "/tasks" && r.URL.Query().Get("scale") == "true":
+		app.Count(*app.Instances - 1)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	fm.run(app)
+	json.NewEncoder(w).Encode(deployment)
+}
+
+// returns a snapshot of the app with the ID
+func (fm *fakeMarathon) app(id string) marathon.Application {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	return *fm.apps[id]
+}
+
+// returns an app labelled as part of the dploy app name with the number of instances
+func runningApp(id string, name string, instances int, labels map[string]string) *marathon.Application {
+	app := &marathon.Application{ID: id}
+	app.Count(instances)
+	app.Labels = &map[string]string{MARATHON_LABEL: name}
+	for k, v := range labels {
+		(*app.Labels)[k] = v
+	}
+	return app
+}
+
+// Tests
+
+func TestSpecChecksum(t *testing.T) {
+	app, _ := appSpecOf(t, `{"id": "/web", "cmd": "python -m http.server", "instances": 1, "labels": {"b": "2", "a": "1"}}`)
+	same, _ := appSpecOf(t, `{"id": "/web", "cmd": "python -m http.server", "instances": 1, "labels": {"a": "1", "b": "2"}}`)
+	scaled, _ := appSpecOf(t, `{"id": "/web", "cmd": "python -m http.server", "instances": 2, "labels": {"a": "1", "b": "2"}}`)
+	if specChecksum(app) != specChecksum(same) {
+		t.Error("checksums of the same spec differ")
+	}
+	if specChecksum(app) == specChecksum(scaled) {
+		t.Error("checksums of different specs match")
+	}
+}
+
+func TestPlanAction(t *testing.T) {
+	app, _ := appSpecOf(t, `{"id": "/web", "cmd": "python -m http.server", "instances": 1}`)
+	checksum := specChecksum(app)
+	deployed := *app
+	deployed.Labels = &map[string]string{MARATHON_LABEL_CHECKSUM: checksum}
+	outdated := *app
+	outdated.Labels = &map[string]string{MARATHON_LABEL_CHECKSUM: "outdated"}
+	tests := []struct {
+		name    string
+		running *marathon.Application
+		want    string
+	}{
+		{"not deployed", nil, PLAN_CREATE},
+		{"deployed", &deployed, PLAN_UNCHANGED},
+		{"outdated", &outdated, PLAN_UPDATE},
+		{"deployed without dploy", &marathon.Application{ID: "/web"}, PLAN_UPDATE},
+	}
+	for _, tt := range tests {
+		if got := planAction(tt.running, checksum); got != tt.want {
+			t.Errorf("%s: planned to %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGroupApps(t *testing.T) {
+	_, group := appSpecOf(t, `{"id": "/shop", "groups": [{"id": "backend", "apps": [{"id": "db"}, {"id": "/shop/backend/cache"}]}], "apps": [{"id": "web"}]}`)
+	if group == nil {
+		t.Fatal("group spec read as app")
+	}
+	apps := map[string]*marathon.Application{}
+	groupApps(group, "", apps)
+	for _, id := range []string{"/shop/web", "/shop/backend/db", "/shop/backend/cache"} {
+		if _, ok := apps[id]; !ok {
+			t.Errorf("app %s of group missing, got %v", id, apps)
+		}
+	}
+	if len(apps) != 3 {
+		t.Errorf("got %d apps, want 3", len(apps))
+	}
+}
+
+func TestSuspendResume(t *testing.T) {
+	tests := []struct {
+		name      string
+		app       *marathon.Application
+		suspended bool
+		instances int
+		resumed   int
+	}{
+		{"running", runningApp("/shop/web", "shop", 3, nil), true, 0, 3},
+		{"already suspended", runningApp("/shop/db", "shop", 0, map[string]string{MARATHON_LABEL_SUSPENDED: "2"}), false, 0, 2},
+		{"scaled to zero", runningApp("/shop/batch", "shop", 0, nil), true, 0, 0},
+		{"other dploy app", runningApp("/blog", "blog", 1, nil), false, 1, 1},
+	}
+	apps := []*marathon.Application{}
+	for _, tt := range tests {
+		apps = append(apps, tt.app)
+	}
+	fm, marathonURL, stop := startFakeMarathon(apps...)
+	defer stop()
+
+	suspended, err := marathonSuspendApps(marathonURL, "shop")
+	if err != nil {
+		t.Fatalf("can't suspend: %v", err)
+	}
+	for _, tt := range tests {
+		found := false
+		for _, id := range suspended {
+			found = found || id == tt.app.ID
+		}
+		app := fm.app(tt.app.ID)
+		if found != tt.suspended || *app.Instances != tt.instances {
+			t.Errorf("%s: suspended %t with %d instances, want %t with %d", tt.name, found, *app.Instances, tt.suspended, tt.instances)
+		}
+		if _, labelled := (*app.Labels)[MARATHON_LABEL_SUSPENDED]; labelled != (tt.suspended || tt.name == "already suspended") {
+			t.Errorf("%s: labelled as suspended: %t", tt.name, labelled)
+		}
+	}
+
+	if _, err := marathonResumeApps(marathonURL, "shop"); err != nil {
+		t.Fatalf("can't resume: %v", err)
+	}
+	for _, tt := range tests {
+		app := fm.app(tt.app.ID)
+		if *app.Instances != tt.resumed {
+			t.Errorf("%s: resumed with %d instances, want %d", tt.name, *app.Instances, tt.resumed)
+		}
+		if _, labelled := (*app.Labels)[MARATHON_LABEL_SUSPENDED]; labelled {
+			t.Errorf("%s: still labelled as suspended after resuming", tt.name)
+		}
+		if (*app.Labels)[MARATHON_LABEL] == "" {
+			t.Errorf("%s: lost the %s label", tt.name, MARATHON_LABEL)
+		}
+	}
+}
+
+func TestRestartApp(t *testing.T) {
+	unhealthy := runningApp("/shop/db", "shop", 1, nil)
+	unhealthy.HealthChecks = &[]marathon.HealthCheck{{Protocol: "TCP"}}
+	fm, marathonURL, stop := startFakeMarathon(runningApp("/shop/web", "shop", 2, nil), unhealthy)
+	defer stop()
+	client := marathonClient(marathonURL)
+	tests := []struct {
+		appID string
+		fails bool
+	}{
+		{"/shop/web", false},
+		{"/shop/db", true}, // the tasks don't report their health checks passing
+		{"/shop/gone", true},
+	}
+	for _, tt := range tests {
+		err := marathonRestartApp(client, tt.appID)
+		if (err != nil) != tt.fails {
+			t.Errorf("restarting %s failed: %v, want failure: %t", tt.appID, err, tt.fails)
+		}
+	}
+	restarts := 0
+	for _, r := range fm.requests {
+		if strings.HasPrefix(r, "POST /v2/apps/") && strings.HasSuffix(r, "/restart") {
+			restarts++
+		}
+	}
+	if restarts != len(tests) {
+		t.Errorf("requested %d restarts, want %d", restarts, len(tests))
+	}
+}
+
+func TestAppIDOfTask(t *testing.T) {
+	tests := []struct {
+		taskID, want string
+	}{
+		{"web.5b3c0dbd-6f5a-11e8-9b2c-70b3d5800001", "/web"},
+		{"shop_backend_db.5b3c0dbd-6f5a-11e8-9b2c-70b3d5800001", "/shop/backend/db"},
+		{"shop_web.instance-5b3c0dbd-6f5a-11e8-9b2c-70b3d5800001._app.1", "/shop/web"},
+		{"nodot", ""},
+	}
+	for _, tt := range tests {
+		got, err := appIDOfTask(tt.taskID)
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("appIDOfTask(%s) = %s (%v), want %s", tt.taskID, got, err, tt.want)
+		}
+	}
+}
+
+func TestKillAndScale(t *testing.T) {
+	tests := []struct {
+		name      string
+		appID     string
+		path      string
+		query     url.Values
+		request   string
+		instances int
+	}{
+		{"task", "shop/web", "/tasks/shop_web.0", url.Values{}, "DELETE /v2/apps/shop/web/tasks/shop_web.0?scale=true", 2},
+		{"tasks on host", "/shop/db", "/tasks", url.Values{"host": {"10.0.4.2"}}, "DELETE /v2/apps/shop/db/tasks?host=10.0.4.2&scale=true", 1},
+	}
+	for _, tt := range tests {
+		fm, marathonURL, stop := startFakeMarathon(runningApp("/shop/web", "shop", 3, nil), runningApp("/shop/db", "shop", 2, nil))
+		if err := marathonKillAndScale(marathonClient(marathonURL), marathonURL, tt.appID, tt.path, tt.query); err != nil {
+			t.Errorf("%s: can't kill and scale due to %v", tt.name, err)
+		}
+		if len(fm.requests) == 0 || fm.requests[0] != tt.request {
+			t.Errorf("%s: requested %v, want %s first", tt.name, fm.requests, tt.request)
+		}
+		if instances := *fm.app("/" + strings.TrimPrefix(tt.appID, "/")).Instances; instances != tt.instances {
+			t.Errorf("%s: scaled to %d instances, want %d", tt.name, instances, tt.instances)
+		}
+		stop()
+	}
+}
+
+func TestSplitRepoURL(t *testing.T) {
+	tests := []struct {
+		repoURL, owner, repo string
+	}{
+		{"https://github.com/mhausenblas/dploy", "mhausenblas", "dploy"},
+		{"https://github.com/mhausenblas/dploy.git", "mhausenblas", "dploy"},
+		{"https://gitlab.com/group/subgroup/dploy/", "group/subgroup", "dploy"},
+		{"https://github.com/dploy", "", ""},
+		{"https://github.com/mhausenblas/", "", ""},
+	}
+	for _, tt := range tests {
+		owner, repo, err := splitRepoURL(tt.repoURL)
+		if owner != tt.owner || repo != tt.repo || (err != nil) != (tt.repo == "") {
+			t.Errorf("splitRepoURL(%s) = %s, %s (%v), want %s, %s", tt.repoURL, owner, repo, err, tt.owner, tt.repo)
+		}
+	}
+}
+
+func TestNewWatchSecrets(t *testing.T) {
+	tests := []struct {
+		name   string
+		app    DployApp
+		pat    string
+		patRef string
+	}{
+		{"token", DployApp{RepoURL: "https://github.com/mhausenblas/dploy"}, "s3cr3t", ""},
+		{"token secret", DployApp{RepoURL: "https://github.com/mhausenblas/dploy", PATSecret: "dploy/pat"}, "", "DPLOY_OBSERVER_SECRET_PAT_MHAUSENBLAS_DPLOY"},
+		{"token secret of other repo", DployApp{RepoURL: "https://gitlab.com/group/sub/shop", PATSecret: "shop/pat"}, "", "DPLOY_OBSERVER_SECRET_PAT_GROUP_SUB_SHOP"},
+	}
+	for _, tt := range tests {
+		watch, err := newWatch(tt.app, "s3cr3t", "")
+		if err != nil {
+			t.Fatalf("%s: can't set up watch: %v", tt.name, err)
+		}
+		if watch.PAT != tt.pat || watch.PATRef != tt.patRef {
+			t.Errorf("%s: watch carries token %q referenced as %q, want %q referenced as %q", tt.name, watch.PAT, watch.PATRef, tt.pat, tt.patRef)
+		}
+	}
+}
+
+func TestReadTokenFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dploy-token")
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		content string
+		perm    os.FileMode
+		want    string
+	}{
+		{"owner only", "s3cr3t\n", 0600, "s3cr3t"},
+		{"group", "  s3cr3t  ", 0640, "s3cr3t"},
+		{"anyone", "s3cr3t", 0644, ""},
+		{"anyone but the owner", "s3cr3t", 0604, ""},
+		{"empty", " \n", 0600, ""},
+	}
+	for _, tt := range tests {
+		fn := filepath.Join(dir, strings.Replace(tt.name, " ", "-", -1))
+		ioutil.WriteFile(fn, []byte(tt.content), tt.perm)
+		os.Chmod(fn, tt.perm) // regardless of the umask
+		token, err := ReadTokenFile(fn)
+		if token != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("%s: read %q (%v), want %q", tt.name, token, err, tt.want)
+		}
+	}
+	if _, err := ReadTokenFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("read token from missing file")
+	}
+}
@@ -27,6 +27,10 @@ var (
 	// command-specific arguments:
 	pid       string
 	instances int
+	host      string
+	scale     bool
+	task      string
+	via       string
 )
 
 func about() {
@@ -43,8 +47,12 @@ func init() {
 	flag.StringVar(&workspace, "w", cwd, "[GLOBAL] directory in which to operate (shorthand)")
 	flag.BoolVar(&all, "all", false, "[GLOBAL] output all available data, semantics are command dependent")
 	flag.BoolVar(&all, "a", false, "[GLOBAL] output all available data, semantics are command dependent (shorthand)")
-	flag.StringVar(&pid, "pid", "", "[SCALE] target the µS with pid")
+	flag.StringVar(&pid, "pid", "", "[SCALE|RESTART|KILL] target the µS with pid")
 	flag.IntVar(&instances, "instances", 0, "[SCALE] set the number of instances")
+	flag.StringVar(&host, "host", "", "[KILL] target the tasks of the µS with pid running on host")
+	flag.BoolVar(&scale, "scale", false, "[KILL] scale down rather than replace killed tasks")
+	flag.StringVar(&task, "task", "", "[PORT-FORWARD] target the task with this ID rather than the first one")
+	flag.StringVar(&via, "via", "", "[PORT-FORWARD] tunnel through this SSH jump host, for example core@52.37.239.156")
 
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, "Usage: dploy [args] <command>\n")
@@ -56,6 +64,15 @@ func init() {
 		fmt.Fprint(os.Stderr, "\tls\t... lists the app's resources\n")
 		fmt.Fprint(os.Stderr, "\tps\t... lists runtime properties of the app\n")
 		fmt.Fprint(os.Stderr, "\tscale\t... scales a µS in the app\n")
+		fmt.Fprint(os.Stderr, "\trestart\t... restarts a µS or all µS in the app\n")
+		fmt.Fprint(os.Stderr, "\tkill\t... kills a task, either `dploy kill <task-id>` or via -pid and -host\n")
+		fmt.Fprint(os.Stderr, "\texec\t... runs a command in a task, `dploy exec <pid> [task] -- <cmd>`\n")
+		fmt.Fprint(os.Stderr, "\tport-forward\t... forwards a local port to a task, `dploy port-forward <pid> <local>:<remote>`\n")
+		fmt.Fprint(os.Stderr, "\thistory\t... lists the deployments carried out on push\n")
+		fmt.Fprint(os.Stderr, "\tpending\t... lists the deployments awaiting approval\n")
+		fmt.Fprint(os.Stderr, "\tapprove\t... carries out a pending deployment, `dploy approve <id>`\n")
+		fmt.Fprint(os.Stderr, "\tsuspend\t... scales all µS in the app to zero\n")
+		fmt.Fprint(os.Stderr, "\tresume\t... restores all µS in the app after a suspend\n")
 		fmt.Fprint(os.Stderr, "\nValid (optional) arguments are:\n")
 		flag.PrintDefaults()
 	}
@@ -69,6 +86,17 @@ func init() {
 	}
 }
 
+// splitCommand splits the arguments at `--` into
+// the part before and the command after it.
+func splitCommand(args []string) ([]string, []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, []string{}
+}
+
 func main() {
 	about()
 	success := false
@@ -87,6 +115,28 @@ func main() {
 		success = dploy.ListRuntimeProperties(workspace, all)
 	case "scale":
 		success = dploy.Scale(workspace, all, pid, instances)
+	case "restart":
+		success = dploy.Restart(workspace, all, pid)
+	case "kill":
+		success = dploy.Kill(workspace, all, flag.Arg(1), pid, host, scale)
+	case "exec":
+		target, command := splitCommand(flag.Args()[1:])
+		target = append(target, "", "") // pid and task are optional here, Exec checks them
+		if code := dploy.Exec(workspace, all, target[0], target[1], command); code >= 0 {
+			os.Exit(code) // pass on the exit code of the command
+		}
+	case "port-forward":
+		success = dploy.PortForward(workspace, all, flag.Arg(1), task, flag.Arg(2), via)
+	case "history":
+		success = dploy.History(workspace, all)
+	case "pending":
+		success = dploy.Pending(workspace, all)
+	case "approve":
+		success = dploy.Approve(workspace, all, flag.Arg(1))
+	case "suspend":
+		success = dploy.Suspend(workspace, all)
+	case "resume":
+		success = dploy.Resume(workspace, all)
 	default:
 		fmt.Fprint(os.Stderr, flag.Args()[0], " is not a valid dploy command\n")
 		flag.Usage()
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// where to serve the API:
+	DEFAULT_LISTEN_ADDR string = ":8888"
+	// how long (in sec) to wait for requests and running deployments on shutdown;
+	// observer.json gives the observer a bit more than that before it gets killed:
+	DEFAULT_SHUTDOWN_WAIT_TIME time.Duration = 50
+)
+
+var (
+	// hex encoded SHA-256 digest of the bearer token protecting the admin endpoints
+	adminTokenDigest string
+
+	// where to serve the API (default: DEFAULT_LISTEN_ADDR)
+	listenAddr string
+
+	// certificate and key to serve the API via TLS and, optionally,
+	// the CA client certificates for the admin endpoints are checked against
+	tlsCert, tlsKey, tlsClientCA string
+)
+
+func grabAdminEnv() {
+	// dploy only passes the digest of the token, the token itself may come from a DC/OS secret:
+	adminTokenDigest = strings.ToLower(os.Getenv("DPLOY_OBSERVER_ADMIN_TOKEN_SHA256"))
+	if token := os.Getenv("DPLOY_OBSERVER_ADMIN_TOKEN"); token != "" {
+		adminTokenDigest = digest(token)
+	}
+	if la := os.Getenv("DPLOY_OBSERVER_LISTEN_ADDR"); la != "" {
+		listenAddr = la
+	}
+	tlsCert = os.Getenv("DPLOY_OBSERVER_TLS_CERT")
+	tlsKey = os.Getenv("DPLOY_OBSERVER_TLS_KEY")
+	tlsClientCA = os.Getenv("DPLOY_OBSERVER_TLS_CLIENT_CA")
+}
+
+// Returns the hex encoded SHA-256 digest of token
+func digest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Checks if the request comes with a client certificate signed by tlsClientCA or
+// the bearer token with the digest adminTokenDigest
+func isAdmin(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return adminTokenDigest != "" && token != "" && subtle.ConstantTimeCompare([]byte(digest(token)), []byte(adminTokenDigest)) == 1
+}
+
+// Wraps an admin endpoint so that it's only accessible to admins, see isAdmin. If
+// neither a client CA nor an admin token is configured, the admin endpoints are
+// disabled altogether.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isAdmin(r) {
+			h(w, r)
+			return
+		}
+		log.WithFields(log.Fields{"admin": r.URL.Path}).Info("Rejected unauthenticated request from ", r.RemoteAddr)
+		writeResult(w, http.StatusUnauthorized, "Unauthorized")
+	}
+}
+
+// Sets up TLS with the certificate and key and, if tlsClientCA is set, verifies
+// client certificates if presented; these are checked by requireAdmin
+func tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if tlsClientCA != "" {
+		ca, err := ioutil.ReadFile(tlsClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in %s", tlsClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Serves the API on listenAddr, via TLS if a certificate is configured, until
+// the observer receives SIGTERM (as sent by Marathon when killing the task) or SIGINT
+func serve() error {
+	server := &http.Server{Addr: listenAddr, Handler: mux}
+	if tlsCert != "" {
+		config, err := tlsConfig()
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = config
+	}
+	stopped := make(chan bool)
+	go shutdown(server, stopped)
+	log.WithFields(log.Fields{"serve": "start"}).Info("Serving on ", listenAddr, ", TLS ", tlsCert != "")
+	var err error
+	if tlsCert != "" {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		<-stopped
+		return nil
+	}
+	return err
+}
+
+// Waits for a signal to shut down, then stops accepting requests and waits for the
+// ones in flight as well as for running deployments to finish, up to
+// DEFAULT_SHUTDOWN_WAIT_TIME in total, and persists the state. Since Marathon also
+// stops the observer on restarts and upgrades, the Webhooks are kept so that the
+// restarted observer picks up where this one left off; `dploy destroy` removes them.
+func shutdown(server *http.Server, stopped chan bool) {
+	defer close(stopped)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.WithFields(log.Fields{"serve": "shutdown"}).Info("Shutting down due to ", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_SHUTDOWN_WAIT_TIME*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithFields(log.Fields{"serve": "shutdown"}).Error("Can't wait for requests to finish due to ", err)
+	}
+	for deploying() && ctx.Err() == nil {
+		time.Sleep(time.Second)
+	}
+	if deploying() {
+		log.WithFields(log.Fields{"serve": "shutdown"}).Error("Gave up waiting for running deployments to finish")
+	}
+	saveState()
+}
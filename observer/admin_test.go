@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Helpers
+
+// issues a certificate for name, signed by the parent (self-signed if nil), and
+// writes it as well as its key PEM encoded into dir as name.pem and name-key.pem
+func issueCert(t *testing.T, dir string, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600)
+	cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return cert
+}
+
+// Tests
+
+func TestRequireAdmin(t *testing.T) {
+	defer func(d string) { adminTokenDigest = d }(adminTokenDigest)
+	tests := []struct {
+		name     string
+		digest   string
+		header   string
+		verified bool
+		status   int
+	}{
+		{"token", digest("s3cr3t"), "Bearer s3cr3t", false, http.StatusOK},
+		{"wrong token", digest("s3cr3t"), "Bearer guess", false, http.StatusUnauthorized},
+		{"no token", digest("s3cr3t"), "", false, http.StatusUnauthorized},
+		{"empty bearer", digest(""), "Bearer ", false, http.StatusUnauthorized},
+		{"token without admin token configured", "", "Bearer s3cr3t", false, http.StatusUnauthorized},
+		{"client certificate", "", "", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		adminTokenDigest = tt.digest
+		r := httptest.NewRequest("POST", "/watches", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if tt.verified {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}
+		}
+		rec := httptest.NewRecorder()
+		requireAdmin(func(w http.ResponseWriter, r *http.Request) { writeResult(w, http.StatusOK, "OK") })(rec, r)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestRequireAdminClientCertificate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dploy-tls")
+	defer os.RemoveAll(dir)
+	ca := issueCert(t, dir, "ca", nil)
+	issueCert(t, dir, "observer", &ca)
+	admin := issueCert(t, dir, "admin", &ca)
+	stranger := issueCert(t, dir, "stranger", nil)
+	defer func(cert, key, ca, d string) { tlsCert, tlsKey, tlsClientCA, adminTokenDigest = cert, key, ca, d }(tlsCert, tlsKey, tlsClientCA, adminTokenDigest)
+	tlsCert, tlsKey, tlsClientCA = filepath.Join(dir, "observer.pem"), filepath.Join(dir, "observer-key.pem"), filepath.Join(dir, "ca.pem")
+	adminTokenDigest = ""
+	config, err := tlsConfig()
+	if err != nil {
+		t.Fatalf("can't set up TLS: %v", err)
+	}
+	server := httptest.NewUnstartedServer(requireAdmin(func(w http.ResponseWriter, r *http.Request) { writeResult(w, http.StatusOK, "OK") }))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	tests := []struct {
+		name   string
+		certs  []tls.Certificate
+		status int
+	}{
+		{"admin", []tls.Certificate{admin}, http.StatusOK},
+		{"no client certificate", nil, http.StatusUnauthorized},
+		{"client certificate of another CA", []tls.Certificate{stranger}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: tt.certs}}}
+		resp, err := client.Get(server.URL + "/pending")
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+			resp.Body.Close()
+		}
+		if status != tt.status {
+			t.Errorf("%s: status %d (%v), want %d", tt.name, status, err, tt.status)
+		}
+	}
+}
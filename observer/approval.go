@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// how long (in sec) a staged deployment can be approved:
+	DEFAULT_APPROVAL_EXPIRY time.Duration = 86400
+)
+
+var (
+	// deployments awaiting approval, by app; guarded by jobMutex
+	staged map[string]*Job
+)
+
+func init() {
+	staged = make(map[string]*Job)
+}
+
+func grabApprovalEnv() {
+	envWatch.Approval, _ = strconv.ParseBool(os.Getenv("DPLOY_OBSERVER_APPROVAL"))
+	if ae := os.Getenv("DPLOY_OBSERVER_APPROVAL_EXPIRY"); ae != "" {
+		e, _ := strconv.ParseUint(ae, 10, 64)
+		envWatch.ApprovalExpiry = int(e)
+	}
+}
+
+// Checks if the job has to be approved before it's carried out. Previews,
+// teardowns and rollbacks don't go live, or restore what was live, so they don't.
+// Expects the caller to hold jobMutex.
+func needsApproval(w *watch, job *Job) bool {
+	return w.Approval && !job.Approved && job.PullRequest == 0 && !job.Rollback
+}
+
+// Pulls the job's commit and plans its deployment rather than carrying it out,
+// then keeps it around until it's approved, superseded by a newer one or expires
+func stage(w *watch, job *Job) {
+	jobMutex.Lock()
+	if previous := staged[job.App]; previous != nil { // the plan has to cover what the previous one would have deployed
+		job.Workspaces = mergeWorkspaces(previous.Workspaces, job.Workspaces)
+	}
+	commit, workspaces := job.Commit, job.Workspaces
+	jobMutex.Unlock()
+
+	log.WithFields(log.Fields{"approval": "stage"}).Info("Staging job ", job.ID, " planning deployment of ", commit)
+	plan, err := deploy(w, commit, workspaces, dploy.PlanApps)
+
+	jobMutex.Lock()
+	if err != nil {
+		job.State = JOB_FAILED
+		job.Msg = err.Error()
+		job.Finished = time.Now()
+		failed := *job
+		jobMutex.Unlock()
+		record(failed)
+		observeJob(failed)
+		reportFinished(w, failed, 0)
+		notify(w, EVENT_FAILED, failed)
+		log.WithFields(log.Fields{"approval": "stage"}).Error("Can't stage job ", job.ID, " due to ", err)
+		return
+	}
+	var superseded *Job
+	if previous := staged[job.App]; previous != nil {
+		log.WithFields(log.Fields{"approval": "stage"}).Info("Staged job ", previous.ID, " superseded by ", job.ID)
+		previous.State = JOB_SUPERSEDED
+		previous.SupersededBy = job.ID
+		previous.Finished = time.Now()
+		s := *previous
+		superseded = &s
+	}
+	job.State = JOB_STAGED
+	job.Plan = plan
+	job.Expires = time.Now().Add(time.Duration(w.ApprovalExpiry) * time.Second)
+	job.Msg = fmt.Sprintf("Awaiting approval until %s", job.Expires.Format(time.RFC3339))
+	staged[job.App] = job
+	persist()
+	s := *job
+	jobMutex.Unlock()
+	if superseded != nil {
+		finishStaged(w, *superseded)
+	}
+	reportStaged(w, s)
+	notify(w, EVENT_STAGED, s)
+	log.WithFields(log.Fields{"approval": "stage"}).Info("Job ", job.ID, " awaiting approval")
+}
+
+// Queues the staged job with the ID for deployment, unless it expired
+func approve(id string) (Job, error) {
+	jobMutex.Lock()
+	var job *Job
+	for _, j := range staged {
+		if j.ID == id {
+			job = j
+		}
+	}
+	if job == nil {
+		jobMutex.Unlock()
+		return Job{}, fmt.Errorf("No deployment %s awaiting approval", id)
+	}
+	w, watched := lookupWatch(job.Repo)
+	if !watched {
+		jobMutex.Unlock()
+		return *job, fmt.Errorf("No longer watching %s", job.Repo)
+	}
+	delete(staged, job.App)
+	persist()
+	if time.Now().After(job.Expires) {
+		expire(job)
+		expired := *job
+		jobMutex.Unlock()
+		finishStaged(w, expired)
+		return expired, fmt.Errorf("Approval of deployment %s expired at %s", id, job.Expires.Format(time.RFC3339))
+	}
+	job.Approved = true
+	job.State = JOB_QUEUED
+	job.Msg = ""
+	superseded := schedule(job.App, job)
+	approved := *job
+	jobMutex.Unlock()
+	if superseded != nil {
+		reportSuperseded(w, *superseded)
+	}
+	reportQueued(w, approved)
+	log.WithFields(log.Fields{"approval": "approve"}).Info("Job ", id, " approved")
+	return approved, nil
+}
+
+// Returns the jobs awaiting approval, of all repos or only of the repo OWNER/REPO,
+// oldest first, and expires the stale ones
+func pendingPlans(repo string) []Job {
+	jobMutex.Lock()
+	pending, expired := []Job{}, []Job{}
+	for app, job := range staged {
+		if time.Now().After(job.Expires) {
+			delete(staged, app)
+			persist()
+			expire(job)
+			expired = append(expired, *job)
+			continue
+		}
+		if repo == "" || job.Repo == repo {
+			pending = append(pending, *job)
+		}
+	}
+	jobMutex.Unlock()
+	for _, job := range expired {
+		w, _ := lookupWatch(job.Repo)
+		finishStaged(w, job)
+	}
+	sort.Sort(byQueued(pending))
+	return pending
+}
+
+// Marks a staged job as expired. Expects the caller to hold jobMutex.
+func expire(job *Job) {
+	log.WithFields(log.Fields{"approval": "expire"}).Info("Approval of job ", job.ID, " expired")
+	job.State = JOB_EXPIRED
+	job.Msg = fmt.Sprintf("Not approved before %s", job.Expires.Format(time.RFC3339))
+	job.Finished = time.Now()
+}
+
+// Records a staged job that's done without having been deployed, since it expired
+// or has been superseded, and lets the watch know, unless it has been removed
+func finishStaged(w *watch, job Job) {
+	record(job)
+	observeJob(job)
+	if w == nil {
+		return
+	}
+	if job.State == JOB_EXPIRED {
+		reportExpired(w, job)
+		notify(w, EVENT_EXPIRED, job)
+		return
+	}
+	reportSuperseded(w, job)
+	notify(w, EVENT_SUPERSEDED, job)
+}
+
+// byQueued sorts jobs by the time they have been queued, oldest first
+type byQueued []Job
+
+func (b byQueued) Len() int           { return len(b) }
+func (b byQueued) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byQueued) Less(i, j int) bool { return b[i].Queued.Before(b[j].Queued) }
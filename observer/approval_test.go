@@ -0,0 +1,118 @@
+package main
+
+import (
+	dploy "github.com/mhausenblas/dploy/lib"
+	"testing"
+	"time"
+)
+
+// Tests
+
+func TestPendingPlansExpires(t *testing.T) {
+	defer tempHistory()()
+	resetJobs()
+	defer resetJobs()
+	tests := []struct {
+		job     Job
+		pending bool
+	}{
+		{Job{ID: "fresh", Repo: "mhausenblas/fresh", App: "mhausenblas/fresh", State: JOB_STAGED, Expires: time.Now().Add(time.Hour)}, true},
+		{Job{ID: "stale", Repo: "mhausenblas/stale", App: "mhausenblas/stale", State: JOB_STAGED, Expires: time.Now().Add(-time.Minute)}, false},
+	}
+	staged = make(map[string]*Job)
+	defer func() { staged = make(map[string]*Job) }()
+	for _, tt := range tests {
+		job := tt.job
+		staged[job.App] = &job
+	}
+	pending := pendingPlans("")
+	for _, tt := range tests {
+		found := false
+		for _, job := range pending {
+			found = found || job.ID == tt.job.ID
+		}
+		if found != tt.pending {
+			t.Errorf("job %s pending: %t, want %t", tt.job.ID, found, tt.pending)
+		}
+		recorded := historySnapshot(tt.job.Repo)
+		if tt.pending && len(recorded) != 0 {
+			t.Errorf("pending job %s recorded in the history", tt.job.ID)
+		}
+		if !tt.pending && (len(recorded) != 1 || recorded[0].State != JOB_EXPIRED || recorded[0].Finished.IsZero()) {
+			t.Errorf("expired job %s not recorded in the history as expired: %+v", tt.job.ID, recorded)
+		}
+	}
+}
+
+func TestNeedsApproval(t *testing.T) {
+	tests := []struct {
+		name     string
+		approval bool
+		job      Job
+		want     bool
+	}{
+		{"push", true, Job{}, true},
+		{"push without approval", false, Job{}, false},
+		{"approved", true, Job{Approved: true}, false},
+		{"preview", true, Job{PullRequest: 42}, false},
+		{"rollback", true, Job{Rollback: true}, false},
+	}
+	for _, tt := range tests {
+		w := &watch{Watch: dploy.Watch{Approval: tt.approval}}
+		if got := needsApproval(w, &tt.job); got != tt.want {
+			t.Errorf("%s: needs approval %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApprove(t *testing.T) {
+	defer tempHistory()()
+	resetJobs()
+	defer resetJobs()
+	w := &watch{Watch: dploy.Watch{Owner: "mhausenblas", Repo: "approve", Approval: true}}
+	watchMutex.Lock()
+	watches[w.name()] = w
+	watchMutex.Unlock()
+	defer func() {
+		watchMutex.Lock()
+		delete(watches, w.name())
+		watchMutex.Unlock()
+	}()
+	staged = make(map[string]*Job)
+	defer func() { staged = make(map[string]*Job) }()
+	tests := []struct {
+		name  string
+		job   *Job
+		id    string
+		state string
+		fails bool
+	}{
+		{"fresh", &Job{ID: "fresh", Repo: w.name(), App: "fresh", State: JOB_STAGED, Expires: time.Now().Add(time.Hour)}, "fresh", JOB_QUEUED, false},
+		{"expired", &Job{ID: "stale", Repo: w.name(), App: "stale", State: JOB_STAGED, Expires: time.Now().Add(-time.Minute)}, "stale", JOB_EXPIRED, true},
+		{"unknown", nil, "unknown", "", true},
+		{"approved twice", nil, "fresh", "", true},
+	}
+	for _, tt := range tests {
+		jobMutex.Lock()
+		if tt.job != nil {
+			staged[tt.job.App] = tt.job
+			queues[tt.job.App] = &appQueue{running: true} // a deployment is in progress, so nothing gets picked up
+		}
+		jobMutex.Unlock()
+		job, err := approve(tt.id)
+		if (err != nil) != tt.fails || job.State != tt.state {
+			t.Errorf("%s: approved as %s (%v), want %s", tt.name, job.State, err, tt.state)
+		}
+	}
+	if recorded := historySnapshot(w.name()); len(recorded) != 1 || recorded[0].ID != "stale" || recorded[0].State != JOB_EXPIRED {
+		t.Errorf("history is %+v, want the expired job", recorded)
+	}
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	if q := queues["fresh"]; q.pending == nil || !q.pending.Approved {
+		t.Error("approved job not queued")
+	}
+	if len(staged) != 0 {
+		t.Errorf("still awaiting approval: %v", staged)
+	}
+}
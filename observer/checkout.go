@@ -0,0 +1,213 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// where, relative to the working directory, to extract the repo content for deployments:
+	DEFAULT_CHECKOUT_DIR string = "checkouts"
+	// how many checkouts to keep around, including the ones in use:
+	DEFAULT_CHECKOUT_RETENTION int = 3
+)
+
+var (
+	// checkouts deployments are using, along with the number of deployments using
+	// them, which cleanupCheckouts leaves alone; guarded by jobMutex
+	checkoutsInUse map[string]int
+)
+
+func init() {
+	checkoutsInUse = make(map[string]int)
+}
+
+// Pulls the content of the watched repo at ref (typically a commit SHA) from the
+// SCM provider, extracts it into a fresh directory in workdir and returns the
+// directory containing the repo content as well as the checkout itself, which
+// the caller has to hand back via releaseCheckout once done with it. Older
+// checkouts of the repo not in use anymore are removed. The content is downloaded
+// as archive via the API of the SCM provider, authenticated like all other calls,
+// rather than cloned, since the observer image doesn't ship a git binary.
+func pull(w *watch, ref, workdir string) (string, string, error) {
+	start := time.Now()
+	root, checkout, err := fetchCheckout(w, ref, workdir)
+	if err != nil {
+		pullsTotal.WithLabelValues("failure").Inc()
+		return "", "", err
+	}
+	pullsTotal.WithLabelValues("success").Inc()
+	pullDuration.Observe(time.Since(start).Seconds())
+	return root, checkout, nil
+}
+
+func fetchCheckout(w *watch, ref, workdir string) (string, string, error) {
+	if w.Owner == "" || w.Repo == "" {
+		return "", "", fmt.Errorf("Don't know where to pull from since no owner or repo set")
+	}
+	cd, _ := filepath.Abs(filepath.Join(workdir, DEFAULT_CHECKOUT_DIR, w.Owner, w.Repo))
+	if err := os.MkdirAll(cd, 0755); err != nil {
+		return "", "", err
+	}
+	td, err := acquireCheckout(cd, w.Repo+"-"+ref+"-")
+	if err != nil {
+		return "", "", err
+	}
+	// each deployment downloads into an archive of its own, outside of the checkouts:
+	af, err := ioutil.TempFile("", "dploy-"+w.Repo+"-"+ref+"-")
+	if err != nil {
+		releaseCheckout(td)
+		os.RemoveAll(td)
+		return "", "", err
+	}
+	archive := af.Name()
+	af.Close()
+	defer os.Remove(archive)
+	if err := w.scm.Download(ref, archive); err != nil {
+		log.WithFields(log.Fields{"observer": "pull"}).Error("Failed to download repo content due to ", err)
+		releaseCheckout(td)
+		os.RemoveAll(td)
+		return "", "", fmt.Errorf("Failed to download repo content due to %s", err)
+	}
+	log.WithFields(log.Fields{"observe": "pull"}).Debug("Downloaded ", ref, " from ", w.scm.Name(), " into ", archive)
+	root, err := unzip(archive, td)
+	if err != nil {
+		releaseCheckout(td)
+		os.RemoveAll(td)
+		return "", "", err
+	}
+	log.WithFields(log.Fields{"observe": "pull"}).Debug("Extracted ", archive, " into ", root)
+	cleanupCheckouts(cd)
+	return root, td, nil
+}
+
+// Creates a fresh checkout in dir and marks it as in use; both happen while holding
+// jobMutex so that cleanupCheckouts never sees the checkout before it's marked
+func acquireCheckout(dir string, prefix string) (string, error) {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	td, err := ioutil.TempDir(dir, prefix)
+	if err != nil {
+		return "", err
+	}
+	checkoutsInUse[td]++
+	return td, nil
+}
+
+// Marks the checkout as no longer in use by the caller, so it can be cleaned up
+func releaseCheckout(checkout string) {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	if checkoutsInUse[checkout]--; checkoutsInUse[checkout] <= 0 {
+		delete(checkoutsInUse, checkout)
+	}
+}
+
+// byModTime sorts files most recently modified first
+type byModTime []os.FileInfo
+
+func (b byModTime) Len() int           { return len(b) }
+func (b byModTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byModTime) Less(i, j int) bool { return b[i].ModTime().After(b[j].ModTime()) }
+
+// Removes all but the DEFAULT_CHECKOUT_RETENTION most recent checkouts in dir, never
+// touching checkouts in use. Since checkouts are never reused, one that isn't in use
+// when listed won't be used anymore, so it's safe to remove it after releasing jobMutex.
+func cleanupCheckouts(dir string) {
+	jobMutex.Lock()
+	checkouts, err := ioutil.ReadDir(dir)
+	if err != nil {
+		jobMutex.Unlock()
+		log.WithFields(log.Fields{"observe": "cleanup"}).Error("Can't list checkouts due to ", err)
+		return
+	}
+	sort.Sort(byModTime(checkouts))
+	kept := 0
+	old := []string{}
+	for _, c := range checkouts {
+		cp := filepath.Join(dir, c.Name())
+		if checkoutsInUse[cp] > 0 {
+			kept++
+			continue
+		}
+		if c.IsDir() && kept < DEFAULT_CHECKOUT_RETENTION {
+			kept++
+			continue
+		}
+		old = append(old, cp)
+	}
+	jobMutex.Unlock()
+	for _, cp := range old {
+		log.WithFields(log.Fields{"observe": "cleanup"}).Debug("Removing old checkout ", cp)
+		os.RemoveAll(cp)
+	}
+}
+
+// Extracts the zip archive src into dest and returns the top-level directory
+// of the archive, since its name differs between SCM providers. Entries that
+// would end up outside of dest as well as symlinks are refused.
+// Originally from http://stackoverflow.com/questions/20357223/easy-way-to-unzip-file-with-golang
+func unzip(src, dest string) (string, error) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	dest, _ = filepath.Abs(dest)
+	tops := map[string]bool{}
+	for _, f := range r.File {
+		fpath := filepath.Join(dest, f.Name)
+		if !strings.HasPrefix(fpath, dest+string(os.PathSeparator)) {
+			return "", fmt.Errorf("Refusing to extract %s since it's outside of %s", f.Name, dest)
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("Refusing to extract symlink %s", f.Name)
+		}
+		tops[strings.SplitN(filepath.ToSlash(f.Name), "/", 2)[0]] = true
+		log.WithFields(log.Fields{"observe": "unzip"}).Debug("Extracting ", fpath)
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(fpath, 0755); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err := extract(f, fpath); err != nil {
+			return "", err
+		}
+	}
+	if len(tops) == 1 {
+		for top := range tops {
+			if fi, err := os.Stat(filepath.Join(dest, top)); err == nil && fi.IsDir() {
+				return filepath.Join(dest, top), nil
+			}
+		}
+	}
+	return dest, nil
+}
+
+// Extracts a single file of a zip archive to fpath
+func extract(f *zip.File, fpath string) error {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	out, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, rc)
+	return err
+}
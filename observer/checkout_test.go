@@ -0,0 +1,82 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Helpers
+
+// writes a zip archive containing the files, by name, into dir
+func writeZip(t *testing.T, dir string, files map[string]string, symlinks map[string]string) string {
+	archive := filepath.Join(dir, "archive.zip")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	for name, target := range symlinks {
+		fh := &zip.FileHeader{Name: name}
+		fh.SetMode(os.ModeSymlink | 0777)
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(target))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+// Tests
+
+func TestUnzip(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dploy-unzip")
+	defer os.RemoveAll(dir)
+	archive := writeZip(t, dir, map[string]string{"dploy-abc123/dploy.app": "app_name: test", "dploy-abc123/specs/app.json": "{}"}, nil)
+	dest := filepath.Join(dir, "checkout")
+	root, err := unzip(archive, dest)
+	if err != nil {
+		t.Fatalf("can't extract archive: %v", err)
+	}
+	if want := filepath.Join(dest, "dploy-abc123"); root != want {
+		t.Errorf("root is %s, want %s", root, want)
+	}
+	if c, err := ioutil.ReadFile(filepath.Join(root, "dploy.app")); err != nil || string(c) != "app_name: test" {
+		t.Errorf("app descriptor not extracted: %v", err)
+	}
+}
+
+func TestUnzipRefusesTraversal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dploy-unzip")
+	defer os.RemoveAll(dir)
+	archive := writeZip(t, dir, map[string]string{"../escaped": "gotcha"}, nil)
+	if _, err := unzip(archive, filepath.Join(dir, "checkout")); err == nil {
+		t.Error("extracted file outside of the destination")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); err == nil {
+		t.Error("file outside of the destination written")
+	}
+}
+
+func TestUnzipRefusesSymlinks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dploy-unzip")
+	defer os.RemoveAll(dir)
+	archive := writeZip(t, dir, nil, map[string]string{"dploy-abc123/passwd": "/etc/passwd"})
+	if _, err := unzip(archive, filepath.Join(dir, "checkout")); err == nil {
+		t.Error("extracted symlink")
+	}
+}
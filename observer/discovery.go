@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the sources the observer can discover Marathon from:
+	DISCOVERY_ENV          string = "env"
+	DISCOVERY_MESOS_DNS    string = "mesos-dns"
+	DISCOVERY_SRV          string = "srv"
+	DISCOVERY_ADMIN_ROUTER string = "admin-router"
+	// the order in which the sources are tried unless set via DPLOY_OBSERVER_DISCOVERY:
+	DEFAULT_DISCOVERY string = "env,mesos-dns,srv,admin-router"
+	// where the HTTP API of Mesos-DNS is served:
+	DEFAULT_MESOS_DNS string = "http://leader.mesos:8123"
+	// the SRV record Marathon is announced with:
+	DEFAULT_MARATHON_SRV string = "_marathon._tcp.marathon.mesos"
+	// the DC/OS admin router, which proxies Marathon at /marathon:
+	DEFAULT_ADMIN_ROUTER string = "http://leader.mesos"
+	// the port Marathon serves its API on, if the source doesn't tell:
+	DEFAULT_MARATHON_PORT string = "8080"
+	// the SRV record the observer itself is announced with by Mesos-DNS:
+	OBSERVER_SRV string = "_dploy-observer._tcp.marathon.mesos"
+	// how often to try each source and how long to wait (in sec) before the next try:
+	DISCOVERY_ATTEMPTS int           = 3
+	DISCOVERY_BACKOFF  time.Duration = 2
+	// how long to wait (in sec) for a source or Marathon to respond:
+	DISCOVERY_TIMEOUT time.Duration = 5
+	// how long (in sec) the Marathon discovered last is used without checking if it still responds:
+	DISCOVERY_PING_INTERVAL time.Duration = 30
+)
+
+// MarathonSource looks up where the Marathon API can be reached
+type MarathonSource interface {
+	// the name of the source, one of the DISCOVERY_* constants
+	Name() string
+	// the base URL of the Marathon API, for example http://10.0.4.2:8080
+	Marathon() (string, error)
+}
+
+type SRVRecord struct {
+	Service string
+	Host    string
+	IP      string
+	Port    string
+}
+
+type HostRecord struct {
+	Host string
+	IP   string
+}
+
+// discovery is a rediscovery of Marathon in progress, which concurrent callers wait for
+type discovery struct {
+	done     chan struct{}
+	location string
+	err      error
+}
+
+var (
+	// the sources to discover Marathon from, in the order they're tried
+	marathonSources []MarathonSource
+
+	// the Mesos-DNS HTTP API used for discovery
+	mesosDNS string
+
+	// the HTTP client used for discovery, which doesn't wait forever
+	discoveryClient *http.Client
+
+	// the Marathon last discovered, when it last responded, the rediscovery in progress,
+	// if any, and where the observer itself is reachable; guarded by discoveryMutex
+	discoveredMarathon string
+	marathonResponded  time.Time
+	rediscovery        *discovery
+	discoveredSelf     string
+	discoveryMutex     sync.Mutex
+)
+
+func init() {
+	discoveryClient = &http.Client{Timeout: DISCOVERY_TIMEOUT * time.Second}
+}
+
+// Sets up the sources to discover Marathon from, as listed in DPLOY_OBSERVER_DISCOVERY
+func grabDiscoveryEnv() {
+	mesosDNS = os.Getenv("DPLOY_OBSERVER_MESOS_DNS")
+	if mesosDNS == "" {
+		mesosDNS = DEFAULT_MESOS_DNS
+	}
+	srv := os.Getenv("DPLOY_OBSERVER_MARATHON_SRV")
+	if srv == "" {
+		srv = DEFAULT_MARATHON_SRV
+	}
+	adminRouter := os.Getenv("DPLOY_OBSERVER_ADMIN_ROUTER")
+	if adminRouter == "" {
+		adminRouter = DEFAULT_ADMIN_ROUTER
+	}
+	order := os.Getenv("DPLOY_OBSERVER_DISCOVERY")
+	if order == "" {
+		order = DEFAULT_DISCOVERY
+	}
+	marathonSources = []MarathonSource{}
+	for _, name := range strings.Split(order, ",") {
+		switch strings.TrimSpace(name) {
+		case DISCOVERY_ENV:
+			marathonSources = append(marathonSources, &envSource{location: os.Getenv("DPLOY_OBSERVER_MARATHON_URL")})
+		case DISCOVERY_MESOS_DNS:
+			marathonSources = append(marathonSources, &mesosDNSSource{api: mesosDNS})
+		case DISCOVERY_SRV:
+			marathonSources = append(marathonSources, &srvSource{record: srv})
+		case DISCOVERY_ADMIN_ROUTER:
+			marathonSources = append(marathonSources, &adminRouterSource{base: strings.TrimSuffix(adminRouter, "/")})
+		default:
+			log.WithFields(log.Fields{"sd": "config"}).Error("Ignoring unknown discovery source ", name)
+		}
+	}
+}
+
+// Returns the base URL of the Marathon API. The Marathon discovered last is used
+// as long as it responds, which is checked at most every DISCOVERY_PING_INTERVAL,
+// otherwise it's discovered again, see discoverMarathon.
+func marathonURL() (string, error) {
+	discoveryMutex.Lock()
+	loc, responded := discoveredMarathon, marathonResponded
+	discoveryMutex.Unlock()
+	if loc != "" {
+		if time.Since(responded) < DISCOVERY_PING_INTERVAL*time.Second {
+			return loc, nil
+		}
+		err := pingMarathon(loc)
+		discoveryMutex.Lock()
+		if discoveredMarathon == loc { // unless it has been discovered again meanwhile
+			if err == nil {
+				marathonResponded = time.Now()
+			} else {
+				discoveredMarathon = ""
+			}
+		}
+		discoveryMutex.Unlock()
+		if err == nil {
+			return loc, nil
+		}
+		marathonErrorsTotal.WithLabelValues(MARATHON_OP_PING).Inc()
+		log.WithFields(log.Fields{"sd": "marathon"}).Info("Marathon at ", loc, " doesn't respond anymore, discovering it again")
+	}
+	return rediscoverMarathon()
+}
+
+// Discovers Marathon again, unless that's in progress already, in which case
+// the outcome of the rediscovery in progress is returned
+func rediscoverMarathon() (string, error) {
+	discoveryMutex.Lock()
+	if d := rediscovery; d != nil {
+		discoveryMutex.Unlock()
+		<-d.done
+		return d.location, d.err
+	}
+	d := &discovery{done: make(chan struct{})}
+	rediscovery = d
+	discoveryMutex.Unlock()
+	d.location, d.err = discoverMarathon()
+	if d.err != nil {
+		marathonErrorsTotal.WithLabelValues(MARATHON_OP_DISCOVERY).Inc()
+	}
+	discoveryMutex.Lock()
+	if d.err == nil {
+		discoveredMarathon, marathonResponded = d.location, time.Now()
+	}
+	rediscovery = nil
+	discoveryMutex.Unlock()
+	close(d.done)
+	return d.location, d.err
+}
+
+// Tries the sources in order, each up to DISCOVERY_ATTEMPTS times,
+// until one yields a Marathon that responds
+func discoverMarathon() (string, error) {
+	if len(marathonSources) == 0 {
+		return "", fmt.Errorf("Can't discover Marathon since no discovery source is configured")
+	}
+	failures := []string{}
+	for _, source := range marathonSources {
+		loc, err := discoverFrom(source)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", source.Name(), err))
+			continue
+		}
+		log.WithFields(log.Fields{"sd": "done"}).Info("Found Marathon at ", loc, " via ", source.Name())
+		return loc, nil
+	}
+	return "", fmt.Errorf("Can't discover Marathon (%s)", strings.Join(failures, "; "))
+}
+
+// Tries to discover a responding Marathon from the source, backing off between attempts
+func discoverFrom(source MarathonSource) (string, error) {
+	var err error
+	for attempt := 1; attempt <= DISCOVERY_ATTEMPTS; attempt++ {
+		var loc string
+		loc, err = source.Marathon()
+		if err == nil {
+			if err = pingMarathon(loc); err == nil {
+				return loc, nil
+			}
+		}
+		if _, unconfigured := err.(unconfiguredError); unconfigured {
+			return "", err
+		}
+		log.WithFields(log.Fields{"sd": "step"}).Debug("Attempt ", attempt, " to discover Marathon via ", source.Name(), " failed due to ", err)
+		if attempt < DISCOVERY_ATTEMPTS {
+			time.Sleep(time.Duration(attempt) * DISCOVERY_BACKOFF * time.Second)
+		}
+	}
+	return "", err
+}
+
+// Checks if the Marathon API at loc responds
+func pingMarathon(loc string) error {
+	resp, err := discoveryClient.Get(loc + "/ping")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Marathon at %s responded with %s", loc, resp.Status)
+	}
+	return nil
+}
+
+// unconfiguredError tells that a source isn't set up, so trying again is pointless
+type unconfiguredError string
+
+func (e unconfiguredError) Error() string {
+	return string(e)
+}
+
+// envSource is a fixed Marathon URL, set via DPLOY_OBSERVER_MARATHON_URL
+type envSource struct {
+	location string
+}
+
+func (s *envSource) Name() string {
+	return DISCOVERY_ENV
+}
+
+func (s *envSource) Marathon() (string, error) {
+	if s.location == "" {
+		return "", unconfiguredError("DPLOY_OBSERVER_MARATHON_URL not set")
+	}
+	u, err := url.Parse(s.location)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", unconfiguredError(fmt.Sprintf("DPLOY_OBSERVER_MARATHON_URL %s is not a valid URL", s.location))
+	}
+	return strings.TrimSuffix(s.location, "/"), nil
+}
+
+// mesosDNSSource looks up the leading Marathon via the HTTP API of Mesos-DNS
+type mesosDNSSource struct {
+	api string
+}
+
+func (s *mesosDNSSource) Name() string {
+	return DISCOVERY_MESOS_DNS
+}
+
+func (s *mesosDNSSource) Marathon() (string, error) {
+	var hrecords []HostRecord
+	if err := queryMesosDNS(s.api+"/v1/hosts/marathon.mesos.", &hrecords); err != nil {
+		return "", err
+	}
+	for _, hr := range hrecords {
+		if hr.IP != "" {
+			return "http://" + net.JoinHostPort(hr.IP, DEFAULT_MARATHON_PORT), nil
+		}
+	}
+	return "", fmt.Errorf("Mesos-DNS has no host record of Marathon")
+}
+
+// srvSource looks up Marathon via a DNS SRV record
+type srvSource struct {
+	record string
+}
+
+func (s *srvSource) Name() string {
+	return DISCOVERY_SRV
+}
+
+func (s *srvSource) Marathon() (string, error) {
+	_, addrs, err := net.LookupSRV("", "", s.record)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if addr.Target != "" && addr.Port != 0 {
+			return "http://" + net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), strconv.Itoa(int(addr.Port))), nil
+		}
+	}
+	return "", fmt.Errorf("No usable SRV record %s", s.record)
+}
+
+// adminRouterSource reaches Marathon through the DC/OS admin router
+type adminRouterSource struct {
+	base string
+}
+
+func (s *adminRouterSource) Name() string {
+	return DISCOVERY_ADMIN_ROUTER
+}
+
+func (s *adminRouterSource) Marathon() (string, error) {
+	return s.base + "/marathon", nil
+}
+
+// Queries the HTTP API of Mesos-DNS at lookup and decodes the records found into v
+func queryMesosDNS(lookup string, v interface{}) error {
+	log.WithFields(log.Fields{"sd": "step"}).Debug("Trying to query HTTP API of Mesos-DNS at ", lookup)
+	resp, err := discoveryClient.Get(lookup)
+	if err != nil {
+		return fmt.Errorf("Can't query Mesos-DNS due to %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Mesos-DNS responded with %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("Can't decode response of Mesos-DNS due to %v", err)
+	}
+	return nil
+}
+
+// Returns the base URL under which the observer is reachable from the outside,
+// that is, on the public node at the host port Marathon assigned to it. The port
+// is taken from PORT0, as set by Marathon, or else looked up via Mesos-DNS or SRV.
+// The lookups happen without holding discoveryMutex so they don't hold up discovering Marathon.
+func whereAmI() (string, error) {
+	discoveryMutex.Lock()
+	self := discoveredSelf
+	discoveryMutex.Unlock()
+	if self != "" {
+		return self, nil
+	}
+	host := pubnode
+	if host == "" {
+		host = os.Getenv("HOST")
+	}
+	if host == "" {
+		marathonErrorsTotal.WithLabelValues(MARATHON_OP_SELF_DISCOVERY).Inc()
+		return "", fmt.Errorf("Don't know where I am since neither DPLOY_PUBLIC_NODE nor HOST is set")
+	}
+	port, err := myPort()
+	if err != nil {
+		marathonErrorsTotal.WithLabelValues(MARATHON_OP_SELF_DISCOVERY).Inc()
+		return "", err
+	}
+	scheme := "http://"
+	if tlsCert != "" {
+		scheme = "https://"
+	}
+	self = scheme + net.JoinHostPort(host, port)
+	discoveryMutex.Lock()
+	discoveredSelf = self
+	discoveryMutex.Unlock()
+	log.WithFields(log.Fields{"sd": "done"}).Debug("Found myself at ", self)
+	return self, nil
+}
+
+// Returns the host port the observer is reachable at
+func myPort() (string, error) {
+	if port := os.Getenv("PORT0"); port != "" {
+		return port, nil
+	}
+	var srvrecords []SRVRecord
+	err := queryMesosDNS(mesosDNS+"/v1/services/"+OBSERVER_SRV+".", &srvrecords)
+	if err == nil {
+		for _, sr := range srvrecords {
+			if sr.Port != "" {
+				return sr.Port, nil
+			}
+		}
+		err = fmt.Errorf("Mesos-DNS has no SRV record of %s", OBSERVER_SRV)
+	}
+	log.WithFields(log.Fields{"sd": "step"}).Debug("Can't look up my port via Mesos-DNS due to ", err, ", trying SRV")
+	_, addrs, serr := net.LookupSRV("", "", OBSERVER_SRV)
+	if serr == nil {
+		for _, addr := range addrs {
+			if addr.Port != 0 {
+				return strconv.Itoa(int(addr.Port)), nil
+			}
+		}
+		serr = fmt.Errorf("no SRV record of %s", OBSERVER_SRV)
+	}
+	return "", fmt.Errorf("Can't look up my port since PORT0 is not set and neither Mesos-DNS (%v) nor SRV (%v) know it", err, serr)
+}
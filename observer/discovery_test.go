@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Helpers
+
+// countingSource yields the Marathon at location, slowly, and counts how often it's asked
+type countingSource struct {
+	location string
+	asked    int32
+}
+
+func (s *countingSource) Name() string {
+	return "counting"
+}
+
+func (s *countingSource) Marathon() (string, error) {
+	atomic.AddInt32(&s.asked, 1)
+	time.Sleep(50 * time.Millisecond)
+	return s.location, nil
+}
+
+// Tests
+
+func TestMarathonURLRediscoversOnce(t *testing.T) {
+	var pings int32
+	marathon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&pings, 1)
+	}))
+	defer marathon.Close()
+	source := &countingSource{location: marathon.URL}
+	marathonSources = []MarathonSource{source}
+	defer func() {
+		marathonSources = nil
+		discoveredMarathon = ""
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if loc, err := marathonURL(); err != nil || loc != marathon.URL {
+				t.Errorf("discovered %s (%v), want %s", loc, err, marathon.URL)
+			}
+		}()
+	}
+	wg.Wait()
+	if asked := atomic.LoadInt32(&source.asked); asked != 1 {
+		t.Errorf("source asked %d times, want once", asked)
+	}
+	before := atomic.LoadInt32(&pings)
+	if _, err := marathonURL(); err != nil {
+		t.Fatal(err)
+	}
+	if after := atomic.LoadInt32(&pings); after != before {
+		t.Errorf("pinged Marathon again right after discovering it")
+	}
+}
+
+func TestGrabDiscoveryEnv(t *testing.T) {
+	defer func() { marathonSources = nil }()
+	defer os.Unsetenv("DPLOY_OBSERVER_DISCOVERY")
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{"", []string{DISCOVERY_ENV, DISCOVERY_MESOS_DNS, DISCOVERY_SRV, DISCOVERY_ADMIN_ROUTER}},
+		{"admin-router, env", []string{DISCOVERY_ADMIN_ROUTER, DISCOVERY_ENV}},
+		{"srv,zookeeper", []string{DISCOVERY_SRV}},
+	}
+	for _, tt := range tests {
+		os.Setenv("DPLOY_OBSERVER_DISCOVERY", tt.order)
+		grabDiscoveryEnv()
+		names := []string{}
+		for _, source := range marathonSources {
+			names = append(names, source.Name())
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("sources of %q are %v, want %v", tt.order, names, tt.want)
+		}
+	}
+}
+
+func TestDiscoverMarathonFallback(t *testing.T) {
+	marathon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ping" && r.URL.Path != "/marathon/ping" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer marathon.Close()
+	defer func() { marathonSources = nil }()
+	tests := []struct {
+		name    string
+		sources []MarathonSource
+		want    string
+		fails   string
+	}{
+		{"env", []MarathonSource{&envSource{location: marathon.URL + "/"}, &adminRouterSource{base: "http://leader.invalid"}}, marathon.URL, ""},
+		{"env not set", []MarathonSource{&envSource{}, &adminRouterSource{base: marathon.URL}}, marathon.URL + "/marathon", ""},
+		{"env not a URL", []MarathonSource{&envSource{location: "marathon.mesos"}, &adminRouterSource{base: marathon.URL}}, marathon.URL + "/marathon", ""},
+		{"nothing configured", []MarathonSource{&envSource{}}, "", "env: DPLOY_OBSERVER_MARATHON_URL not set"},
+		{"no sources", []MarathonSource{}, "", "no discovery source"},
+	}
+	for _, tt := range tests {
+		marathonSources = tt.sources
+		loc, err := discoverMarathon()
+		if loc != tt.want {
+			t.Errorf("%s: discovered %q, want %q", tt.name, loc, tt.want)
+		}
+		if (err != nil) != (tt.fails != "") || err != nil && !strings.Contains(err.Error(), tt.fails) {
+			t.Errorf("%s: failed with %v, want %q", tt.name, err, tt.fails)
+		}
+	}
+}
+
+func TestMesosDNSSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		records string
+		want    string
+	}{
+		{"leader", `[{"host": "marathon.mesos.", "ip": "10.0.4.2"}]`, "http://10.0.4.2:8080"},
+		{"no address", `[{"host": "marathon.mesos.", "ip": ""}]`, ""},
+		{"no records", `[]`, ""},
+		{"garbage", `<html>`, ""},
+	}
+	for _, tt := range tests {
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(tt.records))
+		}))
+		loc, err := (&mesosDNSSource{api: api.URL}).Marathon()
+		api.Close()
+		if loc != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("%s: found Marathon at %q (%v), want %q", tt.name, loc, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"golang.org/x/oauth2"
+	"time"
+)
+
+const (
+	// how long (in sec) the JWTs identifying the GitHub App are valid; GitHub allows at most 10 min:
+	GITHUB_APP_JWT_LIFETIME time.Duration = 540
+	// how long (in sec) before they expire installation tokens are refreshed:
+	GITHUB_APP_TOKEN_LEEWAY time.Duration = 300
+	// the media type of the GitHub Apps API:
+	GITHUB_APP_MEDIA_TYPE string = "application/vnd.github.machine-man-preview+json"
+)
+
+// installationTokenSource mints access tokens of an installation of a GitHub App,
+// see https://developer.github.com/apps/building-github-apps/authenticating-with-github-apps/
+type installationTokenSource struct {
+	appID int
+	// looked up via the repo if not set
+	installationID int
+	owner, repo    string
+	key            *rsa.PrivateKey
+}
+
+// Returns the source of the tokens to authenticate against GitHub with: installation
+// tokens of the GitHub App if the watch has one set up, its personal access token otherwise.
+// Installation tokens expire after an hour, so they're cached and refreshed shortly before.
+func gitHubTokenSource(wd dploy.Watch) (oauth2.TokenSource, error) {
+	if wd.AppID == 0 {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: wd.PAT}), nil
+	}
+	key, err := parsePrivateKey(wd.AppKey)
+	if err != nil {
+		return nil, fmt.Errorf("Can't use private key of GitHub App %d due to %v", wd.AppID, err)
+	}
+	its := &installationTokenSource{
+		appID:          wd.AppID,
+		installationID: wd.InstallationID,
+		owner:          wd.Owner,
+		repo:           wd.Repo,
+		key:            key,
+	}
+	return oauth2.ReuseTokenSource(nil, its), nil
+}
+
+// Decodes the PEM encoded private key GitHub generates for an App
+func parsePrivateKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA key")
+	}
+	return key, nil
+}
+
+// Mints a new installation token; called by the oauth2.ReuseTokenSource wrapping
+// it, which serializes calls, whenever the cached token is about to expire
+func (s *installationTokenSource) Token() (*oauth2.Token, error) {
+	jwt, err := s.jwt()
+	if err != nil {
+		return nil, err
+	}
+	header := map[string]string{"Authorization": "Bearer " + jwt, "Accept": GITHUB_APP_MEDIA_TYPE}
+	if s.installationID == 0 {
+		installation := struct {
+			ID int `json:"id"`
+		}{}
+		if err := scmCall("GET", GITHUB_API+"/repos/"+s.owner+"/"+s.repo+"/installation", header, nil, &installation); err != nil {
+			return nil, fmt.Errorf("Can't look up installation of GitHub App %d in %s/%s due to %v", s.appID, s.owner, s.repo, err)
+		}
+		s.installationID = installation.ID
+		log.WithFields(log.Fields{"auth": "app"}).Info("GitHub App ", s.appID, " is installed in ", s.owner, "/", s.repo, " as installation ", s.installationID)
+	}
+	it := struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+	if err := scmCall("POST", fmt.Sprintf("%s/app/installations/%d/access_tokens", GITHUB_API, s.installationID), header, nil, &it); err != nil {
+		return nil, fmt.Errorf("Can't mint token of installation %d of GitHub App %d due to %v", s.installationID, s.appID, err)
+	}
+	log.WithFields(log.Fields{"auth": "app"}).Debug("Minted token of installation ", s.installationID, " valid until ", it.ExpiresAt)
+	return &oauth2.Token{
+		AccessToken: it.Token,
+		TokenType:   "token",
+		Expiry:      it.ExpiresAt.Add(-GITHUB_APP_TOKEN_LEEWAY * time.Second),
+	}, nil
+}
+
+// Creates a JWT identifying the GitHub App, signed with its private key using RS256
+func (s *installationTokenSource) jwt() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]int64{
+		"iat": now.Add(-60 * time.Second).Unix(), // allow for clock drift
+		"exp": now.Add(GITHUB_APP_JWT_LIFETIME * time.Second).Unix(),
+		"iss": int64(s.appID),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("Can't sign JWT of GitHub App %d due to %v", s.appID, err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
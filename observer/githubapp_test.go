@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests
+
+func TestGitHubAppJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	its := &installationTokenSource{appID: 4711, key: key}
+	jwt, err := its.jwt()
+	if err != nil {
+		t.Fatalf("can't create JWT: %v", err)
+	}
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("JWT has %d parts, want 3", len(parts))
+	}
+	header := map[string]string{}
+	if h, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(h, &header) != nil || header["alg"] != "RS256" {
+		t.Errorf("header %s doesn't announce RS256", parts[0])
+	}
+	claims := map[string]int64{}
+	if c, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(c, &claims) != nil {
+		t.Fatalf("can't decode claims %s", parts[1])
+	}
+	now := time.Now().Unix()
+	if claims["iss"] != 4711 {
+		t.Errorf("issuer is %d, want 4711", claims["iss"])
+	}
+	if claims["iat"] > now || claims["exp"] <= now || claims["exp"]-claims["iat"] > 600 {
+		t.Errorf("JWT valid from %d until %d, GitHub accepts at most 10 min", claims["iat"], claims["exp"])
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("can't decode signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("signature doesn't verify: %v", err)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if parsed, err := parsePrivateKey(string(pkcs1)); err != nil || parsed.N.Cmp(key.N) != 0 {
+		t.Errorf("can't parse PKCS#1 key: %v", err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if parsed, err := parsePrivateKey(string(pkcs8)); err != nil || parsed.N.Cmp(key.N) != 0 {
+		t.Errorf("can't parse PKCS#8 key: %v", err)
+	}
+	if _, err := parsePrivateKey("not a key"); err == nil {
+		t.Error("parsed garbage as key")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// where to keep the deployment history, relative to the history directory:
+	DEFAULT_HISTORY_FILE string = "dploy-history.json"
+	// how many deployments to keep in the history:
+	DEFAULT_HISTORY_LENGTH int = 500
+)
+
+var (
+	// finished deployments, most recent first
+	history []Job
+
+	// guards history
+	historyMutex sync.Mutex
+)
+
+// Determines where the history is persisted: in DPLOY_OBSERVER_HISTORY_DIR if set,
+// otherwise next to the rest of the state of the observer
+func historyLocation() string {
+	dir := os.Getenv("DPLOY_OBSERVER_HISTORY_DIR")
+	if dir == "" {
+		dir = stateDir()
+	}
+	hf, _ := filepath.Abs(filepath.Join(dir, DEFAULT_HISTORY_FILE))
+	return hf
+}
+
+// Loads the persisted history, if any
+func loadHistory() {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	hf := historyLocation()
+	d, err := ioutil.ReadFile(hf)
+	if err != nil {
+		log.WithFields(log.Fields{"history": "load"}).Info("No history found in ", hf)
+		return
+	}
+	if err := json.Unmarshal(d, &history); err != nil {
+		log.WithFields(log.Fields{"history": "load"}).Error("Can't decode history in ", hf, " due to ", err)
+		return
+	}
+	log.WithFields(log.Fields{"history": "load"}).Info("Loaded ", len(history), " deployments from ", hf)
+}
+
+// Adds a finished deployment to the history and persists the history
+func record(job Job) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	history = append([]Job{job}, history...)
+	if len(history) > DEFAULT_HISTORY_LENGTH {
+		history = history[:DEFAULT_HISTORY_LENGTH]
+	}
+	hf := historyLocation()
+	d, err := json.Marshal(history)
+	if err != nil {
+		log.WithFields(log.Fields{"history": "record"}).Error("Can't encode history due to ", err)
+		return
+	}
+	// write to a temporary file first so that a crash can't leave a truncated history behind:
+	tmp := hf + ".tmp"
+	if err := ioutil.WriteFile(tmp, d, 0644); err != nil {
+		log.WithFields(log.Fields{"history": "record"}).Error("Can't write history to ", tmp, " due to ", err)
+		return
+	}
+	if err := os.Rename(tmp, hf); err != nil {
+		log.WithFields(log.Fields{"history": "record"}).Error("Can't write history to ", hf, " due to ", err)
+		return
+	}
+	log.WithFields(log.Fields{"history": "record"}).Debug("Recorded job ", job.ID, " in ", hf)
+}
+
+// Returns the time and commit SHA of the last successful deployment of the repo
+// OWNER/REPO, not counting previews, from the history
+func lastSuccess(repo string) (time.Time, string) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	for _, job := range history {
+		if inRepo(job, repo) && job.PullRequest == 0 && job.State == JOB_SUCCEEDED {
+			return job.Finished, job.Commit
+		}
+	}
+	return time.Time{}, ""
+}
+
+// Checks if the job deployed the repo OWNER/REPO; jobs recorded by earlier versions
+// of the observer only tell their app, which is the repo or, for previews, REPO#N
+func inRepo(job Job, repo string) bool {
+	if job.Repo != "" {
+		return job.Repo == repo
+	}
+	return strings.SplitN(job.App, "#", 2)[0] == repo
+}
+
+// Returns a snapshot of the history, of all repos or only of the repo OWNER/REPO
+func historySnapshot(repo string) []Job {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	h := []Job{}
+	for _, job := range history {
+		if repo == "" || inRepo(job, repo) {
+			h = append(h, job)
+		}
+	}
+	return h
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Helpers
+
+// keeps the history of a test in a temporary directory, returning the function to clean up
+func tempHistory() func() {
+	dir, _ := ioutil.TempDir("", "dploy-history")
+	os.Setenv("DPLOY_OBSERVER_HISTORY_DIR", dir)
+	history = nil
+	return func() {
+		os.Unsetenv("DPLOY_OBSERVER_HISTORY_DIR")
+		os.RemoveAll(dir)
+		history = nil
+	}
+}
+
+// Tests
+
+func TestRecordPersistsHistory(t *testing.T) {
+	defer tempHistory()()
+	for i := 0; i < DEFAULT_HISTORY_LENGTH+1; i++ {
+		record(Job{ID: fmt.Sprintf("job-%d", i), Repo: "mhausenblas/dploy", State: JOB_SUCCEEDED})
+	}
+	d, err := ioutil.ReadFile(historyLocation())
+	if err != nil {
+		t.Fatalf("history not persisted: %v", err)
+	}
+	persisted := []Job{}
+	if err := json.Unmarshal(d, &persisted); err != nil {
+		t.Fatalf("can't decode persisted history: %v", err)
+	}
+	if len(persisted) != DEFAULT_HISTORY_LENGTH {
+		t.Errorf("persisted %d jobs, want %d", len(persisted), DEFAULT_HISTORY_LENGTH)
+	}
+	if latest := fmt.Sprintf("job-%d", DEFAULT_HISTORY_LENGTH); persisted[0].ID != latest {
+		t.Errorf("most recent job is %s, want %s", persisted[0].ID, latest)
+	}
+	history = nil
+	loadHistory()
+	if len(history) != DEFAULT_HISTORY_LENGTH {
+		t.Errorf("loaded %d jobs, want %d", len(history), DEFAULT_HISTORY_LENGTH)
+	}
+}
+
+func TestLastSuccess(t *testing.T) {
+	defer tempHistory()()
+	deployed := time.Date(2018, 6, 14, 23, 20, 16, 0, time.UTC)
+	jobs := []Job{
+		{ID: "old", Repo: "mhausenblas/dploy", Commit: "old", State: JOB_SUCCEEDED, Finished: deployed},
+		{ID: "other", Repo: "mhausenblas/other", Commit: "other", State: JOB_SUCCEEDED, Finished: deployed.Add(time.Minute)},
+		{ID: "legacy", App: "mhausenblas/legacy", Commit: "legacy", State: JOB_SUCCEEDED, Finished: deployed},
+		{ID: "preview", Repo: "mhausenblas/dploy", Commit: "preview", PullRequest: 42, State: JOB_SUCCEEDED, Finished: deployed.Add(2 * time.Minute)},
+		{ID: "failed", Repo: "mhausenblas/dploy", Commit: "failed", State: JOB_FAILED, Finished: deployed.Add(3 * time.Minute)},
+	}
+	for _, job := range jobs {
+		record(job)
+	}
+	tests := []struct {
+		repo   string
+		commit string
+	}{
+		{"mhausenblas/dploy", "old"},
+		{"mhausenblas/other", "other"},
+		{"mhausenblas/legacy", "legacy"}, // recorded before jobs told their repo
+		{"mhausenblas/unknown", ""},
+	}
+	for _, tt := range tests {
+		if _, commit := lastSuccess(tt.repo); commit != tt.commit {
+			t.Errorf("last success of %s is %q, want %q", tt.repo, commit, tt.commit)
+		}
+	}
+	if h := historySnapshot("mhausenblas/dploy"); len(h) != 3 || h[0].ID != "failed" {
+		t.Errorf("history of mhausenblas/dploy is %v, want the 3 jobs of it, most recent first", h)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	dploy "github.com/mhausenblas/dploy/lib"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// the namespace of all metrics the observer exposes via /metrics:
+	METRICS_NAMESPACE string = "dploy_observer"
+	// outcomes of Webhook deliveries, in addition to the REJECT_* reasons:
+	DELIVERY_ACCEPTED string = "accepted"
+	DELIVERY_IGNORED  string = "ignored"
+	// operations failing in marathon_errors_total, besides requests against the Marathon API:
+	MARATHON_OP_DISCOVERY      string = "discovery"
+	MARATHON_OP_SELF_DISCOVERY string = "self_discovery"
+	MARATHON_OP_PING           string = "GET /ping"
+	// the suffix of the app label of preview jobs, see metricsApp:
+	METRICS_PREVIEW_SUFFIX string = "#preview"
+)
+
+var (
+	deliveriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook deliveries received, by outcome (accepted, ignored or the reason for rejecting them).",
+	}, []string{"outcome"})
+
+	pullsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "pulls_total",
+		Help:      "Pulls of repo content from the SCM provider, by outcome.",
+	}, []string{"outcome"})
+
+	pullDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "pull_duration_seconds",
+		Help:      "Time it took to download and extract repo content.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 8),
+	})
+
+	deploymentsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "deployments_total",
+		Help:      "Finished deployment jobs, by app and outcome (succeeded, failed, cancelled or, for staged ones, expired or superseded).",
+	}, []string{"app", "outcome"})
+
+	deploymentDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "deployment_duration_seconds",
+		Help:      "Time it took to carry out deployment jobs, by app and outcome.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"app", "outcome"})
+
+	marathonErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "marathon_errors_total",
+		Help:      "Failed requests against the Marathon API as well as failures to discover Marathon or where the observer is reachable, by operation.",
+	}, []string{"operation"})
+
+	scmRateLimitRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "scm_rate_limit_remaining",
+		Help:      "Requests remaining in the current rate limit window of the SCM provider's API, as last reported by it.",
+	})
+)
+
+// the HTTP client for calls against the REST APIs of the SCM providers
+var scmClient = &http.Client{Transport: rateLimitTransport{http.DefaultTransport}}
+
+// rateLimitTransport records the rate limit reported in all responses of an SCM provider
+type rateLimitTransport struct {
+	base http.RoundTripper
+}
+
+func (t rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		observeRateLimit(resp.Header)
+	}
+	return resp, err
+}
+
+// marathonTransport counts the requests against the Marathon API that fail, that is,
+// don't get a response or get an error other than 404, which dploy expects when
+// looking up apps that don't exist yet
+type marathonTransport struct {
+	base http.RoundTripper
+}
+
+func (t marathonTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound {
+		marathonErrorsTotal.WithLabelValues(marathonOperation(req)).Inc()
+	}
+	return resp, err
+}
+
+// Returns the operation of a request against the Marathon API: its method and
+// the resource, for example PUT /v2/groups, leaving out the IDs of apps, groups,
+// tasks or deployments so that the number of series stays bounded
+func marathonOperation(req *http.Request) string {
+	path := req.URL.Path
+	if i := strings.Index(path, "/v2/"); i >= 0 {
+		resource := strings.SplitN(path[i+len("/v2/"):], "/", 2)[0]
+		return req.Method + " /v2/" + resource
+	}
+	return req.Method + " /" + path[strings.LastIndex(path, "/")+1:]
+}
+
+func init() {
+	prometheus.MustRegister(deliveriesTotal, pullsTotal, pullDuration, deploymentsTotal, deploymentDuration, marathonErrorsTotal, scmRateLimitRemaining)
+	dploy.MarathonTransport = marathonTransport{dploy.MarathonTransport}
+}
+
+// Returns the app label of the metrics of a job. Previews are labelled by the
+// watch rather than the pull request, so that the number of series stays bounded.
+func metricsApp(job Job) string {
+	if job.PullRequest != 0 {
+		return job.Repo + METRICS_PREVIEW_SUFFIX
+	}
+	return job.App
+}
+
+// Records the outcome of a finished deployment job
+func observeJob(job Job) {
+	d := job.Finished.Sub(job.Started).Seconds()
+	deploymentsTotal.WithLabelValues(metricsApp(job), job.State).Inc()
+	deploymentDuration.WithLabelValues(metricsApp(job), job.State).Observe(d)
+}
+
+// Records the remaining rate limit the SCM provider reports in the response
+// headers, X-RateLimit-Remaining for GitHub and Gitea, RateLimit-Remaining for GitLab
+func observeRateLimit(header http.Header) {
+	remaining := header.Get("X-RateLimit-Remaining")
+	if remaining == "" {
+		remaining = header.Get("RateLimit-Remaining")
+	}
+	if r, err := strconv.Atoi(remaining); err == nil {
+		scmRateLimitRemaining.Set(float64(r))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Helpers
+
+// fakeTransport answers every request with status, or fails if status is 0
+type fakeTransport struct {
+	status int
+}
+
+func (t fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.status == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{StatusCode: t.status, Body: http.NoBody, Request: req}, nil
+}
+
+// Tests
+
+func TestMarathonOperation(t *testing.T) {
+	tests := []struct {
+		method, url string
+		want        string
+	}{
+		{"PUT", "http://marathon.mesos:8080/v2/groups", "PUT /v2/groups"},
+		{"GET", "http://marathon.mesos:8080/v2/apps/dploy/web?embed=apps.tasks", "GET /v2/apps"},
+		{"DELETE", "http://leader.mesos/service/marathon/v2/deployments/42", "DELETE /v2/deployments"},
+		{"GET", "http://marathon.mesos:8080/ping", "GET /ping"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		if got := marathonOperation(req); got != tt.want {
+			t.Errorf("marathonOperation(%s %s) = %s, want %s", tt.method, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestMarathonTransportCountsErrors(t *testing.T) {
+	tests := []struct {
+		status  int
+		counted bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNotFound, false},
+		{http.StatusConflict, true},
+		{http.StatusServiceUnavailable, true},
+		{0, true},
+	}
+	for _, tt := range tests {
+		counter := marathonErrorsTotal.WithLabelValues("PUT /v2/groups")
+		before := testutil.ToFloat64(counter)
+		req := httptest.NewRequest("PUT", "http://marathon.mesos:8080/v2/groups/dploy", nil)
+		marathonTransport{fakeTransport{tt.status}}.RoundTrip(req)
+		if counted := testutil.ToFloat64(counter) > before; counted != tt.counted {
+			t.Errorf("status %d counted as error: %t, want %t", tt.status, counted, tt.counted)
+		}
+	}
+}
+
+func TestMetricsApp(t *testing.T) {
+	tests := []struct {
+		job  Job
+		want string
+	}{
+		{Job{Repo: "mhausenblas/dploy", App: "/dploy"}, "/dploy"},
+		{Job{Repo: "mhausenblas/dploy", App: "/dploy", PullRequest: 42}, "mhausenblas/dploy#preview"},
+		{Job{Repo: "mhausenblas/dploy", App: "/dploy", PullRequest: 43}, "mhausenblas/dploy#preview"},
+	}
+	for _, tt := range tests {
+		if got := metricsApp(tt.job); got != tt.want {
+			t.Errorf("metricsApp(%+v) = %s, want %s", tt.job, got, tt.want)
+		}
+	}
+}
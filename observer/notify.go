@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	// the deployment events notification sinks can subscribe to:
+	EVENT_STARTED    string = "started"
+	EVENT_SUCCEEDED  string = "succeeded"
+	EVENT_FAILED     string = "failed"
+	EVENT_ROLLBACK   string = "rollback"
+	EVENT_STAGED     string = "staged"
+	EVENT_EXPIRED    string = "expired"
+	EVENT_SUPERSEDED string = "superseded"
+	// the kinds of notification sinks:
+	NOTIFY_WEBHOOK string = "webhook"
+	NOTIFY_SLACK   string = "slack"
+	NOTIFY_EMAIL   string = "email"
+	// the message sent unless a sink defines its own template:
+	DEFAULT_NOTIFICATION_TEMPLATE string = `[{{.Repo}}] Deployment {{.Event}}: {{.Job.Commit}} pushed by {{.Job.Pusher}}` +
+		`{{if .Job.Msg}} ({{.Job.Msg}}){{end}}` +
+		`{{range .Job.Apps}}
+ {{.ID}}{{if .Endpoints}} at {{.Endpoints}}{{end}}{{if not .Success}} FAILED{{end}}{{end}}`
+)
+
+// Notice is what notification templates are rendered with.
+type Notice struct {
+	Event string `json:"event"`
+	Repo  string `json:"repo"`
+	Job   Job    `json:"job"`
+}
+
+func grabNotifyEnv() {
+	if n := os.Getenv("DPLOY_OBSERVER_NOTIFICATIONS"); n != "" {
+		if err := json.Unmarshal([]byte(n), &envWatch.Notifications); err != nil {
+			log.WithFields(log.Fields{"notify": "config"}).Error("Can't parse notification sinks due to ", err)
+		}
+	}
+	envWatch.SMTPPassword = os.Getenv("DPLOY_OBSERVER_SMTP_PASSWORD")
+	envWatch.RollbackOnFailure, _ = strconv.ParseBool(os.Getenv("DPLOY_OBSERVER_ROLLBACK_ON_FAILURE"))
+}
+
+// Sends a notice about the event concerning the job to all sinks of the watch subscribed
+// to it. Sinks are notified in the background so that slow ones don't hold up deployments.
+func notify(w *watch, event string, job Job) {
+	notice := Notice{Event: event, Repo: w.name(), Job: job}
+	for _, n := range w.Notifications {
+		if !subscribed(n, event) {
+			continue
+		}
+		go func(n dploy.Notification) {
+			if err := send(n, notice, w.SMTPPassword); err != nil {
+				log.WithFields(log.Fields{"notify": n.Type}).Error("Failed to notify about ", event, " of job ", job.ID, " due to ", err)
+				return
+			}
+			log.WithFields(log.Fields{"notify": n.Type}).Debug("Notified about ", event, " of job ", job.ID)
+		}(n)
+	}
+}
+
+// Checks if the sink wants to hear about the event; sinks without events want all
+func subscribed(n dploy.Notification, event string) bool {
+	if len(n.Events) == 0 {
+		return true
+	}
+	for _, e := range n.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func send(n dploy.Notification, notice Notice, smtpPassword string) error {
+	msg, err := render(n, notice)
+	if err != nil {
+		return err
+	}
+	switch n.Type {
+	case NOTIFY_WEBHOOK:
+		payload := struct {
+			Notice
+			Message string `json:"message"`
+		}{notice, msg}
+		return postJSON(n.URL, payload)
+	case NOTIFY_SLACK:
+		return postJSON(n.URL, map[string]string{"text": msg})
+	case NOTIFY_EMAIL:
+		return sendMail(n, notice, msg, smtpPassword)
+	default:
+		return fmt.Errorf("Unknown notification sink type %s", n.Type)
+	}
+}
+
+func render(n dploy.Notification, notice Notice) (string, error) {
+	text := n.Template
+	if text == "" {
+		text = DEFAULT_NOTIFICATION_TEMPLATE
+	}
+	tmpl, err := template.New(n.Type).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var msg bytes.Buffer
+	if err := tmpl.Execute(&msg, notice); err != nil {
+		return "", err
+	}
+	return msg.String(), nil
+}
+
+func postJSON(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return nil
+}
+
+func sendMail(n dploy.Notification, notice Notice, msg string, smtpPassword string) error {
+	var auth smtp.Auth
+	if n.Username != "" {
+		host, _, err := net.SplitHostPort(n.SMTPHost)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.Username, smtpPassword, host)
+	}
+	subject := fmt.Sprintf("[%s] Deployment %s: %s", notice.Repo, notice.Event, notice.Job.Commit)
+	mail := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", n.From, strings.Join(n.To, ", "), subject, msg)
+	return smtp.SendMail(n.SMTPHost, auth, n.From, n.To, []byte(mail))
+}
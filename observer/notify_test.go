@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Tests
+
+func TestRender(t *testing.T) {
+	job := Job{
+		Commit: "4b825dc6",
+		Pusher: "octocat",
+		Apps: []dploy.AppResult{
+			{ID: "/shop/web", Success: true, Endpoints: "10.0.4.2:31001"},
+			{ID: "/shop/db", Success: false},
+		},
+	}
+	notice := Notice{Event: EVENT_FAILED, Repo: "mhausenblas/shop", Job: job}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		fails    bool
+	}{
+		{"default", "", "[mhausenblas/shop] Deployment failed: 4b825dc6 pushed by octocat\n /shop/web at 10.0.4.2:31001\n /shop/db FAILED", false},
+		{"custom", "{{.Event}} {{.Repo}}@{{.Job.Commit}}{{range .Job.Apps}} {{.ID}}{{end}}", "failed mhausenblas/shop@4b825dc6 /shop/web /shop/db", false},
+		{"message", "{{if .Job.Msg}}{{.Job.Msg}}{{else}}no message{{end}}", "no message", false},
+		{"invalid", "{{.Event", "", true},
+		{"unknown field", "{{.Pusher}}", "", true},
+	}
+	for _, tt := range tests {
+		got, err := render(dploy.Notification{Type: NOTIFY_SLACK, Template: tt.template}, notice)
+		if (err != nil) != tt.fails || got != tt.want {
+			t.Errorf("%s: rendered %q (%v), want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSubscribed(t *testing.T) {
+	tests := []struct {
+		events []string
+		event  string
+		want   bool
+	}{
+		{nil, EVENT_STARTED, true},
+		{[]string{EVENT_FAILED, EVENT_ROLLBACK}, EVENT_ROLLBACK, true},
+		{[]string{EVENT_FAILED, EVENT_ROLLBACK}, EVENT_SUCCEEDED, false},
+		{[]string{EVENT_STAGED}, EVENT_EXPIRED, false},
+	}
+	for _, tt := range tests {
+		if got := subscribed(dploy.Notification{Events: tt.events}, tt.event); got != tt.want {
+			t.Errorf("sink of %v subscribed to %s: %t, want %t", tt.events, tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	received := map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+	notice := Notice{Event: EVENT_SUCCEEDED, Repo: "mhausenblas/shop", Job: Job{ID: "1", Commit: "4b825dc6"}}
+	tests := []struct {
+		sink   string
+		fields []string
+	}{
+		{NOTIFY_SLACK, []string{"text"}},
+		{NOTIFY_WEBHOOK, []string{"event", "repo", "job", "message"}},
+	}
+	for _, tt := range tests {
+		if err := send(dploy.Notification{Type: tt.sink, URL: server.URL, Template: "{{.Event}}"}, notice, ""); err != nil {
+			t.Errorf("%s: can't send due to %v", tt.sink, err)
+		}
+		for _, field := range tt.fields {
+			if _, ok := received[field]; !ok {
+				t.Errorf("%s: %s missing in %v", tt.sink, field, received)
+			}
+		}
+		if len(received) != len(tt.fields) {
+			t.Errorf("%s: sent %v, want only %v", tt.sink, received, tt.fields)
+		}
+	}
+	if err := send(dploy.Notification{Type: "pager"}, notice, ""); err == nil {
+		t.Error("sent to sink of unknown type")
+	}
+}
@@ -1,445 +1,365 @@
 package main
 
 import (
-	"archive/zip"
 	"encoding/json"
 	"flag"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	github "github.com/google/go-github/github"
 	dploy "github.com/mhausenblas/dploy/lib"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/oauth2"
-	yaml "gopkg.in/yaml.v2"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 )
 
 const (
 	VERSION string = "1.0.3"
 	// which branch to observe for changes:
 	DEFAULT_OBSERVE_BRANCH string = "dcos"
-	// how long to wait (in sec) after launch to register Webhook:
-	DEFAULT_OBSERVER_WAIT_TIME time.Duration = 30
 )
 
 var (
 	// the HTTP request multiplexer
 	mux *http.ServeMux
 
-	// the GitHub client
-	client *github.Client
-
-	// personal access token (pat), owner and repo to observe
-	pat, owner, repo string
+	// the repo to watch as configured via environment and CLI arguments,
+	// further ones are added via /watches
+	envWatch dploy.Watch
 
 	// public IP address FQDN of the public agent this service using
 	pubnode string
-
-	// Web hook used to trigger deployment
-	deployHook *github.Hook
-
-	// how long to wait to register Webhook (default: DEFAULT_OBSERVER_WAIT_TIME)
-	registerDelay time.Duration
-
-	// which branch to observe for push events (default: DEFAULT_OBSERVE_BRANCH)
-	targetBranch string
-
-	// time stamp of the last successful deployment
-	lastDeployment time.Time
 )
 
 type Status struct {
-	Owner        string    `json:"owner"`
-	Repo         string    `json:"repo"`
-	TargetBranch string    `json:"branch"`
-	Pubnode      string    `json:"pubnode"`
-	LastDeploy   time.Time `json:"lastdeploy"`
+	Pubnode  string         `json:"pubnode"`
+	Watches  []WatchStatus  `json:"watches"`
+	Rejected map[string]int `json:"rejected"`
 }
 
 type DployResult struct {
 	Success bool   `json:"success"`
 	Msg     string `json:"message"`
+	Job     string `json:"job,omitempty"`
 }
 
-type DNSResults struct {
-	SRVRecords []SRVRecord
-}
-
-type SRVRecord struct {
-	Service string
-	Host    string
-	IP      string
-	Port    string
-}
-
-type HostRecord struct {
-	Host string
-	IP   string
+// AdminResult is the outcome of a request to an admin endpoint
+type AdminResult struct {
+	Result string `json:"result"`
 }
 
 func init() {
 	mux = http.NewServeMux()
-	registerDelay = DEFAULT_OBSERVER_WAIT_TIME
-	targetBranch = DEFAULT_OBSERVE_BRANCH
+	listenAddr = DEFAULT_LISTEN_ADDR
 	grabEnv() // try via env variables first
-	flag.StringVar(&pat, "pat", pat, "the personal access token, via https://github.com/settings/tokens")
-	flag.StringVar(&owner, "owner", owner, "the GitHub owner, for example 'mhausenblas' or 'mesosphere'.")
-	flag.StringVar(&repo, "repo", repo, "the GitHub repo, for example 'dploy' or 'marathon'.")
+	flag.StringVar(&envWatch.PAT, "pat", envWatch.PAT, "the personal access token, for example via https://github.com/settings/tokens")
+	flag.StringVar(&envWatch.Owner, "owner", envWatch.Owner, "the repo owner, for example 'mhausenblas' or 'mesosphere'.")
+	flag.StringVar(&envWatch.Repo, "repo", envWatch.Repo, "the repo, for example 'dploy' or 'marathon'.")
+	flag.StringVar(&envWatch.RepoURL, "repourl", envWatch.RepoURL, "the repo URL, for example 'https://gitlab.com/mhausenblas/dploy'.")
+	flag.StringVar(&listenAddr, "listen", listenAddr, "the address to serve on, for example ':8888' or '127.0.0.1:8443'.")
+	flag.StringVar(&envWatch.SCM, "scm", envWatch.SCM, "the SCM provider, one of 'github', 'gitlab', 'bitbucket' or 'gitea'; derived from the repo URL if not set.")
 	flag.Usage = func() {
 		flag.PrintDefaults()
 	}
-	flag.Parse()
-	cwd, _ := os.Getwd()
-	err := stashPAT(cwd)
-	if err != nil {
-		log.WithFields(log.Fields{"observer": "init"}).Error("GitHub Personal Access Token file not available due to ", err)
-	} else {
-		lastDeployment = time.Now()
-	}
 }
 
-func stashPAT(workdir string) error {
-	patFile, _ := filepath.Abs(filepath.Join(workdir, dploy.MARATHON_OBSERVER_PAT_FILE))
-	f, err := os.Create(patFile)
-	if err != nil {
-		log.WithFields(log.Fields{"pat": "stash"}).Error("Can't create ", patFile, " due to ", err)
-		return err
-	}
-	bytesWritten, werr := f.WriteString(pat)
-	if werr != nil {
-		log.WithFields(log.Fields{"pat": "stash"}).Error("Can't write to ", patFile, " due to ", err)
-		return werr
-	}
-	f.Sync()
-	log.WithFields(log.Fields{"pat": "stash"}).Debug("Stashed GitHub Personal Access Token file ", patFile, ", ", bytesWritten, " Bytes written to disk.")
-	return nil
-}
-
-// Grabs the necessary parameter (GitHub personal access token, owner and repo)
-// from environment, if present at all. Note: the CLI arguments will overwrite
-// these environment variables
+// Grabs the necessary parameter (GitHub personal access token, owner and repo
+// as well as how to deploy it) of the repo to watch from environment, if present
+// at all. Note: the CLI arguments will overwrite these environment variables
 func grabEnv() {
 	pubnode = os.Getenv("DPLOY_PUBLIC_NODE")
-	pat = os.Getenv("DPLOY_OBSERVER_GITHUB_PAT")
-	owner = os.Getenv("DPLOY_OBSERVER_GITHUB_OWNER")
-	repo = os.Getenv("DPLOY_OBSERVER_GITHUB_REPO")
-	if dr := os.Getenv("DPLOY_OBSERVER_DELAY_REGISTRATION"); dr != "" {
-		rd, _ := strconv.ParseUint(dr, 10, 64)
-		registerDelay = time.Duration(rd)
+	envWatch.PAT = os.Getenv("DPLOY_OBSERVER_GITHUB_PAT")
+	if pf := os.Getenv("DPLOY_OBSERVER_GITHUB_PAT_FILE"); pf != "" { // for example a secret mounted as file
+		pat, err := dploy.ReadTokenFile(pf)
+		if err != nil {
+			log.WithFields(log.Fields{"observer": "init"}).Error("Can't read personal access token due to ", err)
+		} else {
+			envWatch.PAT = pat
+		}
 	}
-	if tb := os.Getenv("DPLOY_OBSERVER_TARGETBRANCH"); tb != "" {
-		targetBranch = tb
+	if id := os.Getenv("DPLOY_OBSERVER_GITHUB_APP_ID"); id != "" {
+		envWatch.AppID, _ = strconv.Atoi(id)
+		envWatch.InstallationID, _ = strconv.Atoi(os.Getenv("DPLOY_OBSERVER_GITHUB_APP_INSTALLATION_ID"))
+		envWatch.AppKey = os.Getenv("DPLOY_OBSERVER_GITHUB_APP_KEY")
+		if kf := os.Getenv("DPLOY_OBSERVER_GITHUB_APP_KEY_FILE"); kf != "" {
+			key, err := dploy.ReadTokenFile(kf)
+			if err != nil {
+				log.WithFields(log.Fields{"observer": "init"}).Error("Can't read private key of GitHub App due to ", err)
+			} else {
+				envWatch.AppKey = key
+			}
+		}
 	}
-}
-
-// Authenticates user against repo
-// Based on https://godoc.org/github.com/google/go-github/github
-func auth() {
-	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: pat})
-	log.WithFields(log.Fields{"auth": "step"}).Debug("Token Source ", ts)
-	tc := oauth2.NewClient(oauth2.NoContext, ts)
-	log.WithFields(log.Fields{"auth": "step"}).Debug("Auth client ", tc)
-	client = github.NewClient(tc)
-	log.WithFields(log.Fields{"auth": "done"}).Debug("GitHub client ", client)
-	fmt.Printf("Authentication against GitHub done\n")
-}
-
-func marathonURL() string {
-	loc := ""
-	mesosdns := "http://leader.mesos:8123"
-	log.WithFields(log.Fields{"sd": "step"}).Debug("Trying to query HTTP API of ", mesosdns)
-	lookup := "marathon.mesos."
-	resp, err := http.Get(mesosdns + "/v1/hosts/" + lookup)
-	if err != nil {
-		log.WithFields(log.Fields{"sd": "step"}).Error("Can't look up Marathon address due to ", err)
-		return loc
+	envWatch.Owner = os.Getenv("DPLOY_OBSERVER_GITHUB_OWNER")
+	envWatch.Repo = os.Getenv("DPLOY_OBSERVER_GITHUB_REPO")
+	envWatch.RepoURL = os.Getenv("DPLOY_OBSERVER_REPO_URL")
+	envWatch.SCM = os.Getenv("DPLOY_OBSERVER_SCM")
+	envWatch.HookSecret = os.Getenv("DPLOY_OBSERVER_WEBHOOK_SECRET")
+	grabDiscoveryEnv()
+	envWatch.TargetBranch = os.Getenv("DPLOY_OBSERVER_TARGETBRANCH")
+	if tp := os.Getenv("DPLOY_OBSERVER_TAG_PATTERNS"); tp != "" {
+		envWatch.TagPatterns = strings.Split(tp, ",")
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.WithFields(log.Fields{"sd": "step"}).Error("Error reading response from Mesos-DNS ", err)
-		return loc
+	envWatch.OnlySpecChanges, _ = strconv.ParseBool(os.Getenv("DPLOY_OBSERVER_ONLY_SPEC_CHANGES"))
+	grabAdminEnv()
+	grabNotifyEnv()
+	grabApprovalEnv()
+	envWatch.WorkspacePath = os.Getenv("DPLOY_OBSERVER_WORKSPACE_PATH")
+	envWatch.Previews, _ = strconv.ParseBool(os.Getenv("DPLOY_OBSERVER_PREVIEWS"))
+	envWatch.PreviewForks, _ = strconv.ParseBool(os.Getenv("DPLOY_OBSERVER_PREVIEW_FORKS"))
+	if pa := os.Getenv("DPLOY_OBSERVER_PREVIEW_AUTHORS"); pa != "" {
+		envWatch.PreviewAuthors = strings.Split(pa, ",")
 	}
-	var hrecords []HostRecord
-	err = json.Unmarshal(body, &hrecords)
-	if err != nil {
-		log.WithFields(log.Fields{"sd": "step"}).Error("Error decoding JSON object ", err)
-		return loc
+	envWatch.Mode = os.Getenv("DPLOY_OBSERVER_MODE")
+	if pi := os.Getenv("DPLOY_OBSERVER_POLL_INTERVAL"); pi != "" {
+		i, _ := strconv.ParseUint(pi, 10, 64)
+		envWatch.PollInterval = int(i)
 	}
-	loc = "http://" + hrecords[0].IP + ":8080"
-	log.WithFields(log.Fields{"sd": "done"}).Debug("Found Marathon at ", loc)
-	return loc
 }
 
-func whereAmI() string {
-	loc := pubnode
-	mesosdns := "http://leader.mesos:8123"
-	log.WithFields(log.Fields{"sd": "step"}).Debug("Trying to query HTTP API of ", mesosdns)
-	lookup := "_dploy-observer._tcp.marathon.mesos."
-	resp, err := http.Get(mesosdns + "/v1/services/" + lookup)
-	if err != nil {
-		log.WithFields(log.Fields{"sd": "step"}).Error("Can't look up my address due to ", err)
-		return loc
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.WithFields(log.Fields{"sd": "step"}).Error("Error reading response from Mesos-DNS ", err)
-		return loc
-	}
-	var srvrecords []SRVRecord
-	err = json.Unmarshal(body, &srvrecords)
-	if err != nil {
-		log.WithFields(log.Fields{"sd": "step"}).Error("Error decoding JSON object ", err)
-		return loc
-	}
-	loc = "http://" + pubnode + ":" + srvrecords[0].Port
-	log.WithFields(log.Fields{"sd": "done"}).Debug("Found myself at ", loc)
-	return loc
+// Authenticates user against repo, returning a GitHub client using the tokens of ts,
+// see gitHubTokenSource. Based on https://godoc.org/github.com/google/go-github/github
+func auth(ts oauth2.TokenSource) *github.Client {
+	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	tc.Transport = rateLimitTransport{tc.Transport}
+	log.WithFields(log.Fields{"auth": "step"}).Debug("Auth client ", tc)
+	gc := github.NewClient(tc)
+	log.WithFields(log.Fields{"auth": "done"}).Debug("GitHub client ", gc)
+	fmt.Printf("Authentication against GitHub done\n")
+	return gc
 }
 
-// Checks if a Webhook already exists
-func hookExists() (bool, int) {
-	opt := &github.ListOptions{Page: 1}
-	hooks, _, err := client.Repositories.ListHooks(owner, repo, opt)
+// Registers the Webhook of the watch with the SCM provider, pointing to
+// /dploy/OWNER/REPO. Deliveries are signed with the watch's secret, so if the
+// Webhook already exists its config is updated to make sure it uses the current secret.
+func registerHook(w *watch) string {
+	loc, err := whereAmI()
 	if err != nil {
-		log.WithFields(log.Fields{"hook": "check"}).Error("Can't query hooks due to ", err)
-		return false, 0
+		log.WithFields(log.Fields{"observe": "register"}).Debug("Can't register due to: ", err)
+		return fmt.Sprintf("Can't register hook of %s due to %s", w.name(), err)
 	}
-	for _, hook := range hooks {
-		log.WithFields(log.Fields{"hook": "check"}).Debug("Looking at hook ", hook)
-		url, _ := hook.Config["url"].(string)
-		if strings.HasSuffix(url, "/dploy") {
-			return true, *hook.ID
-		}
+	deployURL := loc + "/dploy/" + w.name()
+	log.WithFields(log.Fields{"observe": "register"}).Debug("Hook with URL ", deployURL)
+	if err := registerHookAt(w, deployURL); err != nil {
+		log.WithFields(log.Fields{"observe": "register"}).Debug("Can't register due to: ", err)
+		return fmt.Sprintf("Can't register hook of %s due to %s", w.name(), err)
 	}
-	return false, 0
+	log.WithFields(log.Fields{"observe": "done"}).Debug("Registered WebHook with ", w.scm.Name())
+	return fmt.Sprintf("Registered WebHook with %s ", string(deployURL))
 }
 
-// Registers a Webhook using https://developer.github.com/v3/repos/hooks
-func registerHook() string {
-	deployURL := pubnode
-	if exists, _ := hookExists(); !exists {
-		deployURL = whereAmI() + "/dploy"
-		deployHook = new(github.Hook)
-		hookType := "web"
-		deployHook.Name = new(string)
-		deployHook.Name = &hookType
-		deployHook.Config = make(map[string]interface{})
-		deployHook.Config["url"] = deployURL
-		enableHook := true
-		deployHook.Active = new(bool)
-		deployHook.Active = &enableHook
-
-		// see https://github.com/google/go-github/blob/master/github/repos_hooks.go
-		// for details on WebHookPayload
-		log.WithFields(log.Fields{"observe": "register"}).Debug("Hook: ", deployHook)
-		whp, _, err := client.Repositories.CreateHook(owner, repo, deployHook)
-		if err != nil {
-			log.WithFields(log.Fields{"observe": "register"}).Debug("Can't register due to: ", err)
-			return fmt.Sprintf("Can't register hook due to %s", err)
-		}
-		log.WithFields(log.Fields{"observe": "done"}).Debug("Registered WebHook ", whp)
-		return fmt.Sprintf("Registered WebHook with %s ", string(deployURL))
-	} else {
-		log.WithFields(log.Fields{"observe": "done"}).Debug("WebHook was already registered!")
-		return fmt.Sprintf("WebHook was already registered!")
-	}
-}
-
-func unregisterHook() string {
-	if exists, hid := hookExists(); exists {
-		log.WithFields(log.Fields{"observe": "unregister"}).Debug("Hook with ID ", hid)
-		_, err := client.Repositories.DeleteHook(owner, repo, hid)
-		if err != nil {
-			log.WithFields(log.Fields{"observe": "unregister"}).Debug("Can't unregister due to: ", err)
-			return fmt.Sprintf("Can't unregister hook due to %s", err)
-		}
+func unregisterHook(w *watch) string {
+	if err := w.scm.UnregisterHook(); err != nil {
+		log.WithFields(log.Fields{"observe": "unregister"}).Debug("Can't unregister due to: ", err)
+		return fmt.Sprintf("Can't unregister hook of %s due to %s", w.name(), err)
 	}
-	return fmt.Sprintf("Unregistered hook")
+	watchMutex.Lock()
+	w.hookID, w.hookURL = "", ""
+	watchMutex.Unlock()
+	persist()
+	return fmt.Sprintf("Unregistered hook of %s", w.name())
 }
 
-// from http://stackoverflow.com/questions/20357223/easy-way-to-unzip-file-with-golang
-// patched f.Mode() -> 0755
-func unzip(src, dest string) error {
-	r, err := zip.OpenReader(src)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-	for _, f := range r.File {
-		rc, err := f.Open()
-		if err != nil {
-			return err
-		}
-		defer rc.Close()
-		fpath := filepath.Join(dest, f.Name)
-		log.WithFields(log.Fields{"observe": "unzip"}).Debug("Extracting ", fpath)
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(fpath, 0755)
-			// os.MkdirAll(fpath, f.Mode())
-		} else {
-			var fdir string
-			if lastIndex := strings.LastIndex(fpath, string(os.PathSeparator)); lastIndex > -1 {
-				fdir = fpath[:lastIndex]
-			}
-			err = os.MkdirAll(fdir, 0755)
-			// err = os.MkdirAll(fdir, f.Mode())
-			if err != nil {
-				log.Fatal(err)
-				return err
-			}
-			f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
-			// f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			_, err = io.Copy(f, rc)
-			if err != nil {
-				return err
-			}
+// Registers or unregisters the Webhooks of all watches not in poll mode
+func forAllHooks(f func(w *watch) string) string {
+	results := []string{}
+	for _, w := range allWatches() {
+		if w.Mode != dploy.OBSERVER_MODE_POLL {
+			results = append(results, f(w))
 		}
 	}
-	return nil
+	return strings.Join(results, "; ")
 }
 
-func pull(owner, repo, workdir string) error {
-	if owner == "" || repo == "" {
-		return fmt.Errorf("Don't know where to pull from since no owner or repo set")
-	}
-	repoURL := "https://github.com/" + owner + "/" + repo + "/archive/" + targetBranch + ".zip"
-	_, err := dploy.Download(repoURL, workdir)
-	if err != nil {
-		log.WithFields(log.Fields{"observer": "pull"}).Error("Failed to download repo content due to ", err)
-		return fmt.Errorf("Failed to download repo content due to %s", err)
-	}
-	log.WithFields(log.Fields{"observe": "pull"}).Debug("Downloaded ", repoURL, " into ", workdir)
-	td, _ := filepath.Abs(filepath.Join(workdir, ""))
-	if _, err := os.Stat(td); os.IsExist(err) {
-		os.RemoveAll(td)
-	}
-	uerr := unzip(targetBranch+".zip", td)
-	if uerr != nil {
-		return uerr
-	}
-	log.WithFields(log.Fields{"observe": "pull"}).Debug("Extracted ", targetBranch+".zip", " into ", td)
-	return nil
+// Responds to an admin request with status and the result as JSON
+func writeResult(w http.ResponseWriter, status int, result string) {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(AdminResult{Result: result})
 }
 
-func patchMarathon(workdir string) error {
-	ad, _ := filepath.Abs(filepath.Join(workdir, dploy.APP_DESCRIPTOR_FILENAME))
-	log.WithFields(log.Fields{"observer": "patchmarathon"}).Debug("Trying to read app descriptor ", ad)
-	d, err := ioutil.ReadFile(ad)
-	if err != nil {
-		return fmt.Errorf("Failed to read app descriptor due to", err)
-	}
-	appDescriptor := dploy.DployApp{}
-	uerr := yaml.Unmarshal([]byte(d), &appDescriptor)
-	if uerr != nil {
-		log.WithFields(log.Fields{"observer": "patchmarathon"}).Error("Failed to de-serialize app descriptor due to ", uerr)
-		return fmt.Errorf("Failed to de-serialize app descriptor due to ", uerr)
+// Routes a Webhook delivery to the watch of the repo it's for, based on the path
+// /dploy/OWNER/REPO; deliveries to plain /dploy, as registered by earlier versions
+// of the observer, go to the watch configured via environment
+func routeDelivery(path string) (*watch, bool) {
+	name := strings.Trim(strings.TrimPrefix(path, "/dploy"), "/")
+	if name == "" {
+		name = envWatch.Owner + "/" + envWatch.Repo
 	}
-	log.WithFields(log.Fields{"observer": "patchmarathon"}).Debug("Got valid app descriptor ")
-	appDescriptor.MarathonURL = marathonURL()
-	ob, merr := yaml.Marshal(&appDescriptor)
-	if merr != nil {
-		log.WithFields(log.Fields{"observer": "patchmarathon"}).Error("Failed to serialize app descriptor due to ", merr)
-		return fmt.Errorf("Failed to serialize app descriptor due to ", merr)
-	}
-	f, perr := os.Create(ad)
-	if perr != nil {
-		log.WithFields(log.Fields{"observer": "patchmarathon"}).Error("Can't create ", ad, " due to ", perr)
-		return fmt.Errorf("Failed to serialize app descriptor due to ", perr)
-	}
-	bytesWritten, err := f.Write(ob)
-	f.Sync()
-	log.WithFields(log.Fields{"observer": "patchmarathon"}).Debug("Patched ", ad, ", ", bytesWritten, " Bytes written to disk.")
-	return nil
-}
-
-func bootstrap() {
-	log.WithFields(log.Fields{"bootstrap": "step"}).Debug("Starting bootstrap process ...")
-	time.Sleep(time.Second * DEFAULT_OBSERVER_WAIT_TIME) // wait for Mesos-DNS to kick in
-	log.WithFields(log.Fields{"bootstrap": "step"}).Debug("Waited long enough now for Mesos-DNS, registering Webhook")
-	result := registerHook()
-	log.WithFields(log.Fields{"bootstrap": "step"}).Debug(result)
-	fmt.Printf("%s\n", result)
+	return lookupWatch(name)
 }
 
 func main() {
+	flag.Parse()
 	log.SetLevel(log.DebugLevel)
 	fmt.Printf("This is dploy observer version %s\n", VERSION)
-	fmt.Printf("I'm observing branch %s of repo %s/%s trying to serve on node %s\n", targetBranch, owner, repo, pubnode)
-	auth()
-	go bootstrap()
+	fmt.Printf("I'm trying to serve on node %s\n", pubnode)
+	loadHistory()
+	if err := restoreState(); err != nil {
+		log.Fatal(err)
+	}
+	go persistState()
 	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/javascript")
 		s := &Status{
-			Owner:        owner,
-			Repo:         repo,
-			TargetBranch: targetBranch,
-			Pubnode:      pubnode,
-			LastDeploy:   lastDeployment,
+			Pubnode:  pubnode,
+			Watches:  watchStatus(),
+			Rejected: rejectionCounts(),
 		}
 		sb, _ := json.Marshal(s)
 		w.Header().Set("Content-Type", "application/javascript")
 		fmt.Fprint(w, string(sb))
 	})
-	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
-		result := registerHook()
-		fmt.Printf("Webhook registered\n")
-		w.Header().Set("Content-Type", "application/javascript")
-		fmt.Fprint(w, `{"result":"`+result+`"}`)
-	})
-	mux.HandleFunc("/reset", func(w http.ResponseWriter, r *http.Request) {
-		result := unregisterHook()
-		w.Header().Set("Content-Type", "application/javascript")
-		fmt.Fprint(w, `{"result":"`+result+`"}`)
-	})
-	mux.HandleFunc("/dploy", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/register", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		result := forAllHooks(registerHook)
+		fmt.Printf("Webhooks registered\n")
+		writeResult(w, http.StatusOK, result)
+	}))
+	mux.HandleFunc("/reset", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		result := forAllHooks(unregisterHook)
+		writeResult(w, http.StatusOK, result)
+	}))
+	handleDelivery := func(w http.ResponseWriter, r *http.Request) {
 		dr := &DployResult{}
-		cwd, _ := os.Getwd()
-		log.WithFields(log.Fields{"handle": "/dploy"}).Info("Noticed change of branch ", targetBranch, " in ", owner, "/", repo)
-		err := pull(owner, repo, cwd)
-		if err != nil {
+		watched, ok := routeDelivery(r.URL.Path)
+		if !ok {
+			log.WithFields(log.Fields{"handle": "/dploy"}).Info("Rejected delivery to ", r.URL.Path, " since I'm not watching that repo")
 			dr.Success = false
-			dr.Msg = fmt.Sprintf("Not able to pull new version of %s/%s due to %v", owner, repo, err)
+			dr.Msg = fmt.Sprintf("Not watching %s", strings.TrimPrefix(r.URL.Path, "/dploy/"))
 			drb, _ := json.Marshal(dr)
 			w.Header().Set("Content-Type", "application/javascript")
+			w.WriteHeader(http.StatusNotFound)
 			fmt.Fprint(w, string(drb))
 			return
 		}
-		log.WithFields(log.Fields{"handle": "/dploy"}).Info("Pulled new version, ready to patch Marathon")
-		perr := patchMarathon(repo + "-" + targetBranch)
-		if perr != nil {
+		body, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = verifyDelivery(watched, r, body)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"handle": "/dploy"}).Info("Rejected delivery due to ", err)
 			dr.Success = false
-			dr.Msg = fmt.Sprintf("Not able to patch Marathon URL due to %v", perr)
+			dr.Msg = fmt.Sprintf("Rejected delivery due to %v", err)
 			drb, _ := json.Marshal(dr)
 			w.Header().Set("Content-Type", "application/javascript")
+			w.WriteHeader(http.StatusUnauthorized)
 			fmt.Fprint(w, string(drb))
 			return
 		}
-		log.WithFields(log.Fields{"handle": "/dploy"}).Info("Patched Marathon, ready to update using workspace " + repo + "-" + targetBranch)
-		success := dploy.Upgrade(repo + "-" + targetBranch)
-		if success {
-			log.WithFields(log.Fields{"handle": "/dploy"}).Info("Update successfully carried out")
-		} else {
-			log.WithFields(log.Fields{"handle": "/dploy"}).Info("Update problems")
+		push, reason := parseDelivery(watched, r, body)
+		if push == nil {
+			log.WithFields(log.Fields{"handle": "/dploy"}).Info(reason)
+			deliveriesTotal.WithLabelValues(DELIVERY_IGNORED).Inc()
+			dr.Success = true
+			dr.Msg = reason
+			drb, _ := json.Marshal(dr)
+			w.Header().Set("Content-Type", "application/javascript")
+			fmt.Fprint(w, string(drb))
+			return
 		}
-		lastDeployment = time.Now()
-		dr.Success = success
-		dr.Msg = fmt.Sprintf("New version of %s/%s deployed at %s", owner, repo, lastDeployment)
+		log.WithFields(log.Fields{"handle": "/dploy"}).Info("Noticed push of ", push.Commit, " to ", push.Ref, " in ", watched.name(), " by ", push.Pusher)
+		deliveriesTotal.WithLabelValues(DELIVERY_ACCEPTED).Inc()
+		job := enqueue(watched, push)
+		dr.Success = true
+		dr.Msg = fmt.Sprintf("Queued deployment of %s, see /jobs/%s", push.Commit, job.ID)
+		dr.Job = job.ID
 		drb, _ := json.Marshal(dr)
 		w.Header().Set("Content-Type", "application/javascript")
+		w.WriteHeader(http.StatusAccepted)
 		fmt.Fprint(w, string(drb))
-
+	}
+	mux.HandleFunc("/dploy", handleDelivery)
+	mux.HandleFunc("/dploy/", handleDelivery)
+	mux.HandleFunc("/watches", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			wb, _ := json.Marshal(watchStatus())
+			w.Header().Set("Content-Type", "application/javascript")
+			fmt.Fprint(w, string(wb))
+		case "POST":
+			wd := dploy.Watch{}
+			if err := json.NewDecoder(r.Body).Decode(&wd); err != nil {
+				writeResult(w, http.StatusBadRequest, "Can't decode watch")
+				return
+			}
+			watched, err := addWatch(WatchState{Watch: wd})
+			if err != nil {
+				log.WithFields(log.Fields{"handle": "/watches"}).Info("Can't add watch due to ", err)
+				writeResult(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeResult(w, http.StatusCreated, "Watching "+watched.name())
+		default:
+			writeResult(w, http.StatusMethodNotAllowed, "Watches can be listed via GET and added via POST")
+		}
+	}))
+	mux.HandleFunc("/watches/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			writeResult(w, http.StatusMethodNotAllowed, "Watches can be removed via DELETE")
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/watches/")
+		if _, ok := lookupWatch(name); !ok {
+			writeResult(w, http.StatusNotFound, "Not watching "+name)
+			return
+		}
+		if err := removeWatch(name); err != nil {
+			log.WithFields(log.Fields{"handle": "/watches"}).Error(err)
+			writeResult(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		writeResult(w, http.StatusOK, "Stopped watching "+name)
+	}))
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/history", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		hb, _ := json.Marshal(historySnapshot(r.URL.Query().Get("repo")))
+		w.Header().Set("Content-Type", "application/javascript")
+		fmt.Fprint(w, string(hb))
+	}))
+	mux.HandleFunc("/pending", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		pb, _ := json.Marshal(pendingPlans(r.URL.Query().Get("repo")))
+		w.Header().Set("Content-Type", "application/javascript")
+		fmt.Fprint(w, string(pb))
+	}))
+	mux.HandleFunc("/approve/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeResult(w, http.StatusMethodNotAllowed, "Approvals have to be POSTed")
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/approve/")
+		job, err := approve(id)
+		if err != nil {
+			log.WithFields(log.Fields{"handle": "/approve"}).Info(err)
+			status := http.StatusConflict
+			if job.ID == "" {
+				status = http.StatusNotFound
+			}
+			writeResult(w, status, err.Error())
+			return
+		}
+		jb, _ := json.Marshal(job)
+		w.Header().Set("Content-Type", "application/javascript")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, string(jb))
+	}))
+	// jobs are linked from deployments and commit statuses, so anyone may look them up:
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+		job, ok := lookupJob(id)
+		if !ok {
+			writeResult(w, http.StatusNotFound, "No such job "+id)
+			return
+		}
+		if !isAdmin(r) {
+			job = job.public()
+		}
+		jb, _ := json.Marshal(job)
+		w.Header().Set("Content-Type", "application/javascript")
+		fmt.Fprint(w, string(jb))
 	})
-	log.Fatal(http.ListenAndServe(":8888", mux))
+	if err := serve(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Tests
+
+func TestWriteResult(t *testing.T) {
+	results := []string{
+		"Watching mhausenblas/dploy",
+		`Can't register Webhook: {"message":"Validation Failed"}`,
+		`No such job ..\..\etc`,
+	}
+	for _, result := range results {
+		rec := httptest.NewRecorder()
+		writeResult(rec, http.StatusBadRequest, result)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", result, rec.Code, http.StatusBadRequest)
+		}
+		ar := AdminResult{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &ar); err != nil {
+			t.Errorf("%s: invalid JSON %s: %v", result, rec.Body.String(), err)
+			continue
+		}
+		if ar.Result != result {
+			t.Errorf("result is %q, want %q", ar.Result, result)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"time"
+)
+
+const (
+	// how often (in sec) to poll the trigger branch in poll mode:
+	DEFAULT_POLL_INTERVAL time.Duration = 60
+)
+
+// Periodically looks up the head of the watch's target branch and queues a deployment
+// whenever it changes, for clusters the SCM provider can't deliver Webhooks to, until
+// the watch is removed. Since only the head is known, neither tags nor
+// trigger_on_spec_changes apply.
+func poll(w *watch) {
+	etag := ""
+	interval := time.Duration(w.PollInterval)
+	jobMutex.Lock()
+	seen := w.lastCommit
+	jobMutex.Unlock()
+	log.WithFields(log.Fields{"poll": "start"}).Info("Polling branch ", w.TargetBranch, " of ", w.name(), " every ", interval, " sec")
+	for {
+		sha, newETag, err := w.scm.HeadSHA(w.TargetBranch, etag)
+		switch {
+		case err != nil:
+			log.WithFields(log.Fields{"poll": "head"}).Error("Can't look up head of ", w.TargetBranch, " due to ", err)
+		case sha == "":
+			log.WithFields(log.Fields{"poll": "head"}).Debug("Head of ", w.TargetBranch, " not modified")
+		case seen == "": // nothing deployed by the observer yet, so dploy run deployed what is there now
+			log.WithFields(log.Fields{"poll": "head"}).Info("Starting to observe ", w.TargetBranch, " at ", sha)
+			seen = sha
+		case sha != seen:
+			log.WithFields(log.Fields{"poll": "head"}).Info("Noticed push of ", sha, " to ", w.TargetBranch, " in ", w.name())
+			push := &Push{
+				Ref:    "refs/heads/" + w.TargetBranch,
+				Commit: sha,
+				Pusher: dploy.OBSERVER_MODE_POLL,
+			}
+			job := enqueue(w, push)
+			log.WithFields(log.Fields{"poll": "head"}).Info("Queued deployment of ", sha, " as job ", job.ID)
+			seen = sha
+		}
+		if err == nil {
+			etag = newETag
+		}
+		select {
+		case <-w.stop:
+			log.WithFields(log.Fields{"poll": "stop"}).Info("Stopped polling ", w.name())
+			return
+		case <-time.After(interval * time.Second):
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"reflect"
+	"testing"
+)
+
+// Helpers
+
+// polledSCM reports the heads in turn, failing for "error", and stops
+// the watch once there are no more; "" means the head wasn't modified
+type polledSCM struct {
+	SCMProvider
+	heads []string
+	etags []string
+	stop  chan bool
+}
+
+func (p *polledSCM) HeadSHA(branch string, etag string) (string, string, error) {
+	p.etags = append(p.etags, etag)
+	if len(p.heads) == 0 {
+		if p.stop != nil {
+			close(p.stop)
+			p.stop = nil
+		}
+		return "", etag, nil
+	}
+	head := p.heads[0]
+	p.heads = p.heads[1:]
+	switch head {
+	case "error":
+		return "", "", errors.New("rate limit exceeded")
+	case "":
+		return "", etag, nil
+	}
+	return head, "etag-" + head, nil
+}
+
+// Tests
+
+func TestPoll(t *testing.T) {
+	tests := []struct {
+		name     string
+		deployed string
+		heads    []string
+		queued   []string
+		etags    []string
+	}{
+		{"nothing deployed yet", "", []string{"4b825dc6", "", "4b825dc6", "9fceb02d"}, []string{"9fceb02d"}, []string{"", "etag-4b825dc6", "etag-4b825dc6", "etag-4b825dc6", "etag-9fceb02d"}},
+		{"deployed before", "4b825dc6", []string{"9fceb02d", "9fceb02d", "", "1e6e5ec1"}, []string{"9fceb02d", "1e6e5ec1"}, []string{"", "etag-9fceb02d", "etag-9fceb02d", "etag-9fceb02d", "etag-1e6e5ec1"}},
+		{"head not found", "4b825dc6", []string{"error", "4b825dc6", "error"}, []string{}, []string{"", "", "etag-4b825dc6", "etag-4b825dc6"}},
+	}
+	defer resetJobs()
+	for _, tt := range tests {
+		resetJobs()
+		stop := make(chan bool)
+		scm := &polledSCM{heads: tt.heads, stop: stop}
+		w := &watch{Watch: dploy.Watch{Owner: "mhausenblas", Repo: "poll", TargetBranch: "dcos"}, scm: scm, stop: stop, lastCommit: tt.deployed}
+		queues[w.name()] = &appQueue{running: true} // a deployment is in progress, so nothing gets picked up
+		poll(w)
+		jobMutex.Lock()
+		queued := []string{}
+		for _, id := range jobOrder {
+			job := jobs[id]
+			queued = append(queued, job.Commit)
+			if job.Pusher != dploy.OBSERVER_MODE_POLL || job.Ref != "refs/heads/dcos" {
+				t.Errorf("%s: queued %s pushed by %s to %s", tt.name, job.Commit, job.Pusher, job.Ref)
+			}
+		}
+		jobMutex.Unlock()
+		if !reflect.DeepEqual(queued, tt.queued) {
+			t.Errorf("%s: queued %v, want %v", tt.name, queued, tt.queued)
+		}
+		if len(scm.etags) < len(tt.etags) || !reflect.DeepEqual(scm.etags[:len(tt.etags)], tt.etags) {
+			t.Errorf("%s: polled with ETags %v, want %v", tt.name, scm.etags, tt.etags)
+		}
+	}
+}
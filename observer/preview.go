@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"strings"
+)
+
+// Returns the name of the preview environment of pull request number, which is
+// also the value of the dploy.MARATHON_LABEL_PREVIEW label of its apps
+func previewName(w *watch, number int) string {
+	return fmt.Sprintf("%s#%d", w.name(), number)
+}
+
+// Checks if a pull request qualifies for a preview environment. Since previews run
+// whatever app specs the head of the pull request contains with the credentials of
+// the observer, only pull requests into the target branch of the watch do, and only
+// if they come from a branch of the repo itself. Pull requests from forks only do if
+// the watch opts in to them and their author collaborates on the repo or is one of
+// the preview authors of the watch. If not, the reason why it's ignored is returned.
+func previewQualifies(w *watch, push *Push) string {
+	switch {
+	case push.Base != w.TargetBranch:
+		return fmt.Sprintf("Ignoring pull request %d into %s", push.PullRequest, push.Base)
+	case !push.Fork:
+		return ""
+	case !w.PreviewForks:
+		return fmt.Sprintf("Ignoring pull request %d from a fork", push.PullRequest)
+	case push.Closed: // tear down the preview environment, whoever opened the pull request
+		return ""
+	case push.Collaborator:
+		return ""
+	}
+	for _, author := range w.PreviewAuthors {
+		if push.Author != "" && strings.EqualFold(strings.TrimSpace(author), push.Author) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("Ignoring pull request %d from a fork by %s, who neither collaborates on the repo nor is a preview author", push.PullRequest, push.Author)
+}
+
+// Removes the preview environment of pull request number from Marathon
+func teardownPreview(w *watch, number int) ([]dploy.AppResult, error) {
+	preview := previewName(w, number)
+	marathon, err := marathonURL()
+	if err != nil {
+		return nil, err
+	}
+	results, success := dploy.TeardownPreview(marathon, preview, dploy.PreviewSuffix(number))
+	if !success {
+		return results, fmt.Errorf("Not able to tear down preview environment of %s", preview)
+	}
+	log.WithFields(log.Fields{"preview": "teardown"}).Info("Tore down preview environment of ", preview)
+	return results, nil
+}
+
+// Comments on the pull request of a finished job with the endpoints of its
+// preview environment or why it failed
+func commentPreview(w *watch, job Job) {
+	comment := ""
+	switch {
+	case job.Teardown && job.State == JOB_SUCCEEDED:
+		comment = "Tore down the preview environment."
+	case job.Teardown:
+		comment = fmt.Sprintf("Failed to tear down the preview environment: %s", job.Msg)
+	case job.State == JOB_SUCCEEDED:
+		comment = fmt.Sprintf("Deployed %s into the preview environment:\n", job.Commit)
+		for _, app := range job.Apps {
+			endpoints := app.Endpoints
+			if endpoints == "" {
+				endpoints = "no endpoints"
+			}
+			comment += fmt.Sprintf("\n- `%s`: %s", app.ID, endpoints)
+		}
+	default:
+		comment = fmt.Sprintf("Failed to deploy %s into the preview environment: %s", job.Commit, job.Msg)
+	}
+	comment += fmt.Sprintf("\n\nSee %s for details.", jobURL(job))
+	if err := w.scm.Comment(job.PullRequest, comment); err != nil {
+		log.WithFields(log.Fields{"preview": "comment"}).Error("Can't comment on pull request ", job.PullRequest, " due to ", err)
+	}
+}
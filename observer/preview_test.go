@@ -0,0 +1,45 @@
+package main
+
+import (
+	dploy "github.com/mhausenblas/dploy/lib"
+	"testing"
+)
+
+// Tests
+
+func TestEnqueuePreview(t *testing.T) {
+	resetJobs()
+	defer resetJobs()
+	w := &watch{Watch: dploy.Watch{Owner: "mhausenblas", Repo: "dploy", TargetBranch: "dcos", Previews: true}}
+	tests := []struct {
+		name     string
+		push     *Push
+		app      string
+		teardown bool
+	}{
+		{"push", &Push{Ref: "refs/heads/dcos", Commit: "4b825dc6"}, "mhausenblas/dploy", false},
+		{"pull request", &Push{Commit: "9fceb02d", PullRequest: 42}, "mhausenblas/dploy#42", false},
+		{"other pull request", &Push{Commit: "1e6e5ec1", PullRequest: 7}, "mhausenblas/dploy#7", false},
+		{"closed pull request", &Push{Commit: "9fceb02d", PullRequest: 42, Closed: true}, "mhausenblas/dploy#42", true},
+	}
+	for _, tt := range tests {
+		jobMutex.Lock()
+		queues[tt.app] = &appQueue{running: true} // a deployment is in progress, so nothing gets picked up
+		jobMutex.Unlock()
+		job := enqueue(w, tt.push)
+		if job.App != tt.app || job.Repo != w.name() || job.Teardown != tt.teardown {
+			t.Errorf("%s: queued for %s of %s (teardown %t), want %s of %s (teardown %t)", tt.name, job.App, job.Repo, job.Teardown, tt.app, w.name(), tt.teardown)
+		}
+		if job.PullRequest != 0 && previewName(w, job.PullRequest) != job.App {
+			t.Errorf("%s: queued for %s, but the preview environment is %s", tt.name, job.App, previewName(w, job.PullRequest))
+		}
+	}
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	if q := queues["mhausenblas/dploy#42"]; q.pending == nil || !q.pending.Teardown {
+		t.Error("teardown of pull request 42 didn't supersede its deployment")
+	}
+	if q := queues["mhausenblas/dploy#7"]; q.pending == nil || q.pending.Commit != "1e6e5ec1" {
+		t.Error("pull request 7 doesn't have a queue of its own")
+	}
+}
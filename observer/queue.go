@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how many jobs to keep around for the /jobs endpoint:
+	DEFAULT_JOB_RETENTION int = 100
+	// states a deployment job can be in:
+	JOB_QUEUED     string = "queued"
+	JOB_RUNNING    string = "running"
+	JOB_SUCCEEDED  string = "succeeded"
+	JOB_FAILED     string = "failed"
+	JOB_SUPERSEDED string = "superseded"
+	JOB_STAGED     string = "staged"
+	JOB_EXPIRED    string = "expired"
+	JOB_CANCELLED  string = "cancelled"
+)
+
+// Job is a deployment of a certain commit, triggered by a push
+type Job struct {
+	ID           string            `json:"id"`
+	Repo         string            `json:"repo"`
+	App          string            `json:"app"`
+	Ref          string            `json:"ref"`
+	Commit       string            `json:"commit"`
+	Pusher       string            `json:"pusher"`
+	Workspaces   []string          `json:"workspaces,omitempty"`
+	PullRequest  int               `json:"pull_request,omitempty"`
+	Teardown     bool              `json:"teardown,omitempty"`
+	Rollback     bool              `json:"rollback,omitempty"`
+	Approved     bool              `json:"approved,omitempty"`
+	State        string            `json:"state"`
+	Msg          string            `json:"message,omitempty"`
+	SupersededBy string            `json:"superseded_by,omitempty"`
+	Queued       time.Time         `json:"queued"`
+	Started      time.Time         `json:"started"`
+	Finished     time.Time         `json:"finished"`
+	Apps         []dploy.AppResult `json:"apps,omitempty"`
+	Plan         []dploy.AppResult `json:"plan,omitempty"`
+	Expires      time.Time         `json:"expires"`
+}
+
+// appQueue holds the next deployment of an app; since only the latest push
+// matters, a newly queued job supersedes the one waiting so far
+type appQueue struct {
+	pending *Job
+	running bool
+}
+
+var (
+	// all known jobs, by ID, and the order they have been queued in
+	jobs     map[string]*Job
+	jobOrder []string
+
+	// deployment queues, by app
+	queues map[string]*appQueue
+
+	// guards jobs, queues, staged, checkoutsInUse as well as the last deployment of watches
+	jobMutex sync.Mutex
+)
+
+func init() {
+	jobs = make(map[string]*Job)
+	queues = make(map[string]*appQueue)
+}
+
+// Returns what anyone may know about the job: its state and timestamps, but neither
+// its message nor the apps deployed or planned, which tell about the cluster
+func (job Job) public() Job {
+	job.Msg, job.Apps, job.Plan = "", nil, nil
+	return job
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Queues a deployment of the pushed commit for app, superseding any deployment
+// of app still waiting, and makes sure a worker is processing the queue of app.
+// Pull requests have their own queue per preview environment.
+func enqueue(w *watch, push *Push) Job {
+	app := w.name()
+	if push.PullRequest != 0 {
+		app = previewName(w, push.PullRequest)
+	}
+	job, superseded := queue(w, app, push)
+	go func() {
+		if superseded != nil {
+			reportSuperseded(w, *superseded)
+		}
+		reportQueued(w, job)
+	}()
+	return job
+}
+
+func queue(w *watch, app string, push *Push) (Job, *Job) {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	return queueLocked(w, app, push)
+}
+
+// Same as queue but expects the caller to hold jobMutex
+func queueLocked(w *watch, app string, push *Push) (Job, *Job) {
+	job := &Job{
+		ID:          newJobID(),
+		Repo:        w.name(),
+		App:         app,
+		Ref:         push.Ref,
+		Commit:      push.Commit,
+		Pusher:      push.Pusher,
+		Workspaces:  push.Workspaces,
+		PullRequest: push.PullRequest,
+		Teardown:    push.Closed,
+		Rollback:    push.Rollback,
+		State:       JOB_QUEUED,
+		Queued:      time.Now(),
+	}
+	remember(job)
+	superseded := schedule(app, job)
+	log.WithFields(log.Fields{"queue": "enqueue"}).Debug("Queued job ", job.ID, " for ", app)
+	return *job, superseded
+}
+
+// Keeps track of the job, forgetting about the oldest finished one once more than
+// DEFAULT_JOB_RETENTION jobs are known. Jobs that are queued, running or awaiting
+// approval are never forgotten. Expects the caller to hold jobMutex.
+func remember(job *Job) {
+	jobs[job.ID] = job
+	jobOrder = append(jobOrder, job.ID)
+	for i := 0; len(jobOrder) > DEFAULT_JOB_RETENTION && i < len(jobOrder); {
+		if !jobs[jobOrder[i]].done() {
+			i++
+			continue
+		}
+		delete(jobs, jobOrder[i])
+		jobOrder = append(jobOrder[:i], jobOrder[i+1:]...)
+	}
+}
+
+// Tells whether the job is done, one way or the other
+func (job *Job) done() bool {
+	switch job.State {
+	case JOB_SUCCEEDED, JOB_FAILED, JOB_SUPERSEDED, JOB_EXPIRED, JOB_CANCELLED:
+		return true
+	}
+	return false
+}
+
+// Makes the job the next one to run for the app, superseding the one waiting
+// so far, if any, and starts working on the queue if necessary. Expects the
+// caller to hold jobMutex.
+func schedule(app string, job *Job) *Job {
+	q, ok := queues[app]
+	if !ok {
+		q = &appQueue{}
+		queues[app] = q
+	}
+	var superseded *Job
+	if q.pending != nil {
+		log.WithFields(log.Fields{"queue": "enqueue"}).Info("Job ", q.pending.ID, " superseded by ", job.ID)
+		q.pending.State = JOB_SUPERSEDED
+		q.pending.SupersededBy = job.ID
+		q.pending.Finished = time.Now()
+		job.Workspaces = mergeWorkspaces(q.pending.Workspaces, job.Workspaces)
+		s := *q.pending
+		superseded = &s
+	}
+	q.pending = job
+	if !q.running {
+		q.running = true
+		go work(app)
+	}
+	return superseded
+}
+
+// Processes the deployments of app one at a time until there are no more waiting
+func work(app string) {
+	for {
+		jobMutex.Lock()
+		q := queues[app]
+		job := q.pending
+		if job == nil {
+			q.running = false
+			jobMutex.Unlock()
+			return
+		}
+		q.pending = nil
+		job.State = JOB_RUNNING
+		job.Started = time.Now()
+		commit := job.Commit
+		workspaces := job.Workspaces
+		pr, teardown := job.PullRequest, job.Teardown
+		w, watched := lookupWatch(job.Repo)
+		if !watched { // the watch has been removed since the job was queued
+			job.State = JOB_CANCELLED
+			job.Msg = fmt.Sprintf("No longer watching %s", job.Repo)
+			job.Finished = time.Now()
+			cancelled := *job
+			jobMutex.Unlock()
+			record(cancelled)
+			observeJob(cancelled)
+			log.WithFields(log.Fields{"queue": "work"}).Info("Job ", job.ID, " cancelled: ", cancelled.Msg)
+			continue
+		}
+		started := *job
+		staging := needsApproval(w, job)
+		jobMutex.Unlock()
+
+		if staging {
+			stage(w, job)
+			continue
+		}
+		log.WithFields(log.Fields{"queue": "work"}).Info("Running job ", job.ID, " deploying ", commit)
+		deploymentID := reportStarted(w, started)
+		if started.Rollback {
+			notify(w, EVENT_ROLLBACK, started)
+		} else {
+			notify(w, EVENT_STARTED, started)
+		}
+		var results []dploy.AppResult
+		var err error
+		switch {
+		case pr != 0 && teardown:
+			results, err = teardownPreview(w, pr)
+		case pr != 0:
+			results, err = deploy(w, commit, workspaces, func(workspace string, marathon string) ([]dploy.AppResult, bool) {
+				return dploy.DeployPreview(workspace, marathon, previewName(w, pr), dploy.PreviewSuffix(pr))
+			})
+		default:
+			results, err = deploy(w, commit, workspaces, dploy.UpgradeApps)
+		}
+
+		jobMutex.Lock()
+		job.Finished = time.Now()
+		job.Apps = results
+		if err != nil {
+			job.State = JOB_FAILED
+			job.Msg = err.Error()
+		} else {
+			job.State = JOB_SUCCEEDED
+			job.Msg = fmt.Sprintf("New version %s of %s deployed at %s", commit, w.name(), job.Finished)
+			if teardown {
+				job.Msg = fmt.Sprintf("Preview environment of %s torn down at %s", previewName(w, pr), job.Finished)
+			}
+			if pr == 0 {
+				w.lastDeployment = job.Finished
+				w.lastCommit = commit
+				persist()
+			}
+		}
+		finished := *job
+		rollback := rollbackAfter(w, finished)
+		jobMutex.Unlock()
+		record(finished)
+		observeJob(finished)
+		reportFinished(w, finished, deploymentID)
+		if pr != 0 {
+			commentPreview(w, finished)
+		}
+		if finished.State == JOB_FAILED {
+			notify(w, EVENT_FAILED, finished)
+		} else {
+			notify(w, EVENT_SUCCEEDED, finished)
+		}
+		if rollback != nil {
+			log.WithFields(log.Fields{"queue": "work"}).Info("Rolling back to ", rollback.Commit, " as job ", rollback.ID)
+			go reportQueued(w, *rollback)
+		}
+		log.WithFields(log.Fields{"queue": "work"}).Info("Job ", job.ID, " ", job.State)
+	}
+}
+
+// Pulls the commit and, for each dploy app in workspaces (or all of them if
+// nil), upgrades the app via the discovered Marathon, returning the outcome per µS
+func deploy(w *watch, commit string, workspaces []string, upgrade func(workspace string, marathon string) ([]dploy.AppResult, bool)) ([]dploy.AppResult, error) {
+	marathon, err := marathonURL()
+	if err != nil {
+		return nil, err
+	}
+	cwd, _ := os.Getwd()
+	root, checkout, err := pull(w, commit, cwd)
+	if err != nil {
+		return nil, fmt.Errorf("Not able to pull new version of %s due to %v", w.name(), err)
+	}
+	defer releaseCheckout(checkout)
+	log.WithFields(log.Fields{"queue": "deploy"}).Info("Pulled new version, resolving dploy apps")
+	apps := resolveWorkspaces(w, root, workspaces)
+	if len(apps) == 0 {
+		return nil, fmt.Errorf("No dploy app found in %s at %s", w.name(), commit)
+	}
+	results := []dploy.AppResult{}
+	failed := []string{}
+	for _, workspace := range apps {
+		log.WithFields(log.Fields{"queue": "deploy"}).Info("Updating via Marathon at ", marathon, " using workspace ", workspace)
+		r, success := upgrade(workspace, marathon)
+		results = mergeResults(results, r)
+		if !success {
+			rel, _ := filepath.Rel(root, workspace)
+			failed = append(failed, rel)
+		}
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("Not able to update all µS of %s to %s in %s", w.name(), commit, strings.Join(failed, ", "))
+	}
+	log.WithFields(log.Fields{"queue": "deploy"}).Info("Update successfully carried out")
+	return results, nil
+}
+
+// Appends the outcomes in r to results, replacing earlier outcomes of the same µS
+func mergeResults(results []dploy.AppResult, r []dploy.AppResult) []dploy.AppResult {
+	for _, ar := range r {
+		replaced := false
+		for i := range results {
+			if results[i].ID == ar.ID {
+				results[i] = ar
+				replaced = true
+			}
+		}
+		if !replaced {
+			results = append(results, ar)
+		}
+	}
+	return results
+}
+
+// Resolves workspaces within the checkout at root to the directories holding
+// a dploy app; if workspaces is nil all directories matching workspacePath are used
+func resolveWorkspaces(w *watch, root string, workspaces []string) []string {
+	candidates := []string{}
+	if workspaces == nil {
+		if w.WorkspacePath == "" {
+			candidates = append(candidates, root)
+		} else {
+			candidates, _ = filepath.Glob(filepath.Join(root, w.WorkspacePath))
+		}
+	} else {
+		for _, ws := range workspaces {
+			candidates = append(candidates, filepath.Join(root, ws))
+		}
+	}
+	apps := []string{}
+	for _, c := range candidates {
+		if _, err := os.Stat(filepath.Join(c, dploy.APP_DESCRIPTOR_FILENAME)); err != nil {
+			log.WithFields(log.Fields{"queue": "resolve"}).Debug("Skipping ", c, " since it doesn't contain a ", dploy.APP_DESCRIPTOR_FILENAME)
+			continue
+		}
+		apps = append(apps, c)
+	}
+	return apps
+}
+
+// Merges the workspaces of two jobs, where nil stands for all of them
+func mergeWorkspaces(a, b []string) []string {
+	if a == nil || b == nil {
+		return nil
+	}
+	merged := append([]string{}, a...)
+	for _, ws := range b {
+		found := false
+		for _, m := range merged {
+			if m == ws {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, ws)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// Checks if any deployment is running or waiting
+func deploying() bool {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	for _, q := range queues {
+		if q.running {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a snapshot of the job with id, if it exists
+func lookupJob(id string) (Job, bool) {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	job, ok := jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Queues the redeployment of the last successful commit if the job failed and
+// rollback_on_failure is set, unless a newer push is already waiting to be deployed.
+// Expects the caller to hold jobMutex.
+func rollbackAfter(w *watch, job Job) *Job {
+	if !w.RollbackOnFailure || job.State != JOB_FAILED || job.Rollback || job.PullRequest != 0 {
+		return nil
+	}
+	if w.lastCommit == "" || w.lastCommit == job.Commit || queues[job.App].pending != nil {
+		return nil
+	}
+	push := &Push{
+		Ref:        job.Ref,
+		Commit:     w.lastCommit,
+		Pusher:     EVENT_ROLLBACK,
+		Workspaces: job.Workspaces,
+		Rollback:   true,
+	}
+	rollback, _ := queueLocked(w, job.App, push)
+	return &rollback
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"strings"
+	"testing"
+)
+
+// Helpers
+
+// forgets about all jobs and queues
+func resetJobs() {
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	jobs = make(map[string]*Job)
+	jobOrder = nil
+	queues = make(map[string]*appQueue)
+}
+
+// Tests
+
+func TestQueueSupersedes(t *testing.T) {
+	resetJobs()
+	defer resetJobs()
+	w := &watch{Watch: dploy.Watch{Owner: "mhausenblas", Repo: "queue"}}
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	queues[w.name()] = &appQueue{running: true} // a deployment is in progress, so nothing gets picked up
+	first, superseded := queueLocked(w, w.name(), &Push{Ref: "refs/heads/dcos", Commit: "1", Workspaces: []string{"deploy/web"}})
+	if superseded != nil {
+		t.Errorf("first job superseded %s", superseded.ID)
+	}
+	second, superseded := queueLocked(w, w.name(), &Push{Ref: "refs/heads/dcos", Commit: "2", Workspaces: []string{"deploy/db"}})
+	if superseded == nil || superseded.ID != first.ID {
+		t.Fatalf("second job didn't supersede the first one")
+	}
+	if j := jobs[first.ID]; j.State != JOB_SUPERSEDED || j.SupersededBy != second.ID || j.Finished.IsZero() {
+		t.Errorf("superseded job is %s by %s", j.State, j.SupersededBy)
+	}
+	pending := queues[w.name()].pending
+	if pending.ID != second.ID || pending.State != JOB_QUEUED {
+		t.Errorf("pending job is %s (%s), want %s", pending.ID, pending.State, second.ID)
+	}
+	if got := strings.Join(pending.Workspaces, ","); got != "deploy/db,deploy/web" {
+		t.Errorf("pending job deploys %s, want the workspaces of both pushes", got)
+	}
+	if _, superseded := queueLocked(w, w.name(), &Push{Ref: "refs/heads/dcos", Commit: "3"}); superseded == nil || superseded.ID != second.ID {
+		t.Error("third job didn't supersede the second one")
+	}
+	if ws := queues[w.name()].pending.Workspaces; ws != nil {
+		t.Errorf("pending job deploys %v, want all workspaces", ws)
+	}
+}
+
+func TestRetentionKeepsUnfinishedJobs(t *testing.T) {
+	resetJobs()
+	defer resetJobs()
+	jobMutex.Lock()
+	defer jobMutex.Unlock()
+	running := &Job{ID: "running", State: JOB_RUNNING}
+	staged := &Job{ID: "staged", State: JOB_STAGED}
+	remember(running)
+	remember(staged)
+	for i := 0; i < DEFAULT_JOB_RETENTION; i++ {
+		remember(&Job{ID: fmt.Sprintf("done-%d", i), State: JOB_SUCCEEDED})
+	}
+	if len(jobOrder) != DEFAULT_JOB_RETENTION || len(jobs) != DEFAULT_JOB_RETENTION {
+		t.Errorf("keeping %d jobs in order, %d by ID, want %d", len(jobOrder), len(jobs), DEFAULT_JOB_RETENTION)
+	}
+	for _, id := range []string{"running", "staged"} {
+		if _, ok := jobs[id]; !ok {
+			t.Errorf("forgot about %s job", id)
+		}
+	}
+	if _, ok := jobs["done-0"]; ok {
+		t.Error("kept the oldest finished job")
+	}
+	if _, ok := jobs[fmt.Sprintf("done-%d", DEFAULT_JOB_RETENTION-1)]; !ok {
+		t.Error("forgot about the latest job")
+	}
+}
+
+func TestJobPublic(t *testing.T) {
+	job := Job{ID: "4b825dc6", State: JOB_FAILED, Msg: "Can't reach http://10.0.0.1:8080", Apps: []dploy.AppResult{{ID: "/web"}}, Plan: []dploy.AppResult{{ID: "/web"}}}
+	public := job.public()
+	if public.ID != job.ID || public.State != job.State {
+		t.Errorf("public job is %s in state %s, want %s in state %s", public.ID, public.State, job.ID, job.State)
+	}
+	if public.Msg != "" || public.Apps != nil || public.Plan != nil {
+		t.Errorf("public job tells about the cluster: %+v", public)
+	}
+	if job.Msg == "" || job.Apps == nil {
+		t.Error("public view changed the job itself")
+	}
+}
+
+func TestWorkCancelsUnwatched(t *testing.T) {
+	defer tempHistory()()
+	resetJobs()
+	defer resetJobs()
+	job := &Job{ID: "orphan", Repo: "mhausenblas/unwatched", App: "mhausenblas/unwatched", State: JOB_QUEUED}
+	jobMutex.Lock()
+	remember(job)
+	queues[job.App] = &appQueue{pending: job, running: true}
+	jobMutex.Unlock()
+	work(job.App)
+	if j, _ := lookupJob(job.ID); j.State != JOB_CANCELLED || j.Finished.IsZero() {
+		t.Errorf("job of unwatched repo is %s, want %s", j.State, JOB_CANCELLED)
+	}
+	if recorded := historySnapshot(job.Repo); len(recorded) != 1 || recorded[0].State != JOB_CANCELLED {
+		t.Errorf("cancelled job not recorded in the history: %+v", recorded)
+	}
+}
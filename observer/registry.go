@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watch is a repo the observer watches, along with the SCM provider hosting it
+// and the state of its deployments
+type watch struct {
+	dploy.Watch
+
+	// the SCM provider hosting the repo
+	scm SCMProvider
+
+	// time stamp and commit SHA of the last successful deployment; guarded by jobMutex
+	lastDeployment time.Time
+	lastCommit     string
+
+	// ID and URL of the registered Webhook; guarded by watchMutex
+	hookID  string
+	hookURL string
+
+	// closed when the watch is removed, to stop polling
+	stop chan bool
+}
+
+// WatchStatus is what the observer tells about a watch via /status and /watches
+type WatchStatus struct {
+	Owner        string    `json:"owner"`
+	Repo         string    `json:"repo"`
+	SCM          string    `json:"scm"`
+	Mode         string    `json:"mode"`
+	TargetBranch string    `json:"branch"`
+	LastDeploy   time.Time `json:"lastdeploy"`
+	LastCommit   string    `json:"lastcommit"`
+}
+
+var (
+	// the repos the observer watches, by OWNER/REPO
+	watches map[string]*watch
+
+	// guards watches
+	watchMutex sync.Mutex
+)
+
+func init() {
+	watches = make(map[string]*watch)
+}
+
+// OWNER/REPO of the watched repo, which identifies the watch
+func (w *watch) name() string {
+	return w.Owner + "/" + w.Repo
+}
+
+// Adds a watch of the repo and starts observing it, either by polling or by
+// registering a Webhook. The Webhook and last deployment are taken from ws when
+// restoring a watch from the persisted state; the Webhook only if it has been
+// registered with the same secret. An existing watch of the same repo is replaced,
+// keeping its deployment state.
+func addWatch(ws WatchState) (*watch, error) {
+	wd := ws.Watch
+	if wd.Owner == "" || wd.Repo == "" {
+		return nil, fmt.Errorf("Don't know which repo to watch since no owner or repo set")
+	}
+	if wd.TargetBranch == "" {
+		wd.TargetBranch = DEFAULT_OBSERVE_BRANCH
+	}
+	if wd.Mode == "" {
+		wd.Mode = dploy.OBSERVER_MODE_WEBHOOK
+	}
+	if wd.PollInterval <= 0 {
+		wd.PollInterval = int(DEFAULT_POLL_INTERVAL)
+	}
+	if wd.ApprovalExpiry <= 0 {
+		wd.ApprovalExpiry = int(DEFAULT_APPROVAL_EXPIRY)
+	}
+	if err := resolveSecrets(&wd); err != nil {
+		return nil, err
+	}
+	if wd.HookSecret == "" {
+		wd.HookSecret = hookSecret(wd)
+	}
+	provider, err := newSCMProvider(wd)
+	if err != nil {
+		return nil, err
+	}
+	w := &watch{Watch: wd, scm: provider, stop: make(chan bool)}
+	if ws.HookSecretDigest == digest(wd.HookSecret) {
+		w.hookID, w.hookURL = ws.HookID, ws.HookURL
+	}
+	w.lastDeployment, w.lastCommit = lastSuccess(w.name())
+	if ws.LastDeployment.After(w.lastDeployment) {
+		w.lastDeployment, w.lastCommit = ws.LastDeployment, ws.LastCommit
+	}
+	watchMutex.Lock()
+	previous := watches[w.name()]
+	watches[w.name()] = w
+	watchMutex.Unlock()
+	if previous != nil {
+		close(previous.stop)
+		jobMutex.Lock()
+		if previous.lastDeployment.After(w.lastDeployment) {
+			w.lastDeployment, w.lastCommit = previous.lastDeployment, previous.lastCommit
+		}
+		jobMutex.Unlock()
+		if previous.HookSecret == w.HookSecret {
+			watchMutex.Lock()
+			w.hookID, w.hookURL = previous.hookID, previous.hookURL
+			watchMutex.Unlock()
+		}
+	}
+	persist()
+	log.WithFields(log.Fields{"registry": "add"}).Info("Watching branch ", w.TargetBranch, " of ", w.name(), " hosted on ", provider.Name(), " in ", w.Mode, " mode")
+	if w.Mode == dploy.OBSERVER_MODE_POLL {
+		go poll(w)
+	} else {
+		go bootstrap(w)
+	}
+	return w, nil
+}
+
+// Resolves the secrets the watch references rather than carrying them, which are
+// environment variables of the observer such as DC/OS secrets Marathon injects
+func resolveSecrets(wd *dploy.Watch) error {
+	refs := []struct {
+		ref    string
+		secret *string
+	}{
+		{wd.PATRef, &wd.PAT},
+		{wd.AppKeyRef, &wd.AppKey},
+		{wd.SMTPPasswordRef, &wd.SMTPPassword},
+	}
+	for _, r := range refs {
+		if r.ref == "" {
+			continue
+		}
+		if !strings.HasPrefix(r.ref, dploy.OBSERVER_SECRET_ENV_PREFIX) {
+			return fmt.Errorf("Can't resolve %s since secrets have to be referenced via %s* environment variables", r.ref, dploy.OBSERVER_SECRET_ENV_PREFIX)
+		}
+		secret := os.Getenv(r.ref)
+		if secret == "" {
+			return fmt.Errorf("Can't resolve %s since the observer has no such environment variable", r.ref)
+		}
+		*r.secret = secret
+	}
+	return nil
+}
+
+// Removes the watch of the repo OWNER/REPO, unregistering its Webhook or stopping to poll
+func removeWatch(name string) error {
+	watchMutex.Lock()
+	w, ok := watches[name]
+	delete(watches, name)
+	watchMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("Not watching %s", name)
+	}
+	close(w.stop)
+	persist()
+	if w.Mode != dploy.OBSERVER_MODE_POLL {
+		if err := w.scm.UnregisterHook(); err != nil {
+			return fmt.Errorf("Stopped watching %s but can't unregister hook due to %s", name, err)
+		}
+	}
+	log.WithFields(log.Fields{"registry": "remove"}).Info("Stopped watching ", name)
+	return nil
+}
+
+// Looks up the watch of the repo OWNER/REPO
+func lookupWatch(name string) (*watch, bool) {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	w, ok := watches[name]
+	return w, ok
+}
+
+// Returns all watches, ordered by name
+func allWatches() []*watch {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	names := []string{}
+	for name := range watches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	all := []*watch{}
+	for _, name := range names {
+		all = append(all, watches[name])
+	}
+	return all
+}
+
+// Returns the status of all watches, leaving out secrets such as the token
+func watchStatus() []WatchStatus {
+	statuses := []WatchStatus{}
+	for _, w := range allWatches() {
+		jobMutex.Lock()
+		statuses = append(statuses, WatchStatus{
+			Owner:        w.Owner,
+			Repo:         w.Repo,
+			SCM:          w.scm.Name(),
+			Mode:         w.Mode,
+			TargetBranch: w.TargetBranch,
+			LastDeploy:   w.lastDeployment,
+			LastCommit:   w.lastCommit,
+		})
+		jobMutex.Unlock()
+	}
+	return statuses
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	dploy "github.com/mhausenblas/dploy/lib"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// Tests
+
+func TestWatchMultipleRepos(t *testing.T) {
+	defer tempHistory()()
+	// the watches poll the Gitea server, which fails so that they don't queue any deployments:
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	deployed := time.Date(2018, 6, 14, 23, 20, 16, 0, time.UTC)
+	tests := []struct {
+		owner, repo string
+		state       WatchState
+	}{
+		{"mhausenblas", "shop", WatchState{}},
+		{"mhausenblas", "blog", WatchState{LastDeployment: deployed, LastCommit: "9fceb02d"}},
+		{"octocat", "shop", WatchState{}},
+		{"mhausenblas", "shop", WatchState{Watch: dploy.Watch{TargetBranch: "production"}}}, // replaces the first one
+	}
+	for _, tt := range tests {
+		ws := tt.state
+		ws.Watch.Owner, ws.Watch.Repo = tt.owner, tt.repo
+		ws.Watch.SCM, ws.Watch.RepoURL = SCM_GITEA, server.URL+"/"+tt.owner+"/"+tt.repo
+		ws.Watch.Mode, ws.Watch.PollInterval = dploy.OBSERVER_MODE_POLL, 3600
+		if _, err := addWatch(ws); err != nil {
+			t.Fatalf("can't watch %s/%s: %v", tt.owner, tt.repo, err)
+		}
+	}
+	defer func() {
+		for _, name := range []string{"mhausenblas/blog", "mhausenblas/shop", "octocat/shop"} {
+			removeWatch(name)
+		}
+	}()
+	statuses := watchStatus()
+	names := []string{}
+	for _, s := range statuses {
+		names = append(names, s.Owner+"/"+s.Repo)
+	}
+	if len(names) != 3 || names[0] != "mhausenblas/blog" || names[1] != "mhausenblas/shop" || names[2] != "octocat/shop" {
+		t.Fatalf("watching %v, want mhausenblas/blog, mhausenblas/shop and octocat/shop", names)
+	}
+	if s := statuses[0]; s.LastCommit != "9fceb02d" || !s.LastDeploy.Equal(deployed) || s.SCM != SCM_GITEA {
+		t.Errorf("mhausenblas/blog last deployed %s at %s via %s, want 9fceb02d at %s via %s", s.LastCommit, s.LastDeploy, s.SCM, deployed, SCM_GITEA)
+	}
+	if s := statuses[1]; s.TargetBranch != "production" {
+		t.Errorf("mhausenblas/shop watches branch %s, want production", s.TargetBranch)
+	}
+	if s := statuses[2]; s.TargetBranch != DEFAULT_OBSERVE_BRANCH {
+		t.Errorf("octocat/shop watches branch %s, want %s", s.TargetBranch, DEFAULT_OBSERVE_BRANCH)
+	}
+	if err := removeWatch("octocat/shop"); err != nil {
+		t.Errorf("can't stop watching octocat/shop: %v", err)
+	}
+	if _, ok := lookupWatch("octocat/shop"); ok {
+		t.Error("still watching octocat/shop")
+	}
+	if _, ok := lookupWatch("mhausenblas/shop"); !ok {
+		t.Error("stopped watching mhausenblas/shop along with octocat/shop")
+	}
+	if err := removeWatch("octocat/shop"); err == nil {
+		t.Error("stopped watching octocat/shop twice")
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	os.Setenv(dploy.OBSERVER_SECRET_ENV_PREFIX+"PAT", "s3cr3t")
+	defer os.Unsetenv(dploy.OBSERVER_SECRET_ENV_PREFIX + "PAT")
+	tests := []struct {
+		name  string
+		ref   string
+		pat   string
+		fails bool
+	}{
+		{"no reference", "", "", false},
+		{"reference", dploy.OBSERVER_SECRET_ENV_PREFIX + "PAT", "s3cr3t", false},
+		{"unknown reference", dploy.OBSERVER_SECRET_ENV_PREFIX + "UNKNOWN", "", true},
+		{"other environment variable", "HOME", "", true},
+	}
+	for _, tt := range tests {
+		wd := dploy.Watch{PATRef: tt.ref}
+		err := resolveSecrets(&wd)
+		if (err != nil) != tt.fails || wd.PAT != tt.pat {
+			t.Errorf("%s: resolved %q (%v), want %q", tt.name, wd.PAT, err, tt.pat)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	github "github.com/google/go-github/github"
+	dploy "github.com/mhausenblas/dploy/lib"
+)
+
+const (
+	// the GitHub environment deployments are reported for:
+	DEFAULT_ENVIRONMENT string = "dcos"
+	// the context commit statuses are reported with:
+	STATUS_CONTEXT string = "dploy"
+)
+
+// Returns the GitHub environment a job deploys into
+func environment(job Job) string {
+	if job.PullRequest != 0 {
+		return DEFAULT_ENVIRONMENT + dploy.PreviewSuffix(job.PullRequest)
+	}
+	return DEFAULT_ENVIRONMENT
+}
+
+// Returns the URL under which the state of a job can be looked up, if known
+func jobURL(job Job) string {
+	loc, err := whereAmI()
+	if err != nil {
+		return ""
+	}
+	return loc + "/jobs/" + job.ID
+}
+
+// Returns the GitHub provider of the watch, if the repo is hosted on GitHub
+func gitHubOf(w *watch) (*gitHub, bool) {
+	gh, ok := w.scm.(*gitHub)
+	return gh, ok
+}
+
+// Reports a queued deployment as pending commit status
+func reportQueued(w *watch, job Job) {
+	reportCommitStatus(w, job, "pending", "Deployment queued")
+}
+
+// Reports a superseded deployment as errored commit status
+func reportSuperseded(w *watch, job Job) {
+	reportCommitStatus(w, job, "error", fmt.Sprintf("Superseded by deployment %s", job.SupersededBy))
+}
+
+// Reports a deployment awaiting approval as pending commit status
+func reportStaged(w *watch, job Job) {
+	reportCommitStatus(w, job, "pending", "Deployment awaiting approval")
+}
+
+// Reports a deployment that hasn't been approved in time as errored commit status
+func reportExpired(w *watch, job Job) {
+	reportCommitStatus(w, job, "error", "Approval of deployment expired")
+}
+
+// Creates a GitHub deployment for the job's commit, marks it as pending and
+// returns its ID, see https://developer.github.com/v3/repos/deployments/
+// Deployments are only reported for repos hosted on GitHub and not for teardowns.
+func reportStarted(w *watch, job Job) int64 {
+	gh, ok := gitHubOf(w)
+	if !ok || job.Teardown {
+		return 0
+	}
+	req := &github.DeploymentRequest{
+		Ref:              github.String(job.Commit),
+		Task:             github.String("deploy"),
+		AutoMerge:        github.Bool(false),
+		RequiredContexts: &[]string{},
+		Environment:      github.String(environment(job)),
+		Description:      github.String(fmt.Sprintf("dploy push-to-deploy of %s", job.Ref)),
+	}
+	deployment, _, err := gh.client.Repositories.CreateDeployment(context.Background(), gh.owner, gh.repo, req)
+	if err != nil {
+		log.WithFields(log.Fields{"report": "started"}).Error("Can't create GitHub deployment due to ", err)
+		return 0
+	}
+	reportDeploymentStatus(gh, job, *deployment.ID, "pending", "Deployment running")
+	reportCommitStatus(w, job, "pending", "Deployment running")
+	return *deployment.ID
+}
+
+// Reports the outcome of a finished job both as deployment and commit status
+func reportFinished(w *watch, job Job, deploymentID int64) {
+	state, description := "success", "Deployment succeeded"
+	if job.State != JOB_SUCCEEDED {
+		state, description = "failure", "Deployment failed"
+	}
+	if gh, ok := gitHubOf(w); ok && deploymentID != 0 {
+		reportDeploymentStatus(gh, job, deploymentID, state, description)
+	}
+	reportCommitStatus(w, job, state, description)
+}
+
+func reportDeploymentStatus(gh *gitHub, job Job, deploymentID int64, state string, description string) {
+	req := &github.DeploymentStatusRequest{
+		State:       github.String(state),
+		LogURL:      github.String(jobURL(job)),
+		Description: github.String(description),
+	}
+	if _, _, err := gh.client.Repositories.CreateDeploymentStatus(context.Background(), gh.owner, gh.repo, deploymentID, req); err != nil {
+		log.WithFields(log.Fields{"report": "deployment_status"}).Error("Can't create GitHub deployment status due to ", err)
+		return
+	}
+	log.WithFields(log.Fields{"report": "deployment_status"}).Debug("Reported deployment ", deploymentID, " as ", state)
+}
+
+// Sets the commit status, see https://developer.github.com/v3/repos/statuses/
+func reportCommitStatus(w *watch, job Job, state string, description string) {
+	gh, ok := gitHubOf(w)
+	if !ok || job.Teardown {
+		return
+	}
+	status := &github.RepoStatus{
+		State:       github.String(state),
+		TargetURL:   github.String(jobURL(job)),
+		Description: github.String(description),
+		Context:     github.String(STATUS_CONTEXT),
+	}
+	if _, _, err := gh.client.Repositories.CreateStatus(context.Background(), gh.owner, gh.repo, job.Commit, status); err != nil {
+		log.WithFields(log.Fields{"report": "commit_status"}).Error("Can't create GitHub commit status due to ", err)
+		return
+	}
+	log.WithFields(log.Fields{"report": "commit_status"}).Debug("Reported commit ", job.Commit, " as ", state)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	github "github.com/google/go-github/github"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// Helpers
+
+// starts a fake GitHub API recording the reports it gets as METHOD PATH STATE, returning
+// a watch of a repo hosted on it and the function to stop it. The observer is assumed to
+// be reachable at http://10.0.4.2:31001, so that reports link to the jobs.
+func fakeGitHub() (*watch, *[]string, func()) {
+	reports := []string{}
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := struct {
+			State string `json:"state"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&report)
+		mutex.Lock()
+		reports = append(reports, r.Method+" "+r.URL.Path+" "+report.State)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 42}`))
+	}))
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	gh := &gitHub{scmRepo: scmRepo{owner: "mhausenblas", repo: "dploy"}, client: client}
+	discoveryMutex.Lock()
+	discoveredSelf = "http://10.0.4.2:31001"
+	discoveryMutex.Unlock()
+	return &watch{scm: gh}, &reports, func() {
+		server.Close()
+		discoveryMutex.Lock()
+		discoveredSelf = ""
+		discoveryMutex.Unlock()
+	}
+}
+
+// Tests
+
+func TestEnvironment(t *testing.T) {
+	tests := []struct {
+		job  Job
+		want string
+	}{
+		{Job{Commit: "4b825dc6"}, "dcos"},
+		{Job{Commit: "4b825dc6", PullRequest: 42}, "dcos-pr42"},
+	}
+	for _, tt := range tests {
+		if got := environment(tt.job); got != tt.want {
+			t.Errorf("environment of pull request %d is %s, want %s", tt.job.PullRequest, got, tt.want)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	deployed := Job{ID: "1", Commit: "4b825dc6", State: JOB_SUCCEEDED}
+	failed := Job{ID: "2", Commit: "4b825dc6", State: JOB_FAILED}
+	teardown := Job{ID: "3", Commit: "4b825dc6", PullRequest: 42, Teardown: true, State: JOB_SUCCEEDED}
+	tests := []struct {
+		name    string
+		report  func(w *watch)
+		reports []string
+	}{
+		{"queued", func(w *watch) { reportQueued(w, deployed) }, []string{
+			"POST /repos/mhausenblas/dploy/statuses/4b825dc6 pending",
+		}},
+		{"started", func(w *watch) {
+			if id := reportStarted(w, deployed); id != 42 {
+				t.Errorf("started: reported GitHub deployment %d, want 42", id)
+			}
+		}, []string{
+			"POST /repos/mhausenblas/dploy/deployments ",
+			"POST /repos/mhausenblas/dploy/deployments/42/statuses pending",
+			"POST /repos/mhausenblas/dploy/statuses/4b825dc6 pending",
+		}},
+		{"succeeded", func(w *watch) { reportFinished(w, deployed, 42) }, []string{
+			"POST /repos/mhausenblas/dploy/deployments/42/statuses success",
+			"POST /repos/mhausenblas/dploy/statuses/4b825dc6 success",
+		}},
+		{"failed", func(w *watch) { reportFinished(w, failed, 42) }, []string{
+			"POST /repos/mhausenblas/dploy/deployments/42/statuses failure",
+			"POST /repos/mhausenblas/dploy/statuses/4b825dc6 failure",
+		}},
+		{"failed to start", func(w *watch) { reportFinished(w, failed, 0) }, []string{
+			"POST /repos/mhausenblas/dploy/statuses/4b825dc6 failure",
+		}},
+		{"teardown", func(w *watch) {
+			if id := reportStarted(w, teardown); id != 0 {
+				t.Errorf("teardown: reported GitHub deployment %d", id)
+			}
+			reportFinished(w, teardown, 0)
+		}, []string{}},
+	}
+	for _, tt := range tests {
+		w, reports, stop := fakeGitHub()
+		tt.report(w)
+		stop()
+		if !reflect.DeepEqual(*reports, tt.reports) {
+			t.Errorf("%s: reported %v, want %v", tt.name, *reports, tt.reports)
+		}
+	}
+}
+
+func TestReportLinksJob(t *testing.T) {
+	linked := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := github.RepoStatus{}
+		json.NewDecoder(r.Body).Decode(&status)
+		linked = status.GetTargetURL()
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	w, _, stop := fakeGitHub()
+	defer stop()
+	w.scm.(*gitHub).client.BaseURL, _ = url.Parse(server.URL + "/")
+	reportQueued(w, Job{ID: "1", Commit: "4b825dc6"})
+	if want := "http://10.0.4.2:31001/jobs/1"; linked != want {
+		t.Errorf("commit status links to %q, want %q", linked, want)
+	}
+}
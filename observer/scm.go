@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// the supported SCM providers:
+	SCM_GITHUB    string = "github"
+	SCM_GITLAB    string = "gitlab"
+	SCM_BITBUCKET string = "bitbucket"
+	SCM_GITEA     string = "gitea"
+	// commit SHA the SCM providers use to signal a deleted ref:
+	ZERO_SHA string = "0000000000000000000000000000000000000000"
+	// how many commits GitHub lists at most in the payload of a push:
+	GITHUB_PUSH_COMMITS_CAP int = 20
+)
+
+// returned by SCMProvider.Verify if a delivery doesn't carry a signature or token at all
+var errUnsigned = errors.New("Delivery is not signed")
+
+// Push is a push to the observed repo, independent of the SCM provider
+type Push struct {
+	Ref     string
+	Commit  string
+	Deleted bool
+	Pusher  string
+	// the files added, removed or modified; nil if the provider doesn't tell
+	Changed []string
+	// the workspaces of dploy apps within the repo touched by the push; nil for all
+	Workspaces []string
+	// the number of the pull request, if the push updates one
+	PullRequest int
+	// the branch the pull request is to be merged into
+	Base string
+	// the head of the pull request comes from another repo, typically a fork
+	Fork bool
+	// who opened the pull request and if the provider tells that they collaborate on the repo
+	Author       string
+	Collaborator bool
+	// the pull request has been closed or merged
+	Closed bool
+	// redeploys the last successful commit after a failed deployment
+	Rollback bool
+}
+
+// SCMProvider abstracts the source code management system hosting the observed repo
+type SCMProvider interface {
+	// Name of the provider, one of the SCM_* constants
+	Name() string
+	// Creates the Webhook pointing to deployURL, or updates it if it already exists
+	RegisterHook(deployURL string, secret string) error
+	// Deletes the Webhook, if it exists
+	UnregisterHook() error
+	// Looks up the Webhook, returning its ID and URL; the ID is empty if there's none
+	Hook() (string, string, error)
+	// Checks if a delivery is authentic, returns errUnsigned if it isn't signed at all
+	Verify(r *http.Request, body []byte, secret string) error
+	// The ID of a delivery as set by the provider, for logging; it's not signed
+	DeliveryID(r *http.Request) string
+	// Decodes a delivery into a Push per ref it updates; if it's not a push, the event
+	// type is returned instead
+	ParsePush(r *http.Request, body []byte) ([]*Push, string, error)
+	// Decodes a pull request being opened, updated or closed into a Push of its head;
+	// if it's not such a pull request event, the event type is returned instead
+	ParsePullRequest(r *http.Request, body []byte) (*Push, string, error)
+	// Comments on the pull request with number
+	Comment(number int, comment string) error
+	// Downloads a zip archive of the repo at ref (typically a commit SHA) into the file
+	// archive, authenticating with the token so that private repos work as well
+	Download(ref string, archive string) error
+	// Looks up the commit SHA at the head of branch along with the ETag of the response.
+	// If the head hasn't changed since the response with etag, the SHA is empty.
+	HeadSHA(branch string, etag string) (string, string, error)
+}
+
+// scmRepo is the repo an SCM provider instance talks to, along with the token to authenticate
+type scmRepo struct {
+	owner, repo, pat string
+}
+
+// Selects the SCM provider for the watched repo based on the host of the repo URL, unless
+// set explicitly, for example for self-hosted GitLab or Gitea instances
+func newSCMProvider(wd dploy.Watch) (SCMProvider, error) {
+	name := wd.SCM
+	u, err := url.Parse(wd.RepoURL)
+	if wd.RepoURL == "" || err != nil {
+		u = &url.URL{Scheme: "https", Host: "github.com"}
+	}
+	if name == "" {
+		switch host := strings.ToLower(u.Host); {
+		case strings.Contains(host, "gitlab"):
+			name = SCM_GITLAB
+		case strings.Contains(host, "bitbucket"):
+			name = SCM_BITBUCKET
+		case strings.Contains(host, "gitea"):
+			name = SCM_GITEA
+		default:
+			name = SCM_GITHUB
+		}
+	}
+	base := u.Scheme + "://" + u.Host
+	log.WithFields(log.Fields{"scm": "select"}).Debug("Using SCM provider ", name, " at ", base, " for ", wd.Owner, "/", wd.Repo)
+	r := scmRepo{owner: wd.Owner, repo: wd.Repo, pat: wd.PAT}
+	switch name {
+	case SCM_GITHUB:
+		tokens, err := gitHubTokenSource(wd)
+		if err != nil {
+			return nil, err
+		}
+		return newGitHub(r, tokens), nil
+	case SCM_GITLAB:
+		return &gitLab{scmRepo: r, base: base}, nil
+	case SCM_BITBUCKET:
+		return &bitbucket{scmRepo: r}, nil
+	case SCM_GITEA:
+		return &gitea{scmRepo: r, base: base}, nil
+	}
+	return nil, fmt.Errorf("Unknown SCM provider %s", name)
+}
+
+// Carries out a call against the REST API of an SCM provider, encoding in and decoding
+// the response into out as JSON, if not nil
+func scmCall(method string, callURL string, header map[string]string, in interface{}, out interface{}) error {
+	var body *bytes.Reader
+	if in != nil {
+		b, _ := json.Marshal(in)
+		body = bytes.NewReader(b)
+	} else {
+		body = bytes.NewReader([]byte{})
+	}
+	req, err := http.NewRequest(method, callURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := scmClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	c, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s failed with %s: %s", method, callURL, resp.Status, strings.TrimSpace(string(c)))
+	}
+	if out != nil && len(c) > 0 {
+		return json.Unmarshal(c, out)
+	}
+	return nil
+}
+
+// Downloads the resource at callURL into the file archive
+func scmDownload(callURL string, header map[string]string, archive string) error {
+	req, err := http.NewRequest("GET", callURL, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := scmClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("GET %s failed with %s", callURL, resp.Status)
+	}
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"scm": "download"}).Debug("Downloaded ", callURL, " into ", archive)
+	return nil
+}
+
+// Carries out a conditional GET against the REST API of an SCM provider, see
+// https://developer.github.com/v3/#conditional-requests; returns the response body,
+// which is nil if the resource hasn't changed since etag, along with its ETag
+func scmConditionalGet(callURL string, header map[string]string, etag string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", callURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := scmClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+	c, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("GET %s failed with %s: %s", callURL, resp.Status, strings.TrimSpace(string(c)))
+	}
+	return c, resp.Header.Get("ETag"), nil
+}
+
+// Checks if a Webhook points to an observer, either to the /dploy endpoint of
+// a single repo observer or to the one of a watch, /dploy/OWNER/REPO
+func isDployHook(hookURL string) bool {
+	return strings.HasSuffix(hookURL, "/dploy") || strings.Contains(hookURL, "/dploy/")
+}
+
+// Returns the ref of the head of pull request number
+func pullRequestRef(number int) string {
+	return fmt.Sprintf("refs/pull/%d/head", number)
+}
+
+// Collects the files changed by a list of commits
+func changedFiles(lists ...[]string) []string {
+	changed := []string{}
+	for _, l := range lists {
+		changed = append(changed, l...)
+	}
+	return changed
+}
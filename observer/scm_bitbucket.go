@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	BITBUCKET_API string = "https://api.bitbucket.org/2.0"
+)
+
+// bitbucket implements SCMProvider for bitbucket.org,
+// see https://developer.atlassian.com/cloud/bitbucket/rest/api-group-repositories/#api-group-webhooks
+type bitbucket struct {
+	scmRepo
+}
+
+type bitbucketHooks struct {
+	Values []struct {
+		UUID string `json:"uuid"`
+		URL  string `json:"url"`
+	} `json:"values"`
+}
+
+type bitbucketRef struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target struct {
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+// the source or destination of a pull request
+type bitbucketEndpoint struct {
+	Branch struct {
+		Name string `json:"name"`
+	} `json:"branch"`
+	Commit struct {
+		Hash string `json:"hash"`
+	} `json:"commit"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// the subset of the payload of a Bitbucket push event the observer needs, see
+// https://support.atlassian.com/bitbucket-cloud/docs/event-payloads/#Push
+type bitbucketPushEvent struct {
+	Actor struct {
+		DisplayName string `json:"display_name"`
+	} `json:"actor"`
+	Push struct {
+		Changes []struct {
+			New *bitbucketRef `json:"new"`
+			Old *bitbucketRef `json:"old"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+// the subset of the payload of a Bitbucket pull request event the observer needs, see
+// https://support.atlassian.com/bitbucket-cloud/docs/event-payloads/#Pull-request-events
+type bitbucketPullRequestEvent struct {
+	Actor struct {
+		DisplayName string `json:"display_name"`
+	} `json:"actor"`
+	PullRequest struct {
+		ID     int `json:"id"`
+		Author struct {
+			Nickname string `json:"nickname"`
+		} `json:"author"`
+		Source      bitbucketEndpoint `json:"source"`
+		Destination bitbucketEndpoint `json:"destination"`
+	} `json:"pullrequest"`
+}
+
+func (bb *bitbucket) Name() string {
+	return SCM_BITBUCKET
+}
+
+func (bb *bitbucket) hooksURL() string {
+	return BITBUCKET_API + "/repositories/" + bb.owner + "/" + bb.repo + "/hooks"
+}
+
+func (bb *bitbucket) header() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + bb.pat}
+}
+
+func (bb *bitbucket) Hook() (string, string, error) {
+	hooks := bitbucketHooks{}
+	if err := scmCall("GET", bb.hooksURL(), bb.header(), nil, &hooks); err != nil {
+		log.WithFields(log.Fields{"hook": "check"}).Error("Can't query hooks due to ", err)
+		return "", "", err
+	}
+	for _, hook := range hooks.Values {
+		if isDployHook(hook.URL) {
+			return hook.UUID, hook.URL, nil
+		}
+	}
+	return "", "", nil
+}
+
+func (bb *bitbucket) RegisterHook(deployURL string, secret string) error {
+	hook := map[string]interface{}{
+		"description": "dploy observer",
+		"url":         deployURL,
+		"active":      true,
+		"events":      []string{"repo:push", "pullrequest:created", "pullrequest:updated", "pullrequest:fulfilled", "pullrequest:rejected"},
+		"secret":      secret,
+	}
+	hid, _, err := bb.Hook()
+	if err != nil {
+		return err
+	}
+	if hid != "" {
+		return scmCall("PUT", bb.hooksURL()+"/"+hid, bb.header(), hook, nil)
+	}
+	return scmCall("POST", bb.hooksURL(), bb.header(), hook, nil)
+}
+
+func (bb *bitbucket) UnregisterHook() error {
+	hid, _, err := bb.Hook()
+	if err != nil || hid == "" {
+		return err
+	}
+	return scmCall("DELETE", bb.hooksURL()+"/"+hid, bb.header(), nil, nil)
+}
+
+// Checks the X-Hub-Signature HMAC Bitbucket sends for Webhooks with a secret
+func (bb *bitbucket) Verify(r *http.Request, body []byte, secret string) error {
+	sig := r.Header.Get("X-Hub-Signature")
+	if sig == "" {
+		return errUnsigned
+	}
+	if !hmac.Equal([]byte(sig), []byte("sha256="+signature(secret, body))) {
+		return fmt.Errorf("Delivery signature doesn't match")
+	}
+	return nil
+}
+
+func (bb *bitbucket) DeliveryID(r *http.Request) string {
+	return r.Header.Get("X-Request-UUID")
+}
+
+// A single push to Bitbucket can update several branches and tags, each of which is
+// listed as a change. Bitbucket doesn't list the files changed, so Push.Changed remains nil.
+func (bb *bitbucket) ParsePush(r *http.Request, body []byte) ([]*Push, string, error) {
+	event := r.Header.Get("X-Event-Key")
+	if event != "repo:push" {
+		return nil, event, nil
+	}
+	pe := bitbucketPushEvent{}
+	if err := json.Unmarshal(body, &pe); err != nil {
+		return nil, event, err
+	}
+	pushes := []*Push{}
+	for _, change := range pe.Push.Changes {
+		ref := change.New
+		if ref == nil { // the branch or tag has been deleted
+			ref = change.Old
+		}
+		if ref == nil {
+			continue
+		}
+		push := &Push{
+			Ref:     "refs/heads/" + ref.Name,
+			Commit:  ref.Target.Hash,
+			Deleted: change.New == nil,
+			Pusher:  pe.Actor.DisplayName,
+		}
+		if ref.Type == "tag" {
+			push.Ref = "refs/tags/" + ref.Name
+		}
+		pushes = append(pushes, push)
+	}
+	if len(pushes) == 0 {
+		return nil, event, fmt.Errorf("Push doesn't contain any changes")
+	}
+	return pushes, event, nil
+}
+
+func (bb *bitbucket) Download(ref string, archive string) error {
+	return scmDownload("https://bitbucket.org/"+bb.owner+"/"+bb.repo+"/get/"+ref+".zip", bb.header(), archive)
+}
+
+func (bb *bitbucket) HeadSHA(branch string, etag string) (string, string, error) {
+	c, etag, err := scmConditionalGet(BITBUCKET_API+"/repositories/"+bb.owner+"/"+bb.repo+"/refs/branches/"+url.PathEscape(branch), bb.header(), etag)
+	if err != nil || c == nil {
+		return "", etag, err
+	}
+	ref := bitbucketRef{}
+	if err := json.Unmarshal(c, &ref); err != nil {
+		return "", "", err
+	}
+	return ref.Target.Hash, etag, nil
+}
+
+func (bb *bitbucket) ParsePullRequest(r *http.Request, body []byte) (*Push, string, error) {
+	event := r.Header.Get("X-Event-Key")
+	switch event {
+	case "pullrequest:created", "pullrequest:updated", "pullrequest:fulfilled", "pullrequest:rejected":
+	default:
+		return nil, event, nil
+	}
+	pe := bitbucketPullRequestEvent{}
+	if err := json.Unmarshal(body, &pe); err != nil {
+		return nil, event, err
+	}
+	pr := pe.PullRequest
+	return &Push{
+		Ref:         pullRequestRef(pr.ID),
+		Commit:      pr.Source.Commit.Hash,
+		Pusher:      pe.Actor.DisplayName,
+		PullRequest: pr.ID,
+		Closed:      event == "pullrequest:fulfilled" || event == "pullrequest:rejected",
+		Base:        pr.Destination.Branch.Name,
+		Fork:        !strings.EqualFold(pr.Source.Repository.FullName, pr.Destination.Repository.FullName),
+		Author:      pr.Author.Nickname,
+	}, event, nil
+}
+
+func (bb *bitbucket) Comment(number int, comment string) error {
+	c := map[string]interface{}{"content": map[string]string{"raw": comment}}
+	return scmCall("POST", BITBUCKET_API+"/repositories/"+bb.owner+"/"+bb.repo+"/pullrequests/"+strconv.Itoa(number)+"/comments", bb.header(), c, nil)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// gitea implements SCMProvider for Gitea instances at base,
+// see https://try.gitea.io/api/swagger#/repository/repoListHooks
+type gitea struct {
+	scmRepo
+	base string
+}
+
+type giteaHook struct {
+	ID     int               `json:"id"`
+	Config map[string]string `json:"config"`
+}
+
+// the subset of the payload of a Gitea push event the observer needs
+type giteaPushEvent struct {
+	Ref   string `json:"ref"`
+	After string `json:"after"`
+	// Gitea lists a limited number of commits, this is the number of commits pushed
+	TotalCommits int `json:"total_commits"`
+	Commits      []struct {
+		Added    []string `json:"added"`
+		Removed  []string `json:"removed"`
+		Modified []string `json:"modified"`
+	} `json:"commits"`
+	Pusher struct {
+		Login string `json:"login"`
+	} `json:"pusher"`
+}
+
+// the subset of the payload of a Gitea pull request event the observer needs
+type giteaPullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		Head struct {
+			SHA    string `json:"sha"`
+			RepoID int    `json:"repo_id"`
+		} `json:"head"`
+		Base struct {
+			Ref    string `json:"ref"`
+			RepoID int    `json:"repo_id"`
+		} `json:"base"`
+	} `json:"pull_request"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+}
+
+func (gt *gitea) Name() string {
+	return SCM_GITEA
+}
+
+func (gt *gitea) hooksURL() string {
+	return gt.base + "/api/v1/repos/" + gt.owner + "/" + gt.repo + "/hooks"
+}
+
+func (gt *gitea) header() map[string]string {
+	return map[string]string{"Authorization": "token " + gt.pat}
+}
+
+func (gt *gitea) Hook() (string, string, error) {
+	hooks := []giteaHook{}
+	if err := scmCall("GET", gt.hooksURL(), gt.header(), nil, &hooks); err != nil {
+		log.WithFields(log.Fields{"hook": "check"}).Error("Can't query hooks due to ", err)
+		return "", "", err
+	}
+	for _, hook := range hooks {
+		if isDployHook(hook.Config["url"]) {
+			return strconv.Itoa(hook.ID), hook.Config["url"], nil
+		}
+	}
+	return "", "", nil
+}
+
+func (gt *gitea) RegisterHook(deployURL string, secret string) error {
+	hook := map[string]interface{}{
+		"type": "gitea",
+		"config": map[string]string{
+			"url":          deployURL,
+			"content_type": "json",
+			"secret":       secret,
+		},
+		"events": []string{"push", "pull_request"},
+		"active": true,
+	}
+	hid, _, err := gt.Hook()
+	if err != nil {
+		return err
+	}
+	if hid != "" {
+		return scmCall("PATCH", gt.hooksURL()+"/"+hid, gt.header(), hook, nil)
+	}
+	return scmCall("POST", gt.hooksURL(), gt.header(), hook, nil)
+}
+
+func (gt *gitea) UnregisterHook() error {
+	hid, _, err := gt.Hook()
+	if err != nil || hid == "" {
+		return err
+	}
+	return scmCall("DELETE", gt.hooksURL()+"/"+hid, gt.header(), nil, nil)
+}
+
+// Checks the X-Gitea-Signature HMAC, which is hex encoded without a prefix
+func (gt *gitea) Verify(r *http.Request, body []byte, secret string) error {
+	sig := r.Header.Get("X-Gitea-Signature")
+	if sig == "" {
+		return errUnsigned
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, body))) {
+		return fmt.Errorf("Delivery signature doesn't match")
+	}
+	return nil
+}
+
+func (gt *gitea) DeliveryID(r *http.Request) string {
+	return r.Header.Get("X-Gitea-Delivery")
+}
+
+func (gt *gitea) ParsePush(r *http.Request, body []byte) ([]*Push, string, error) {
+	event := r.Header.Get("X-Gitea-Event")
+	if event != "push" {
+		return nil, event, nil
+	}
+	pe := giteaPushEvent{}
+	if err := json.Unmarshal(body, &pe); err != nil {
+		return nil, event, err
+	}
+	push := &Push{
+		Ref:     pe.Ref,
+		Commit:  pe.After,
+		Deleted: pe.After == ZERO_SHA,
+		Pusher:  pe.Pusher.Login,
+		Changed: []string{},
+	}
+	for _, c := range pe.Commits {
+		push.Changed = append(push.Changed, changedFiles(c.Added, c.Removed, c.Modified)...)
+	}
+	if pe.TotalCommits > len(pe.Commits) { // not all commits are listed, so the files changed aren't known
+		push.Changed = nil
+	}
+	return []*Push{push}, event, nil
+}
+
+func (gt *gitea) Download(ref string, archive string) error {
+	return scmDownload(gt.base+"/api/v1/repos/"+gt.owner+"/"+gt.repo+"/archive/"+ref+".zip", gt.header(), archive)
+}
+
+func (gt *gitea) HeadSHA(branch string, etag string) (string, string, error) {
+	c, etag, err := scmConditionalGet(gt.base+"/api/v1/repos/"+gt.owner+"/"+gt.repo+"/branches/"+url.PathEscape(branch), gt.header(), etag)
+	if err != nil || c == nil {
+		return "", etag, err
+	}
+	b := struct {
+		Commit struct {
+			ID string `json:"id"`
+		} `json:"commit"`
+	}{}
+	if err := json.Unmarshal(c, &b); err != nil {
+		return "", "", err
+	}
+	return b.Commit.ID, etag, nil
+}
+
+func (gt *gitea) ParsePullRequest(r *http.Request, body []byte) (*Push, string, error) {
+	event := r.Header.Get("X-Gitea-Event")
+	if event != "pull_request" {
+		return nil, event, nil
+	}
+	pe := giteaPullRequestEvent{}
+	if err := json.Unmarshal(body, &pe); err != nil {
+		return nil, event, err
+	}
+	switch pe.Action {
+	case "opened", "reopened", "synchronized", "closed":
+		pr := pe.PullRequest
+		return &Push{
+			Ref:         pullRequestRef(pe.Number),
+			Commit:      pr.Head.SHA,
+			Pusher:      pe.Sender.Login,
+			PullRequest: pe.Number,
+			Closed:      pe.Action == "closed",
+			Base:        pr.Base.Ref,
+			Fork:        pr.Head.RepoID != pr.Base.RepoID,
+			Author:      pr.User.Login,
+		}, event, nil
+	}
+	return nil, event + " " + pe.Action, nil
+}
+
+func (gt *gitea) Comment(number int, comment string) error {
+	c := map[string]string{"body": comment}
+	return scmCall("POST", gt.base+"/api/v1/repos/"+gt.owner+"/"+gt.repo+"/issues/"+strconv.Itoa(number)+"/comments", gt.header(), c, nil)
+}
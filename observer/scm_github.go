@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	github "github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	GITHUB_API string = "https://api.github.com"
+)
+
+// gitHub implements SCMProvider for github.com, using the go-github client set up in auth()
+type gitHub struct {
+	scmRepo
+	// the tokens to authenticate with, of the personal access token or the GitHub App
+	tokens oauth2.TokenSource
+	client *github.Client
+}
+
+// the subset of the payload of a GitHub push event the observer needs,
+// see https://developer.github.com/v3/activity/events/types/#pushevent
+type gitHubPushEvent struct {
+	Ref     string `json:"ref"`
+	After   string `json:"after"`
+	Deleted bool   `json:"deleted"`
+	Size    int    `json:"size"`
+	Commits []struct {
+		Added    []string `json:"added"`
+		Removed  []string `json:"removed"`
+		Modified []string `json:"modified"`
+	} `json:"commits"`
+	Pusher struct {
+		Name string `json:"name"`
+	} `json:"pusher"`
+}
+
+// the subset of the payload of a GitHub pull request event the observer needs,
+// see https://developer.github.com/v3/activity/events/types/#pullrequestevent
+type gitHubPullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		AuthorAssociation string `json:"author_association"`
+		Head              struct {
+			SHA  string `json:"sha"`
+			Repo *struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"head"`
+		Base struct {
+			Ref  string `json:"ref"`
+			Repo struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"base"`
+	} `json:"pull_request"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+}
+
+func newGitHub(r scmRepo, tokens oauth2.TokenSource) *gitHub {
+	return &gitHub{scmRepo: r, tokens: tokens, client: auth(tokens)}
+}
+
+func (gh *gitHub) Name() string {
+	return SCM_GITHUB
+}
+
+func (gh *gitHub) header() map[string]string {
+	t, err := gh.tokens.Token()
+	if err != nil {
+		log.WithFields(log.Fields{"auth": "token"}).Error("Can't get token to authenticate against GitHub due to ", err)
+		return map[string]string{}
+	}
+	return map[string]string{"Authorization": "token " + t.AccessToken}
+}
+
+// Checks if a Webhook already exists
+func (gh *gitHub) Hook() (string, string, error) {
+	opt := &github.ListOptions{Page: 1}
+	hooks, _, err := gh.client.Repositories.ListHooks(context.Background(), gh.owner, gh.repo, opt)
+	if err != nil {
+		log.WithFields(log.Fields{"hook": "check"}).Error("Can't query hooks due to ", err)
+		return "", "", err
+	}
+	for _, hook := range hooks {
+		log.WithFields(log.Fields{"hook": "check"}).Debug("Looking at hook ", *hook.ID)
+		url, _ := hook.Config["url"].(string)
+		if isDployHook(url) {
+			return strconv.FormatInt(*hook.ID, 10), url, nil
+		}
+	}
+	return "", "", nil
+}
+
+// Registers a Webhook using https://developer.github.com/v3/repos/hooks
+func (gh *gitHub) RegisterHook(deployURL string, secret string) error {
+	deployHook := new(github.Hook)
+	hookType := "web"
+	deployHook.Name = new(string)
+	deployHook.Name = &hookType
+	deployHook.Config = make(map[string]interface{})
+	deployHook.Config["url"] = deployURL
+	deployHook.Config["content_type"] = "json"
+	deployHook.Config["secret"] = secret
+	deployHook.Events = []string{"push", "pull_request"}
+	enableHook := true
+	deployHook.Active = new(bool)
+	deployHook.Active = &enableHook
+	hid, _, err := gh.Hook()
+	if err != nil {
+		return err
+	}
+	if hid != "" {
+		id, _ := strconv.ParseInt(hid, 10, 64)
+		_, _, err := gh.client.Repositories.EditHook(context.Background(), gh.owner, gh.repo, id, deployHook)
+		return err
+	}
+	// see https://github.com/google/go-github/blob/master/github/repos_hooks.go
+	// for details on WebHookPayload
+	whp, _, err := gh.client.Repositories.CreateHook(context.Background(), gh.owner, gh.repo, deployHook)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"observe": "register"}).Debug("Registered WebHook ", *whp.ID)
+	return nil
+}
+
+func (gh *gitHub) UnregisterHook() error {
+	hid, _, err := gh.Hook()
+	if err != nil || hid == "" {
+		return err
+	}
+	log.WithFields(log.Fields{"observe": "unregister"}).Debug("Hook with ID ", hid)
+	id, _ := strconv.ParseInt(hid, 10, 64)
+	_, err = gh.client.Repositories.DeleteHook(context.Background(), gh.owner, gh.repo, id)
+	return err
+}
+
+// Checks the X-Hub-Signature-256 HMAC, see https://developer.github.com/webhooks/securing/
+func (gh *gitHub) Verify(r *http.Request, body []byte, secret string) error {
+	sig := r.Header.Get("X-Hub-Signature-256")
+	if sig == "" {
+		return errUnsigned
+	}
+	if !hmac.Equal([]byte(sig), []byte("sha256="+signature(secret, body))) {
+		return fmt.Errorf("Delivery signature doesn't match")
+	}
+	return nil
+}
+
+func (gh *gitHub) DeliveryID(r *http.Request) string {
+	return r.Header.Get("X-GitHub-Delivery")
+}
+
+func (gh *gitHub) ParsePush(r *http.Request, body []byte) ([]*Push, string, error) {
+	event := r.Header.Get("X-GitHub-Event")
+	if event != "push" {
+		return nil, event, nil
+	}
+	pe := gitHubPushEvent{}
+	if err := json.Unmarshal(body, &pe); err != nil {
+		return nil, event, err
+	}
+	push := &Push{
+		Ref:     pe.Ref,
+		Commit:  pe.After,
+		Deleted: pe.Deleted || pe.After == ZERO_SHA,
+		Pusher:  pe.Pusher.Name,
+		Changed: []string{},
+	}
+	for _, c := range pe.Commits {
+		push.Changed = append(push.Changed, changedFiles(c.Added, c.Removed, c.Modified)...)
+	}
+	if len(pe.Commits) >= GITHUB_PUSH_COMMITS_CAP || pe.Size > len(pe.Commits) {
+		// the list of commits may be truncated, so the files changed by the push aren't known:
+		log.WithFields(log.Fields{"scm": "parse"}).Info("Push to ", pe.Ref, " may contain more than the ", len(pe.Commits), " commits listed, considering all files changed")
+		push.Changed = nil
+	}
+	return []*Push{push}, event, nil
+}
+
+// Uses the zipball endpoint, see https://developer.github.com/v3/repos/contents/#get-archive-link
+func (gh *gitHub) Download(ref string, archive string) error {
+	return scmDownload(GITHUB_API+"/repos/"+gh.owner+"/"+gh.repo+"/zipball/"+ref, gh.header(), archive)
+}
+
+// Uses the plain REST API rather than go-github to be able to send If-None-Match,
+// since conditional requests answered with 304 don't count against the rate limit
+func (gh *gitHub) HeadSHA(branch string, etag string) (string, string, error) {
+	header := gh.header()
+	header["Accept"] = "application/vnd.github.VERSION.sha"
+	c, etag, err := scmConditionalGet(GITHUB_API+"/repos/"+gh.owner+"/"+gh.repo+"/commits/"+branch, header, etag)
+	if err != nil || c == nil {
+		return "", etag, err
+	}
+	return strings.TrimSpace(string(c)), etag, nil
+}
+
+func (gh *gitHub) ParsePullRequest(r *http.Request, body []byte) (*Push, string, error) {
+	event := r.Header.Get("X-GitHub-Event")
+	if event != "pull_request" {
+		return nil, event, nil
+	}
+	pe := gitHubPullRequestEvent{}
+	if err := json.Unmarshal(body, &pe); err != nil {
+		return nil, event, err
+	}
+	switch pe.Action {
+	case "opened", "reopened", "synchronize", "closed":
+		pr := pe.PullRequest
+		// the head repo is null if the fork has been deleted in the meantime:
+		fork := pr.Head.Repo == nil || !strings.EqualFold(pr.Head.Repo.FullName, pr.Base.Repo.FullName)
+		return &Push{
+			Ref:          pullRequestRef(pe.Number),
+			Commit:       pr.Head.SHA,
+			Pusher:       pe.Sender.Login,
+			PullRequest:  pe.Number,
+			Closed:       pe.Action == "closed",
+			Base:         pr.Base.Ref,
+			Fork:         fork,
+			Author:       pr.User.Login,
+			Collaborator: pr.AuthorAssociation == "OWNER" || pr.AuthorAssociation == "MEMBER" || pr.AuthorAssociation == "COLLABORATOR",
+		}, event, nil
+	}
+	return nil, event + " " + pe.Action, nil
+}
+
+func (gh *gitHub) Comment(number int, comment string) error {
+	_, _, err := gh.client.Issues.CreateComment(context.Background(), gh.owner, gh.repo, number, &github.IssueComment{Body: github.String(comment)})
+	return err
+}
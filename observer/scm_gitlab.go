@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// gitLab implements SCMProvider for gitlab.com and self-hosted GitLab instances at base,
+// see https://docs.gitlab.com/ee/api/projects.html#hooks
+type gitLab struct {
+	scmRepo
+	base string
+}
+
+type gitLabHook struct {
+	ID  int    `json:"id,omitempty"`
+	URL string `json:"url"`
+}
+
+// the subset of the payload of a GitLab push event the observer needs,
+// see https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#push-events
+type gitLabPushEvent struct {
+	Ref          string `json:"ref"`
+	After        string `json:"after"`
+	UserUsername string `json:"user_username"`
+	// GitLab lists at most 20 commits, this is the number of commits pushed
+	TotalCommitsCount int `json:"total_commits_count"`
+	Commits           []struct {
+		Added    []string `json:"added"`
+		Removed  []string `json:"removed"`
+		Modified []string `json:"modified"`
+	} `json:"commits"`
+}
+
+// the subset of the payload of a GitLab merge request event the observer needs,
+// see https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#merge-request-events
+type gitLabMergeRequestEvent struct {
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	ObjectAttributes struct {
+		IID             int    `json:"iid"`
+		Action          string `json:"action"`
+		OldRev          string `json:"oldrev"`
+		SourceProjectID int    `json:"source_project_id"`
+		TargetProjectID int    `json:"target_project_id"`
+		TargetBranch    string `json:"target_branch"`
+		LastCommit      struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+func (gl *gitLab) Name() string {
+	return SCM_GITLAB
+}
+
+func (gl *gitLab) projectURL() string {
+	project := strings.Replace(gl.owner+"/"+gl.repo, "/", "%2F", -1)
+	return gl.base + "/api/v4/projects/" + project
+}
+
+func (gl *gitLab) hooksURL() string {
+	return gl.projectURL() + "/hooks"
+}
+
+func (gl *gitLab) header() map[string]string {
+	return map[string]string{"PRIVATE-TOKEN": gl.pat}
+}
+
+func (gl *gitLab) Hook() (string, string, error) {
+	hooks := []gitLabHook{}
+	if err := scmCall("GET", gl.hooksURL(), gl.header(), nil, &hooks); err != nil {
+		log.WithFields(log.Fields{"hook": "check"}).Error("Can't query hooks due to ", err)
+		return "", "", err
+	}
+	for _, hook := range hooks {
+		if isDployHook(hook.URL) {
+			return strconv.Itoa(hook.ID), hook.URL, nil
+		}
+	}
+	return "", "", nil
+}
+
+func (gl *gitLab) RegisterHook(deployURL string, secret string) error {
+	hook := map[string]interface{}{
+		"url":                     deployURL,
+		"push_events":             true,
+		"tag_push_events":         true,
+		"merge_requests_events":   true,
+		"token":                   secret,
+		"enable_ssl_verification": true,
+	}
+	hid, _, err := gl.Hook()
+	if err != nil {
+		return err
+	}
+	if hid != "" {
+		return scmCall("PUT", gl.hooksURL()+"/"+hid, gl.header(), hook, nil)
+	}
+	return scmCall("POST", gl.hooksURL(), gl.header(), hook, nil)
+}
+
+func (gl *gitLab) UnregisterHook() error {
+	hid, _, err := gl.Hook()
+	if err != nil || hid == "" {
+		return err
+	}
+	return scmCall("DELETE", gl.hooksURL()+"/"+hid, gl.header(), nil, nil)
+}
+
+// GitLab doesn't sign deliveries but sends the secret token along in X-Gitlab-Token
+func (gl *gitLab) Verify(r *http.Request, body []byte, secret string) error {
+	token := r.Header.Get("X-Gitlab-Token")
+	if token == "" {
+		return errUnsigned
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return fmt.Errorf("Delivery token doesn't match")
+	}
+	return nil
+}
+
+func (gl *gitLab) DeliveryID(r *http.Request) string {
+	return r.Header.Get("X-Gitlab-Event-UUID")
+}
+
+func (gl *gitLab) ParsePush(r *http.Request, body []byte) ([]*Push, string, error) {
+	event := r.Header.Get("X-Gitlab-Event")
+	if event != "Push Hook" && event != "Tag Push Hook" {
+		return nil, event, nil
+	}
+	pe := gitLabPushEvent{}
+	if err := json.Unmarshal(body, &pe); err != nil {
+		return nil, event, err
+	}
+	push := &Push{
+		Ref:     pe.Ref,
+		Commit:  pe.After,
+		Deleted: pe.After == ZERO_SHA,
+		Pusher:  pe.UserUsername,
+		Changed: []string{},
+	}
+	for _, c := range pe.Commits {
+		push.Changed = append(push.Changed, changedFiles(c.Added, c.Removed, c.Modified)...)
+	}
+	if pe.TotalCommitsCount > len(pe.Commits) { // not all commits are listed, so the files changed aren't known
+		push.Changed = nil
+	}
+	return []*Push{push}, event, nil
+}
+
+// Uses the archive endpoint, see https://docs.gitlab.com/ee/api/repositories.html#get-file-archive
+func (gl *gitLab) Download(ref string, archive string) error {
+	return scmDownload(gl.projectURL()+"/repository/archive.zip?sha="+ref, gl.header(), archive)
+}
+
+func (gl *gitLab) HeadSHA(branch string, etag string) (string, string, error) {
+	c, etag, err := scmConditionalGet(gl.projectURL()+"/repository/branches/"+url.PathEscape(branch), gl.header(), etag)
+	if err != nil || c == nil {
+		return "", etag, err
+	}
+	b := struct {
+		Commit struct {
+			ID string `json:"id"`
+		} `json:"commit"`
+	}{}
+	if err := json.Unmarshal(c, &b); err != nil {
+		return "", "", err
+	}
+	return b.Commit.ID, etag, nil
+}
+
+// Merge requests are updated for a number of reasons, only updates carrying
+// new commits (with oldrev set) count
+func (gl *gitLab) ParsePullRequest(r *http.Request, body []byte) (*Push, string, error) {
+	event := r.Header.Get("X-Gitlab-Event")
+	if event != "Merge Request Hook" {
+		return nil, event, nil
+	}
+	me := gitLabMergeRequestEvent{}
+	if err := json.Unmarshal(body, &me); err != nil {
+		return nil, event, err
+	}
+	mr := me.ObjectAttributes
+	switch {
+	case mr.Action == "open", mr.Action == "reopen", mr.Action == "update" && mr.OldRev != "", mr.Action == "close", mr.Action == "merge":
+		// merge request events carry the author only by ID, so this is whoever
+		// opened or updated the merge request:
+		return &Push{
+			Ref:         pullRequestRef(mr.IID),
+			Commit:      mr.LastCommit.ID,
+			Pusher:      me.User.Username,
+			PullRequest: mr.IID,
+			Closed:      mr.Action == "close" || mr.Action == "merge",
+			Base:        mr.TargetBranch,
+			Fork:        mr.SourceProjectID != mr.TargetProjectID,
+			Author:      me.User.Username,
+		}, event, nil
+	}
+	return nil, event + " " + mr.Action, nil
+}
+
+func (gl *gitLab) Comment(number int, comment string) error {
+	note := map[string]string{"body": comment}
+	return scmCall("POST", gl.projectURL()+"/merge_requests/"+strconv.Itoa(number)+"/notes", gl.header(), note, nil)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Tests
+
+func TestVerify(t *testing.T) {
+	secret := "s3cr3t"
+	body := []byte(`{"ref":"refs/heads/dcos","after":"4b825dc642cb6eb9a060e54bf8d69288fbee4904"}`)
+	tampered := []byte(`{"ref":"refs/heads/dcos","after":"9b2cfe1d9e2b6f0e6c1a0b3c5d7e9f1a2b4c6d8e"}`)
+	tests := []struct {
+		name   string
+		scm    SCMProvider
+		header string
+		valid  string
+		forged string
+	}{
+		{"github", &gitHub{}, "X-Hub-Signature-256", "sha256=" + signature(secret, body), "sha256=" + signature(secret, tampered)},
+		{"gitlab", &gitLab{}, "X-Gitlab-Token", secret, "guessed"},
+		{"bitbucket", &bitbucket{}, "X-Hub-Signature", "sha256=" + signature(secret, body), "sha256=" + signature(secret, tampered)},
+		{"gitea", &gitea{}, "X-Gitea-Signature", signature(secret, body), signature(secret, tampered)},
+	}
+	for _, tt := range tests {
+		deliver := func(value string) error {
+			r := httptest.NewRequest("POST", "/dploy/mhausenblas/verify", bytes.NewReader(body))
+			if value != "" {
+				r.Header.Set(tt.header, value)
+			}
+			return tt.scm.Verify(r, body, secret)
+		}
+		if err := deliver(tt.valid); err != nil {
+			t.Errorf("%s: valid delivery rejected: %v", tt.name, err)
+		}
+		if err := deliver(tt.forged); err == nil || err == errUnsigned {
+			t.Errorf("%s: tampered delivery not rejected as such, got %v", tt.name, err)
+		}
+		if err := deliver(""); err != errUnsigned {
+			t.Errorf("%s: unsigned delivery not rejected as such, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestHeadSHAEscapesBranch(t *testing.T) {
+	requested := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.EscapedPath()
+		w.Write([]byte(`{"commit":{"id":"4b825dc6","sha":"4b825dc6"}}`))
+	}))
+	defer server.Close()
+	tests := []struct {
+		scm  SCMProvider
+		want string
+	}{
+		{&gitLab{scmRepo: scmRepo{owner: "mhausenblas", repo: "dploy"}, base: server.URL}, "/api/v4/projects/mhausenblas%2Fdploy/repository/branches/feature%2Fgroups"},
+		{&gitea{scmRepo: scmRepo{owner: "mhausenblas", repo: "dploy"}, base: server.URL}, "/api/v1/repos/mhausenblas/dploy/branches/feature%2Fgroups"},
+	}
+	for _, tt := range tests {
+		if _, _, err := tt.scm.HeadSHA("feature/groups", ""); err != nil {
+			t.Errorf("%s: can't look up head: %v", tt.scm.Name(), err)
+		}
+		if requested != tt.want {
+			t.Errorf("%s: requested %s, want %s", tt.scm.Name(), requested, tt.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// where to keep the state, relative to the state directory:
+	DEFAULT_STATE_FILE string = "dploy-observer-state.json"
+	// the persistent volume Marathon mounts into the sandbox, see observer.json:
+	DEFAULT_STATE_VOLUME string = "state"
+	// how often to try registering a Webhook and how long to wait (in sec) before the next try:
+	DEFAULT_REGISTER_ATTEMPTS int           = 5
+	DEFAULT_REGISTER_BACKOFF  time.Duration = 2
+)
+
+// State is what the observer persists to pick up where it left off after a restart
+type State struct {
+	Watches []WatchState `json:"watches"`
+	Staged  []Job        `json:"staged"`
+}
+
+// WatchState is a watch along with its Webhook and last successful deployment. Rather
+// than the secret the Webhook has been registered with, only its digest is kept.
+type WatchState struct {
+	dploy.Watch
+	HookID           string    `json:"hook_id,omitempty"`
+	HookURL          string    `json:"hook_url,omitempty"`
+	HookSecretDigest string    `json:"hook_secret_sha256,omitempty"`
+	LastDeployment   time.Time `json:"last_deployment"`
+	LastCommit       string    `json:"last_commit,omitempty"`
+}
+
+var (
+	// signals that the state changed and should be persisted
+	stateChanged chan bool
+
+	// guards writing the state file
+	stateMutex sync.Mutex
+)
+
+func init() {
+	stateChanged = make(chan bool, 1)
+}
+
+// Determines where the state is persisted: in DPLOY_OBSERVER_STATE_DIR if set,
+// otherwise on the persistent volume in the Mesos sandbox of the observer, in the
+// sandbox itself if there's no such volume or, outside of Mesos, in the cwd
+func stateDir() string {
+	dir := os.Getenv("DPLOY_OBSERVER_STATE_DIR")
+	if dir == "" {
+		if sandbox := os.Getenv("MESOS_SANDBOX"); sandbox != "" {
+			dir = sandbox
+			if fi, err := os.Stat(filepath.Join(sandbox, DEFAULT_STATE_VOLUME)); err == nil && fi.IsDir() {
+				dir = filepath.Join(sandbox, DEFAULT_STATE_VOLUME)
+			}
+		}
+	}
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	dir, _ = filepath.Abs(dir)
+	return dir
+}
+
+func stateLocation() string {
+	return filepath.Join(stateDir(), DEFAULT_STATE_FILE)
+}
+
+// Marks the state as changed; it's persisted in the background, so this is
+// safe to call while holding jobMutex or watchMutex
+func persist() {
+	select {
+	case stateChanged <- true:
+	default: // already marked
+	}
+}
+
+// Persists the state whenever it changes
+func persistState() {
+	for range stateChanged {
+		saveState()
+	}
+}
+
+// Writes a snapshot of the watches and the jobs awaiting approval to the state file.
+// Secrets are left out: on restore, the ones the watches reference are resolved again
+// and the Webhook secrets are derived again, see hookSecret.
+func saveState() {
+	state := State{Watches: []WatchState{}, Staged: []Job{}}
+	jobMutex.Lock()
+	watchMutex.Lock()
+	for _, w := range watches {
+		wd := w.Watch
+		hookSecretDigest := digest(wd.HookSecret)
+		wd.PAT, wd.AppKey, wd.SMTPPassword, wd.HookSecret = "", "", "", ""
+		state.Watches = append(state.Watches, WatchState{
+			Watch:            wd,
+			HookID:           w.hookID,
+			HookURL:          w.hookURL,
+			HookSecretDigest: hookSecretDigest,
+			LastDeployment:   w.lastDeployment,
+			LastCommit:       w.lastCommit,
+		})
+	}
+	watchMutex.Unlock()
+	for _, job := range staged {
+		state.Staged = append(state.Staged, *job)
+	}
+	jobMutex.Unlock()
+	d, err := json.Marshal(state)
+	if err != nil {
+		log.WithFields(log.Fields{"state": "save"}).Error("Can't encode state due to ", err)
+		return
+	}
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	sf := stateLocation()
+	// write to a temporary file first so that a crash can't leave a truncated state behind:
+	tmp := sf + ".tmp"
+	if err := ioutil.WriteFile(tmp, d, 0600); err != nil {
+		log.WithFields(log.Fields{"state": "save"}).Error("Can't write state to ", tmp, " due to ", err)
+		return
+	}
+	if err := os.Rename(tmp, sf); err != nil {
+		log.WithFields(log.Fields{"state": "save"}).Error("Can't write state to ", sf, " due to ", err)
+		return
+	}
+	log.WithFields(log.Fields{"state": "save"}).Debug("Saved state of ", len(state.Watches), " watches in ", sf)
+}
+
+// Loads the persisted state, if any
+func loadState() State {
+	state := State{}
+	sf := stateLocation()
+	d, err := ioutil.ReadFile(sf)
+	if err != nil {
+		log.WithFields(log.Fields{"state": "load"}).Info("No state found in ", sf)
+		return state
+	}
+	if err := json.Unmarshal(d, &state); err != nil {
+		log.WithFields(log.Fields{"state": "load"}).Error("Can't decode state in ", sf, " due to ", err)
+		return State{}
+	}
+	log.WithFields(log.Fields{"state": "load"}).Info("Loaded state of ", len(state.Watches), " watches from ", sf)
+	return state
+}
+
+// Restores the watches and the jobs awaiting approval from the persisted state and
+// adds the watch configured via environment. If the latter was persisted as well,
+// the environment wins but the Webhook and last deployment are kept. Watches that
+// carried their credentials rather than referencing them can't be restored since
+// the credentials aren't persisted; these have to be added again.
+func restoreState() error {
+	state := loadState()
+	envName := envWatch.Owner + "/" + envWatch.Repo
+	envState := WatchState{Watch: envWatch}
+	for _, ws := range state.Watches {
+		if ws.Owner+"/"+ws.Repo != envName {
+			if ws.PATRef == "" && ws.AppKeyRef == "" {
+				log.WithFields(log.Fields{"state": "restore"}).Error("Can't restore watch of ", ws.Owner, "/", ws.Repo, " since its credentials weren't referenced as DC/OS secrets, use `dploy run` to add it again")
+				continue
+			}
+			if _, err := addWatch(ws); err != nil {
+				log.WithFields(log.Fields{"state": "restore"}).Error("Can't restore watch of ", ws.Owner, "/", ws.Repo, " due to ", err)
+			}
+			continue
+		}
+		envState.HookID, envState.HookURL, envState.HookSecretDigest = ws.HookID, ws.HookURL, ws.HookSecretDigest
+		envState.LastDeployment, envState.LastCommit = ws.LastDeployment, ws.LastCommit
+	}
+	if envWatch.Owner != "" || envWatch.Repo != "" {
+		if _, err := addWatch(envState); err != nil {
+			return err
+		}
+	}
+	jobMutex.Lock()
+	for i := range state.Staged {
+		job := state.Staged[i]
+		staged[job.App] = &job
+		remember(&job)
+	}
+	jobMutex.Unlock()
+	if len(state.Staged) > 0 {
+		log.WithFields(log.Fields{"state": "restore"}).Info("Restored ", len(state.Staged), " deployments awaiting approval")
+	}
+	return nil
+}
+
+// Makes sure the Webhook of the watch is registered and points to the observer,
+// trying again with backoff since neither the SCM provider nor where the observer
+// is reachable may be known right after launch. A Webhook restored from the state
+// is kept as long as it's still in place, so restarts don't re-register it.
+func bootstrap(w *watch) {
+	log.WithFields(log.Fields{"bootstrap": "step"}).Debug("Starting bootstrap process of ", w.name(), " ...")
+	for attempt := 1; attempt <= DEFAULT_REGISTER_ATTEMPTS; attempt++ {
+		result, err := reconcileHook(w)
+		if err == nil {
+			log.WithFields(log.Fields{"bootstrap": "done"}).Debug(result)
+			fmt.Printf("%s\n", result)
+			return
+		}
+		log.WithFields(log.Fields{"bootstrap": "step"}).Info("Attempt ", attempt, " to set up Webhook of ", w.name(), " failed due to ", err)
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(time.Duration(attempt) * DEFAULT_REGISTER_BACKOFF * time.Second):
+		}
+	}
+	log.WithFields(log.Fields{"bootstrap": "done"}).Error("Gave up setting up Webhook of ", w.name(), ", use /register to try again")
+}
+
+// Registers the Webhook of the watch unless the one registered before is still in place
+func reconcileHook(w *watch) (string, error) {
+	loc, err := whereAmI()
+	if err != nil {
+		return "", err
+	}
+	deployURL := loc + "/dploy/" + w.name()
+	hid, hookURL, err := w.scm.Hook()
+	if err != nil {
+		return "", err
+	}
+	watchMutex.Lock()
+	known := hid != "" && hid == w.hookID && hookURL == deployURL && w.hookURL == deployURL
+	watchMutex.Unlock()
+	if known {
+		return fmt.Sprintf("Webhook of %s still registered with %s", w.name(), deployURL), nil
+	}
+	if err := registerHookAt(w, deployURL); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Registered WebHook with %s ", deployURL), nil
+}
+
+// Registers the Webhook of the watch pointing to deployURL and remembers its ID
+func registerHookAt(w *watch, deployURL string) error {
+	if err := w.scm.RegisterHook(deployURL, w.HookSecret); err != nil {
+		return err
+	}
+	hid, _, err := w.scm.Hook()
+	if err != nil {
+		return err
+	}
+	watchMutex.Lock()
+	w.hookID, w.hookURL = hid, deployURL
+	watchMutex.Unlock()
+	persist()
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests
+
+func TestSaveRestoreState(t *testing.T) {
+	defer tempHistory()()
+	dir, _ := ioutil.TempDir("", "dploy-state")
+	defer os.RemoveAll(dir)
+	os.Setenv("DPLOY_OBSERVER_STATE_DIR", dir)
+	defer os.Unsetenv("DPLOY_OBSERVER_STATE_DIR")
+	os.Setenv(dploy.OBSERVER_SECRET_ENV_PREFIX+"PAT_MHAUSENBLAS_SHOP", "s3cr3t")
+	defer os.Unsetenv(dploy.OBSERVER_SECRET_ENV_PREFIX + "PAT_MHAUSENBLAS_SHOP")
+	resetJobs()
+	defer resetJobs()
+	staged = make(map[string]*Job)
+	defer func() { staged = make(map[string]*Job) }()
+	defer func(ew dploy.Watch) { envWatch = ew }(envWatch)
+	// the watches poll the Gitea server, which fails so that they don't queue any deployments:
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	watchOf := func(repo string, pat string, patRef string) dploy.Watch {
+		return dploy.Watch{Owner: "mhausenblas", Repo: repo, SCM: SCM_GITEA, RepoURL: server.URL + "/mhausenblas/" + repo,
+			Mode: dploy.OBSERVER_MODE_POLL, PollInterval: 3600, PAT: pat, PATRef: patRef}
+	}
+	deployed := time.Date(2018, 6, 14, 23, 20, 16, 0, time.UTC)
+	tests := []struct {
+		watch    dploy.Watch
+		restored bool
+	}{
+		{watchOf("shop", "", dploy.OBSERVER_SECRET_ENV_PREFIX+"PAT_MHAUSENBLAS_SHOP"), true},
+		{watchOf("blog", "inline", ""), false}, // its credentials aren't persisted
+		{watchOf("dploy", "inline", ""), true}, // configured via environment
+	}
+	for _, tt := range tests {
+		w, err := addWatch(WatchState{Watch: tt.watch})
+		if err != nil {
+			t.Fatalf("can't watch %s: %v", tt.watch.Repo, err)
+		}
+		jobMutex.Lock()
+		w.lastDeployment, w.lastCommit = deployed, "9fceb02d"
+		jobMutex.Unlock()
+	}
+	jobMutex.Lock()
+	staged["mhausenblas/shop"] = &Job{ID: "staged", Repo: "mhausenblas/shop", App: "mhausenblas/shop", State: JOB_STAGED, Expires: deployed.Add(24 * time.Hour)}
+	jobMutex.Unlock()
+	saveState()
+
+	fi, err := os.Stat(stateLocation())
+	if err != nil {
+		t.Fatalf("state not saved: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("state saved with permissions %v, want 0600", fi.Mode().Perm())
+	}
+	d, _ := ioutil.ReadFile(stateLocation())
+	if strings.Contains(string(d), "s3cr3t") || strings.Contains(string(d), "inline") {
+		t.Errorf("state carries secrets: %s", d)
+	}
+	saved := State{}
+	json.Unmarshal(d, &saved)
+	for _, ws := range saved.Watches {
+		if ws.HookSecretDigest == "" || ws.HookSecret != "" {
+			t.Errorf("watch of %s saved with hook secret %q and digest %q", ws.Repo, ws.HookSecret, ws.HookSecretDigest)
+		}
+	}
+
+	for _, name := range []string{"mhausenblas/shop", "mhausenblas/blog", "mhausenblas/dploy"} {
+		removeWatch(name)
+	}
+	defer func() {
+		for _, name := range []string{"mhausenblas/shop", "mhausenblas/blog", "mhausenblas/dploy"} {
+			removeWatch(name)
+		}
+	}()
+	resetJobs()
+	staged = make(map[string]*Job)
+	envWatch = watchOf("dploy", "inline", "")
+	if err := restoreState(); err != nil {
+		t.Fatalf("can't restore state: %v", err)
+	}
+	for _, tt := range tests {
+		w, ok := lookupWatch("mhausenblas/" + tt.watch.Repo)
+		if ok != tt.restored {
+			t.Errorf("watch of %s restored: %t, want %t", tt.watch.Repo, ok, tt.restored)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		jobMutex.Lock()
+		if w.lastCommit != "9fceb02d" || !w.lastDeployment.Equal(deployed) {
+			t.Errorf("watch of %s restored with last deployment of %s at %s", tt.watch.Repo, w.lastCommit, w.lastDeployment)
+		}
+		jobMutex.Unlock()
+	}
+	if w, ok := lookupWatch("mhausenblas/shop"); ok && w.PAT != "s3cr3t" {
+		t.Errorf("token of mhausenblas/shop not resolved again, got %q", w.PAT)
+	}
+	if job, ok := lookupJob("staged"); !ok || job.State != JOB_STAGED {
+		t.Errorf("deployment awaiting approval not restored, got %+v", job)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how long (in hours) to remember deliveries for replay detection:
+	DEFAULT_DELIVERY_TTL time.Duration = 24
+	// reasons for rejecting a Webhook delivery:
+	REJECT_UNSIGNED  string = "unsigned"
+	REJECT_SIGNATURE string = "bad_signature"
+	REJECT_REPLAY    string = "replayed"
+)
+
+var (
+	// deliveries seen so far, by repo and digest of the payload, along with when they have been seen
+	deliveries map[string]time.Time
+
+	// number of rejected deliveries, by reason
+	rejections map[string]int
+
+	// guards deliveries and rejections
+	deliveryMutex sync.Mutex
+)
+
+func init() {
+	deliveries = make(map[string]time.Time)
+	rejections = map[string]int{
+		REJECT_UNSIGNED:  0,
+		REJECT_SIGNATURE: 0,
+		REJECT_REPLAY:    0,
+	}
+}
+
+// Generates a random secret for signing Webhook deliveries
+func generateSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		log.WithFields(log.Fields{"hook": "secret"}).Fatal("Can't generate Webhook secret due to ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Derives the secret for signing the Webhook deliveries of the watch from its
+// credentials, so that the same secret results after a restart without having to
+// persist it; without credentials, a random secret is generated
+func hookSecret(wd dploy.Watch) string {
+	key := wd.PAT
+	if wd.AppID != 0 {
+		key = wd.AppKey
+	}
+	if key == "" {
+		return generateSecret()
+	}
+	return signature(key, []byte("dploy-webhook:"+wd.Owner+"/"+wd.Repo))
+}
+
+// Computes the hex encoded HMAC of a delivery the SCM providers send along,
+// see for example https://developer.github.com/webhooks/securing/
+func signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks if a Webhook delivery is signed with the secret of the watch and hasn't been seen
+// before. If not, the delivery is counted as rejected and the reason is returned as an error.
+// Since the delivery ID is a header the signature doesn't cover, replays are detected by the
+// digest of the payload instead; the payload carries the commit as well as the time stamps
+// of the event, so only re-sending the very same delivery matches.
+func verifyDelivery(w *watch, r *http.Request, body []byte) error {
+	deliveryMutex.Lock()
+	defer deliveryMutex.Unlock()
+	if err := w.scm.Verify(r, body, w.HookSecret); err != nil {
+		if err == errUnsigned {
+			rejections[REJECT_UNSIGNED]++
+			deliveriesTotal.WithLabelValues(REJECT_UNSIGNED).Inc()
+		} else {
+			rejections[REJECT_SIGNATURE]++
+			deliveriesTotal.WithLabelValues(REJECT_SIGNATURE).Inc()
+		}
+		return err
+	}
+	id := w.scm.DeliveryID(r)
+	digest := sha256.Sum256(body)
+	key := w.name() + "@" + hex.EncodeToString(digest[:])
+	for d, seen := range deliveries { // forget about old deliveries
+		if time.Since(seen) > DEFAULT_DELIVERY_TTL*time.Hour {
+			delete(deliveries, d)
+		}
+	}
+	if _, seen := deliveries[key]; seen {
+		rejections[REJECT_REPLAY]++
+		deliveriesTotal.WithLabelValues(REJECT_REPLAY).Inc()
+		return fmt.Errorf("Delivery %s has been replayed", id)
+	}
+	deliveries[key] = time.Now()
+	log.WithFields(log.Fields{"hook": "verify"}).Debug("Accepted delivery ", id)
+	return nil
+}
+
+// Returns a snapshot of the number of rejected deliveries, by reason
+func rejectionCounts() map[string]int {
+	deliveryMutex.Lock()
+	defer deliveryMutex.Unlock()
+	c := make(map[string]int)
+	for reason, count := range rejections {
+		c[reason] = count
+	}
+	return c
+}
+
+// Decodes a Webhook delivery and decides if it should trigger a deployment: only
+// pushes to the target branch of the watch or of tags matching one of its tag
+// patterns do and, if only spec changes count or a workspace path is set, only if
+// they touch a dploy app. With previews enabled, pull requests being opened, updated
+// or closed do, too. If a push updates several refs, the first one that qualifies
+// triggers the deployment. If none does, the reason why the delivery is ignored is returned.
+func parseDelivery(w *watch, r *http.Request, body []byte) (*Push, string) {
+	pushes, event, err := w.scm.ParsePush(r, body)
+	if err == nil && len(pushes) == 0 && w.Previews {
+		var pr *Push
+		pr, event, err = w.scm.ParsePullRequest(r, body)
+		if pr != nil {
+			pushes = []*Push{pr}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Sprintf("Ignoring %s event since I can't decode it due to %s", event, err)
+	}
+	if len(pushes) == 0 {
+		if event == "ping" {
+			return nil, "pong"
+		}
+		return nil, fmt.Sprintf("Ignoring %s event", event)
+	}
+	reasons := []string{}
+	for _, push := range pushes {
+		reason := qualifies(w, push)
+		if reason == "" {
+			return push, ""
+		}
+		reasons = append(reasons, reason)
+	}
+	return nil, strings.Join(reasons, "; ")
+}
+
+// Checks if the push qualifies for a deployment, see parseDelivery, and collects the
+// workspaces it touches. If not, the reason why it's ignored is returned.
+func qualifies(w *watch, push *Push) string {
+	if push.PullRequest != 0 { // previews always contain all dploy apps
+		return previewQualifies(w, push)
+	}
+	if push.Deleted || push.Commit == "" {
+		return fmt.Sprintf("Ignoring deletion of %s", push.Ref)
+	}
+	if !refMatches(w, push.Ref) {
+		return fmt.Sprintf("Ignoring push to %s", push.Ref)
+	}
+	if !w.OnlySpecChanges && w.WorkspacePath == "" { // any push deploys the one and only app
+		return ""
+	}
+	push.Workspaces = touchedWorkspaces(w, push)
+	if push.Workspaces != nil && len(push.Workspaces) == 0 {
+		if w.OnlySpecChanges {
+			return fmt.Sprintf("Ignoring push to %s since it doesn't change %s or %s of any dploy app", push.Ref, dploy.APP_DESCRIPTOR_FILENAME, dploy.MARATHON_APP_SPEC_DIR)
+		}
+		return fmt.Sprintf("Ignoring push to %s since it doesn't touch any dploy app in %s", push.Ref, w.WorkspacePath)
+	}
+	return ""
+}
+
+// Checks if ref is the target branch of the watch or a tag matching one of its tag patterns
+func refMatches(w *watch, ref string) bool {
+	if ref == "refs/heads/"+w.TargetBranch {
+		return true
+	}
+	if strings.HasPrefix(ref, "refs/tags/") {
+		tag := strings.TrimPrefix(ref, "refs/tags/")
+		for _, pattern := range w.TagPatterns {
+			if ok, _ := path.Match(pattern, tag); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Determines the workspace of the dploy app file f belongs to, if any, along
+// with the path of f within the workspace. Workspaces are the directories
+// matching the workspace path of the watch, for example 'deploy/*', or the repo root if not set.
+func workspaceOf(w *watch, f string) (string, string, bool) {
+	if w.WorkspacePath == "" {
+		return ".", f, true
+	}
+	pattern := strings.Trim(w.WorkspacePath, "/")
+	depth := len(strings.Split(pattern, "/"))
+	segments := strings.SplitN(f, "/", depth+1)
+	if len(segments) <= depth {
+		return "", "", false
+	}
+	ws := strings.Join(segments[:depth], "/")
+	if ok, _ := path.Match(pattern, ws); !ok {
+		return "", "", false
+	}
+	return ws, segments[depth], true
+}
+
+// Collects the workspaces of the dploy apps a push touches; if only spec changes
+// count, only changes of the app descriptor or app specs do. If the SCM provider
+// doesn't tell which files changed, nil is returned meaning all of them.
+func touchedWorkspaces(w *watch, push *Push) []string {
+	if push.Changed == nil {
+		return nil
+	}
+	touched := []string{}
+	seen := map[string]bool{}
+	for _, f := range push.Changed {
+		ws, rest, ok := workspaceOf(w, f)
+		if !ok || seen[ws] {
+			continue
+		}
+		if w.OnlySpecChanges && rest != dploy.APP_DESCRIPTOR_FILENAME && !strings.HasPrefix(rest, dploy.MARATHON_APP_SPEC_DIR) {
+			continue
+		}
+		seen[ws] = true
+		touched = append(touched, ws)
+	}
+	sort.Strings(touched)
+	return touched
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	dploy "github.com/mhausenblas/dploy/lib"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests
+
+func TestVerifyDeliveryReplay(t *testing.T) {
+	deliveryMutex.Lock()
+	deliveries = make(map[string]time.Time)
+	deliveryMutex.Unlock()
+	w := &watch{Watch: dploy.Watch{Owner: "mhausenblas", Repo: "replay", HookSecret: "s3cr3t"}, scm: &gitHub{}}
+	deliver := func(id string, body string) error {
+		r := httptest.NewRequest("POST", "/dploy/mhausenblas/replay", bytes.NewBufferString(body))
+		r.Header.Set("X-GitHub-Delivery", id)
+		r.Header.Set("X-Hub-Signature-256", "sha256="+signature(w.HookSecret, []byte(body)))
+		return verifyDelivery(w, r, []byte(body))
+	}
+	push := `{"ref":"refs/heads/dcos","after":"4b825dc642cb6eb9a060e54bf8d69288fbee4904"}`
+	if err := deliver("1", push); err != nil {
+		t.Fatalf("first delivery rejected: %v", err)
+	}
+	if err := deliver("1", push); err == nil {
+		t.Error("replayed delivery accepted")
+	}
+	if err := deliver("2", push); err == nil {
+		t.Error("replayed delivery with a different ID accepted")
+	}
+	if err := deliver("2", `{"ref":"refs/heads/dcos","after":"9b2cfe1d9e2b6f0e6c1a0b3c5d7e9f1a2b4c6d8e"}`); err != nil {
+		t.Errorf("new delivery rejected: %v", err)
+	}
+}
+
+func TestRefMatches(t *testing.T) {
+	w := &watch{Watch: dploy.Watch{TargetBranch: "dcos", TagPatterns: []string{"v*"}}}
+	tests := []struct {
+		ref  string
+		want bool
+	}{
+		{"refs/heads/dcos", true},
+		{"refs/heads/master", false},
+		{"refs/heads/dcos-next", false},
+		{"refs/tags/v1.0.0", true},
+		{"refs/tags/release-1", false},
+		{"refs/heads/v1.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := refMatches(w, tt.ref); got != tt.want {
+			t.Errorf("refMatches(%s) = %v, want %v", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestParseDelivery(t *testing.T) {
+	w := &watch{Watch: dploy.Watch{TargetBranch: "dcos", OnlySpecChanges: true}, scm: &gitHub{}}
+	tests := []struct {
+		name   string
+		event  string
+		body   string
+		deploy bool
+	}{
+		{"ping", "ping", `{"zen":"Keep it logically awesome."}`, false},
+		{"issue", "issues", `{"action":"opened"}`, false},
+		{"other branch", "push", `{"ref":"refs/heads/master","after":"4b825dc642cb6eb9a060e54bf8d69288fbee4904","commits":[{"modified":["dploy.app"]}]}`, false},
+		{"deletion", "push", `{"ref":"refs/heads/dcos","after":"0000000000000000000000000000000000000000","deleted":true}`, false},
+		{"no spec change", "push", `{"ref":"refs/heads/dcos","after":"4b825dc642cb6eb9a060e54bf8d69288fbee4904","commits":[{"modified":["README.md"]}]}`, false},
+		{"descriptor change", "push", `{"ref":"refs/heads/dcos","after":"4b825dc642cb6eb9a060e54bf8d69288fbee4904","commits":[{"modified":["README.md"]},{"modified":["dploy.app"]}]}`, true},
+		{"spec added", "push", `{"ref":"refs/heads/dcos","after":"4b825dc642cb6eb9a060e54bf8d69288fbee4904","commits":[{"added":["specs/web.json"]}]}`, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/dploy/mhausenblas/parse", bytes.NewBufferString(tt.body))
+		r.Header.Set("X-GitHub-Event", tt.event)
+		push, msg := parseDelivery(w, r, []byte(tt.body))
+		if deployed := push != nil; deployed != tt.deploy {
+			t.Errorf("%s: deploy = %v, want %v (%s)", tt.name, deployed, tt.deploy, msg)
+		}
+		if tt.event == "ping" && msg != "pong" {
+			t.Errorf("%s: got %q, want pong", tt.name, msg)
+		}
+	}
+}
+
+func TestWorkspaceOf(t *testing.T) {
+	w := &watch{Watch: dploy.Watch{WorkspacePath: "/deploy/*/"}}
+	tests := []struct {
+		f, ws, rest string
+		ok          bool
+	}{
+		{"deploy/web/dploy.app", "deploy/web", "dploy.app", true},
+		{"deploy/web/specs/app.json", "deploy/web", "specs/app.json", true},
+		{"deploy/README.md", "", "", false},
+		{"src/web/main.go", "", "", false},
+		{"deploy", "", "", false},
+	}
+	for _, tt := range tests {
+		ws, rest, ok := workspaceOf(w, tt.f)
+		if ws != tt.ws || rest != tt.rest || ok != tt.ok {
+			t.Errorf("workspaceOf(%s) = %s, %s, %v, want %s, %s, %v", tt.f, ws, rest, ok, tt.ws, tt.rest, tt.ok)
+		}
+	}
+	root := &watch{}
+	if ws, rest, ok := workspaceOf(root, "specs/app.json"); ws != "." || rest != "specs/app.json" || !ok {
+		t.Errorf("workspaceOf(specs/app.json) without workspace path = %s, %s, %v", ws, rest, ok)
+	}
+}
+
+func TestParseDeliveryWorkspaces(t *testing.T) {
+	w := &watch{Watch: dploy.Watch{TargetBranch: "dcos", WorkspacePath: "deploy/*"}, scm: &gitHub{}}
+	body := `{"ref":"refs/heads/dcos","after":"4b825dc642cb6eb9a060e54bf8d69288fbee4904","commits":[{"modified":["deploy/web/specs/web.json","README.md"]},{"added":["deploy/db/dploy.app","deploy/web/dploy.app"]}]}`
+	r := httptest.NewRequest("POST", "/dploy/mhausenblas/parse", bytes.NewBufferString(body))
+	r.Header.Set("X-GitHub-Event", "push")
+	push, msg := parseDelivery(w, r, []byte(body))
+	if push == nil {
+		t.Fatalf("push ignored: %s", msg)
+	}
+	if got := strings.Join(push.Workspaces, ","); got != "deploy/db,deploy/web" {
+		t.Errorf("workspaces = %s, want deploy/db,deploy/web", got)
+	}
+	body = `{"ref":"refs/heads/dcos","after":"4b825dc642cb6eb9a060e54bf8d69288fbee4904","commits":[{"modified":["README.md"]}]}`
+	r = httptest.NewRequest("POST", "/dploy/mhausenblas/parse", bytes.NewBufferString(body))
+	r.Header.Set("X-GitHub-Event", "push")
+	if push, _ := parseDelivery(w, r, []byte(body)); push != nil {
+		t.Errorf("push outside of any workspace deploys %v", push.Workspaces)
+	}
+}
+
+func TestParseDeliveryBitbucketChanges(t *testing.T) {
+	w := &watch{Watch: dploy.Watch{TargetBranch: "dcos"}, scm: &bitbucket{}}
+	body := `{"actor":{"display_name":"Michael"},"push":{"changes":[` +
+		`{"new":{"type":"branch","name":"master","target":{"hash":"4b825dc642cb6eb9a060e54bf8d69288fbee4904"}}},` +
+		`{"new":{"type":"branch","name":"dcos","target":{"hash":"9b2cfe1d9e2b6f0e6c1a0b3c5d7e9f1a2b4c6d8e"}}}]}}`
+	r := httptest.NewRequest("POST", "/dploy/mhausenblas/parse", bytes.NewBufferString(body))
+	r.Header.Set("X-Event-Key", "repo:push")
+	push, msg := parseDelivery(w, r, []byte(body))
+	if push == nil {
+		t.Fatalf("push to target branch in second change ignored: %s", msg)
+	}
+	if push.Ref != "refs/heads/dcos" || push.Commit != "9b2cfe1d9e2b6f0e6c1a0b3c5d7e9f1a2b4c6d8e" {
+		t.Errorf("deploying %s at %s, want refs/heads/dcos at 9b2cfe1d", push.Ref, push.Commit)
+	}
+}
+
+func TestParseDeliveryTruncatedCommits(t *testing.T) {
+	w := &watch{Watch: dploy.Watch{TargetBranch: "dcos", OnlySpecChanges: true}, scm: &gitHub{}}
+	commits := strings.TrimSuffix(strings.Repeat(`{"modified":["README.md"]},`, GITHUB_PUSH_COMMITS_CAP), ",")
+	body := `{"ref":"refs/heads/dcos","after":"4b825dc642cb6eb9a060e54bf8d69288fbee4904","commits":[` + commits + `]}`
+	r := httptest.NewRequest("POST", "/dploy/mhausenblas/parse", bytes.NewBufferString(body))
+	r.Header.Set("X-GitHub-Event", "push")
+	push, msg := parseDelivery(w, r, []byte(body))
+	if push == nil {
+		t.Fatalf("push with possibly truncated commits ignored: %s", msg)
+	}
+	if push.Workspaces != nil {
+		t.Errorf("deploying %v, want all workspaces", push.Workspaces)
+	}
+}
+
+func TestParseDeliveryPullRequests(t *testing.T) {
+	pr := func(action string, head string, base string, association string) string {
+		return `{"action":"` + action + `","number":42,"sender":{"login":"octocat"},"pull_request":{"user":{"login":"octocat"},"author_association":"` + association + `",` +
+			`"head":{"sha":"4b825dc642cb6eb9a060e54bf8d69288fbee4904","repo":` + head + `},"base":{"ref":"` + base + `","repo":{"full_name":"mhausenblas/dploy"}}}}`
+	}
+	same, fork := `{"full_name":"mhausenblas/dploy"}`, `{"full_name":"octocat/dploy"}`
+	tests := []struct {
+		name    string
+		forks   bool
+		authors []string
+		body    string
+		deploy  bool
+	}{
+		{"same repo", false, nil, pr("opened", same, "dcos", "CONTRIBUTOR"), true},
+		{"same repo into other branch", false, nil, pr("opened", same, "master", "OWNER"), false},
+		{"fork", false, nil, pr("opened", fork, "dcos", "COLLABORATOR"), false},
+		{"fork by collaborator", true, nil, pr("synchronize", fork, "dcos", "COLLABORATOR"), true},
+		{"fork by stranger", true, nil, pr("opened", fork, "dcos", "NONE"), false},
+		{"fork by preview author", true, []string{"hubot", " OctoCat"}, pr("opened", fork, "dcos", "NONE"), true},
+		{"deleted fork", true, nil, pr("synchronize", "null", "dcos", "NONE"), false},
+		{"closed fork", true, nil, pr("closed", fork, "dcos", "NONE"), true},
+		{"closed fork without opting in", false, nil, pr("closed", fork, "dcos", "NONE"), false},
+	}
+	for _, tt := range tests {
+		w := &watch{Watch: dploy.Watch{TargetBranch: "dcos", Previews: true, PreviewForks: tt.forks, PreviewAuthors: tt.authors}, scm: &gitHub{}}
+		r := httptest.NewRequest("POST", "/dploy/mhausenblas/parse", bytes.NewBufferString(tt.body))
+		r.Header.Set("X-GitHub-Event", "pull_request")
+		push, msg := parseDelivery(w, r, []byte(tt.body))
+		if deployed := push != nil; deployed != tt.deploy {
+			t.Errorf("%s: deploy = %v, want %v (%s)", tt.name, deployed, tt.deploy, msg)
+		}
+	}
+}
+
+func TestParsePullRequestForks(t *testing.T) {
+	tests := []struct {
+		scm    SCMProvider
+		header string
+		event  string
+		body   string
+	}{
+		{&gitLab{}, "X-Gitlab-Event", "Merge Request Hook",
+			`{"user":{"username":"octocat"},"object_attributes":{"iid":42,"action":"open","source_project_id":2,"target_project_id":1,"target_branch":"dcos","last_commit":{"id":"4b825dc6"}}}`},
+		{&bitbucket{}, "X-Event-Key", "pullrequest:created",
+			`{"actor":{"display_name":"Octocat"},"pullrequest":{"id":42,"author":{"nickname":"octocat"},` +
+				`"source":{"commit":{"hash":"4b825dc6"},"repository":{"full_name":"octocat/dploy"}},"destination":{"branch":{"name":"dcos"},"repository":{"full_name":"mhausenblas/dploy"}}}}`},
+		{&gitea{}, "X-Gitea-Event", "pull_request",
+			`{"action":"opened","number":42,"sender":{"login":"octocat"},"pull_request":{"user":{"login":"octocat"},"head":{"sha":"4b825dc6","repo_id":2},"base":{"ref":"dcos","repo_id":1}}}`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/dploy/mhausenblas/parse", bytes.NewBufferString(tt.body))
+		r.Header.Set(tt.header, tt.event)
+		push, _, err := tt.scm.ParsePullRequest(r, []byte(tt.body))
+		if err != nil || push == nil {
+			t.Fatalf("%s: can't parse pull request: %v", tt.scm.Name(), err)
+		}
+		if !push.Fork || push.Base != "dcos" || push.Author != "octocat" || push.Collaborator {
+			t.Errorf("%s: got fork %v into %s by %s (collaborator %v), want fork into dcos by octocat", tt.scm.Name(), push.Fork, push.Base, push.Author, push.Collaborator)
+		}
+	}
+}